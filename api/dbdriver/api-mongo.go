@@ -1,94 +1,289 @@
 package apimongo
 
 import (
-	"context"
 	"encoding/json"
+	"fmt"
 	"log"
-	"os"
+	"time"
 
+	"github.com/m-h-w/nmea-logger/storage"
 	"github.com/m-h-w/nmea-logger/transform"
-
-	"github.com/joho/godotenv"
 	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 var debug bool = true
-var mongoClient *mongo.Client // the actual mongo client object
+var store storage.Store // Mongo Atlas or local files, see the storage package
 
-// very basic query with no paging (NP). Returns a mongo cursor containg the results
+// very basic query with no paging (NP). Returns a cursor containg the results
 // query element <qe> in the collection <table>
 
-func npBasicQuery(qe string, table string) *mongo.Cursor {
+func npBasicQuery(qe string, table string) (storage.Cursor, error) {
 
-	activeDB := os.Getenv("ACTIVEDB")
-	coll := mongoClient.Database(activeDB).Collection(table)
+	if debug {
+		log.Printf("Querying table:%s", table)
+	}
 
 	// select all the documents that contain the searchElement we are searching for
-	filter := bson.M{qe: bson.M{"$exists": true}}
+	cursor, err := store.Range(table, qe, time.Time{}, time.Time{})
+	if err != nil {
+		log.Printf("Error in NpBasicQuery store.Range() %s", err)
+	}
+	return cursor, err
+}
 
-	if debug {
-		log.Printf("Querying table:%s in DB:%s", table, activeDB)
+func InitDB() {
+
+	log.Println("Connecting to data store.")
+	store = storage.Open() // the mongo store checks the collection schemas when it connects
+	log.Println("Connected to data store.")
+}
+
+func ShutDownDB() {
+
+	store.Close()
+	log.Println("Connection to data store closed.")
+}
+
+// returns the track from a low res table simplified to within tolerance metres and then to no more than
+// maxPoints positions, see transform/simplify.go. 0 for either leaves it out.
+func GetLrPosition(table string, tolerance float64, maxPoints int) ([]byte, error) {
+	var results []transform.PositionData_t
+
+	cursor, err := npBasicQuery(transform.FIELD_LAT, table)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := storage.All(cursor, &results); err != nil {
+		log.Printf("error in NpBasicQuery")
+		return nil, err
+	}
+
+	if tolerance > 0 {
+		results = transform.SimplifyTrack(results, tolerance)
 	}
+	if maxPoints > 0 && len(results) > maxPoints {
+		results = transform.SimplifyTrackTo(results, maxPoints)
+	}
+
+	jsonResults, err := json.Marshal(results)
 
-	cursor, err := coll.Find(context.TODO(), filter)
 	if err != nil {
-		if debug {
-			log.Printf("Error in NpBasicQuery coll.Find()")
-		}
-		log.Fatal(err)
+		log.Printf("Marshalling error in GetLRPosition() %s\n", err)
+		return nil, err
 	}
 
-	return cursor
+	return jsonResults, nil
+}
+
+// engine data for a session is stored in its own collections, see transform/engine.go
+func GetEngineRapid(session string) ([]transform.EngineRapidData_t, error) {
+	var results []transform.EngineRapidData_t
+
+	cursor, err := npBasicQuery(transform.FIELD_RPM, session+transform.ENGINE_RAPID_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
 
+	if err := storage.All(cursor, &results); err != nil {
+		log.Printf("error reading engine rapid data %s\n", err)
+		return nil, err
+	}
+	return results, nil
 }
 
-func InitDB() {
+func GetEngineDynamic(session string) ([]transform.EngineDynamicData_t, error) {
+	var results []transform.EngineDynamicData_t
 
-	log.Println("Connecting to Mongo DB.")
+	cursor, err := npBasicQuery(transform.FIELD_FUEL_RATE, session+transform.ENGINE_DYNAMIC_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := godotenv.Load(); err != nil {
-		log.Println("No .env file found")
+	if err := storage.All(cursor, &results); err != nil {
+		log.Printf("error reading engine dynamic data %s\n", err)
+		return nil, err
 	}
-	uri := os.Getenv("MONGODB_URI")
-	if uri == "" {
-		log.Fatal("You must set your 'MONGODB_URI' environmental variable. See\n\t https://docs.mongodb.com/drivers/go/current/usage-examples/#environment-variable")
+	return results, nil
+}
+
+// a page of results from a time range query and the token for the next page
+type page_t struct {
+	Results    interface{} `json:"results"`
+	Next       string      `json:"next"`                 // pass back as ?page= to get the next page. Empty on the last page
+	Resolution string      `json:"resolution,omitempty"` // the low res level the results came from, empty for full resolution
+}
+
+// high resolution position data between two times from the main session collection, a page at a time
+func GetHrPosition(session string, start time.Time, stop time.Time, limit int64, page string) ([]byte, error) {
+
+	results := []transform.PositionData_t{}
+	q := storage.RangeQuery_t{Collection: session, Field: transform.FIELD_LAT, Start: start, End: stop, Limit: limit, After: page}
+
+	next, err := store.Query(q, &results)
+	if err != nil {
+		log.Printf("error in GetHrPosition() %s\n", err)
+		return nil, err
 	}
-	client, err := mongo.Connect(context.TODO(), options.Client().ApplyURI(uri))
+
+	return json.Marshal(page_t{Results: results, Next: next})
+}
+
+// any measurement between two times. The documents are returned as they are stored, optionally cut down
+// to the fields in projection. resolution is the low res level q reads from, "" for full resolution.
+func GetMeasurements(q storage.RangeQuery_t, resolution string) ([]byte, error) {
+
+	results := []bson.M{}
+
+	next, err := store.Query(q, &results)
 	if err != nil {
-		panic(err)
+		log.Printf("error in GetMeasurements() %s\n", err)
+		return nil, err
 	}
 
-	log.Println("Connected to Mongo DB.")
-	mongoClient = client
+	return json.Marshal(page_t{Results: results, Next: next, Resolution: resolution})
+}
 
+// a page of performance snapshots and the polar they were compared with
+type performancePage_t struct {
+	page_t
+	Polar string `json:"polar,omitempty"` // empty if there wasnt one
 }
 
-func ShutDownDB() {
+// the performance fields of a session's snapshots between two times, see transform/performance.go
+func GetPerformance(q storage.RangeQuery_t, resolution string, session string) ([]byte, error) {
+
+	entry, err := transform.LoadSession(store, session)
+	if err != nil {
+		return nil, err
+	}
 
-	if err := mongoClient.Disconnect(context.TODO()); err != nil {
-		panic(err)
+	results := []bson.M{}
+	next, err := store.Query(q, &results)
+	if err != nil {
+		log.Printf("error in GetPerformance() %s\n", err)
+		return nil, err
 	}
-	log.Println("Connection to MongoDB closed.")
+
+	return json.Marshal(performancePage_t{page_t{Results: results, Next: next, Resolution: resolution}, entry.Polar})
 }
 
-func GetLrPosition(table string) ([]byte, error) {
-	var results []transform.PositionData_t
+// the manoeuvres in a session between two times with how well they were sailed, see transform/manoeuvres.go
+func GetManoeuvres(session string, start time.Time, stop time.Time) ([]transform.ManoeuvreRecord_t, error) {
+
+	records, err := transform.SessionManoeuvres(store, session, start, stop)
+	if err != nil {
+		log.Printf("error in GetManoeuvres() %s\n", err)
+	}
+	return records, err
+}
 
-	cursor := npBasicQuery("lat", table)
+// the course sailed in a session and its legs, see transform/course.go
+func GetCourse(session string) (transform.Course_t, error) {
 
-	if err := cursor.All(context.TODO(), &results); err != nil {
-		log.Printf("error in NpBasicQuery")
-		panic(err)
+	course, err := transform.LoadCourse(store, session)
+	if err != nil && err != storage.ErrNotFound {
+		log.Printf("error in GetCourse() %s\n", err)
 	}
+	return course, err
+}
 
-	jsonResults, err := json.Marshal(results)
+// a session's start, the one analysed with -gun if gun is zero, otherwise worked out at gun on line (or the
+// course's start line if line is nil). See transform/start.go
+func GetStart(session string, line *transform.Line_t, gun time.Time) (transform.Start_t, error) {
 
-	if err != nil {
-		log.Printf("Marshalling error in GetLRPosition() %s\n", err)
+	var start transform.Start_t
+	var err error
+	if gun.IsZero() {
+		start, err = transform.LoadStart(store, session)
+	} else {
+		start, err = transform.AnalyseStart(store, session, line, gun)
+	}
+	if err != nil && err != storage.ErrNotFound {
+		log.Printf("error in GetStart() %s\n", err)
+	}
+	return start, err
+}
+
+// every session in the catalog, see transform/catalog.go
+func GetSessions() ([]transform.Session_t, error) {
+
+	sessions := []transform.Session_t{}
+	if err := store.GetAll(transform.SESSION_CATALOG, &sessions); err != nil {
+		log.Printf("error reading the session catalog %s\n", err)
 		return nil, err
 	}
+	return sessions, nil
+}
 
-	return jsonResults, nil
+// The full resolution data has no fixed rate but the B&G rapid updates come ten times a second, which is
+// what is assumed when deciding whether it has too many points to return.
+const FULL_RES_INTERVAL = 100 * time.Millisecond
+
+// Picks the data to read for a time range so that there are no more than about maxPoints documents of each
+// measurement: the full resolution data if that is small enough, otherwise the finest level of the session's
+// low res pyramid that is, otherwise the coarsest level. snapshots restricts the choice to levels with
+// snapshots. Returns the collection and the level name, which is "" for the full resolution data.
+func PickResolution(session string, start time.Time, stop time.Time, maxPoints int64, snapshots bool) (string, string, error) {
+
+	entry, err := transform.LoadSession(store, session)
+	if err != nil {
+		return "", "", err
+	}
+	span := stop.Sub(start)
+
+	if !snapshots && int64(span/FULL_RES_INTERVAL) <= maxPoints {
+		return session, "", nil
+	}
+
+	var chosen *transform.Level_t
+	levels := transform.SessionLevels(entry)
+	for i := range levels {
+		if snapshots && levels[i].Snapshots == "" {
+			continue
+		}
+		chosen = &levels[i]
+		if int64(span/levels[i].Resolution) <= maxPoints {
+			break
+		}
+	}
+	if chosen == nil {
+		if snapshots {
+			return "", "", fmt.Errorf("session %s has no snapshots", session)
+		}
+		return session, "", nil // no pyramid, all there is is the full resolution data
+	}
+
+	if snapshots {
+		return chosen.Snapshots, chosen.Name, nil
+	}
+	return chosen.Collection, chosen.Name, nil
+}
+
+// the collection holding a level of a session's low res pyramid, or its snapshots
+func LevelCollection(session string, name string, snapshots bool) (string, error) {
+
+	entry, err := transform.LoadSession(store, session)
+	if err != nil {
+		return "", err
+	}
+	for _, level := range transform.SessionLevels(entry) {
+		if level.Name != name {
+			continue
+		}
+		if !snapshots {
+			return level.Collection, nil
+		}
+		if level.Snapshots != "" {
+			return level.Snapshots, nil
+		}
+	}
+	return "", fmt.Errorf("session %s has no %s level", session, name)
+}
+
+// the time span of a session from the catalog
+func SessionSpan(session string) (time.Time, time.Time, error) {
+
+	entry, err := transform.LoadSession(store, session)
+	return entry.Start, entry.End, err
 }
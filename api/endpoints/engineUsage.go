@@ -0,0 +1,132 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	apimongo "github.com/m-h-w/nmea-logger/api/dbdriver"
+	"github.com/m-h-w/nmea-logger/transform"
+)
+
+/*
+Query structure
+---------------
+?session=<collection> - returns the fuel burnt and the hours spent motoring for each engine in the session.
+
+Engine data is only logged on deliveries so sessions without it return an empty array.
+*/
+
+const motoringRpm float64 = 500         // below this the engine is off or being cranked
+const maxSampleGap time.Duration = 10e9 // gaps longer than 10s are logger outages, not engine running time
+
+type engineUsage_t struct {
+	Instance      string    `json:"instance"`
+	Start         time.Time `json:"start"`         // first engine reading in the session
+	End           time.Time `json:"end"`           // last engine reading in the session
+	MotoringHours float64   `json:"motoringHours"` // time with the engine above motoringRpm
+	FuelBurnt     float64   `json:"fuelBurnt"`     // litres, integrated from the fuel rate
+	AverageRpm    float64   `json:"averageRpm"`    // while motoring
+	EngineHours   float64   `json:"engineHours"`   // engine hour meter at the end of the session
+}
+
+func GetEngineUsage(w http.ResponseWriter, r *http.Request) { // r is the request, w is the response
+
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	rapid, err := apimongo.GetEngineRapid(session)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	dynamic, err := apimongo.GetEngineDynamic(session)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	result, err := json.Marshal(engineUsage(rapid, dynamic))
+	if err != nil {
+		log.Printf("Marshalling error in GetEngineUsage() %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
+
+// works out the usage for each engine instance. Motoring time comes from the rpm in the rapid updates
+// and fuel burn from the fuel rate in the dynamic updates. Each sample is assumed to hold until the next
+// one, unless the gap is longer than maxSampleGap.
+func engineUsage(rapid []transform.EngineRapidData_t, dynamic []transform.EngineDynamicData_t) []engineUsage_t {
+
+	usage := map[string]*engineUsage_t{}
+	var instances []string // keeps the output in the order the engines were first seen
+	var rpmSum = map[string]float64{}
+
+	get := func(instance string, ts time.Time) *engineUsage_t {
+		u, ok := usage[instance]
+		if !ok {
+			u = &engineUsage_t{Instance: instance, Start: ts, End: ts}
+			usage[instance] = u
+			instances = append(instances, instance)
+		}
+		if ts.Before(u.Start) {
+			u.Start = ts
+		}
+		if ts.After(u.End) {
+			u.End = ts
+		}
+		return u
+	}
+
+	sort.Slice(rapid, func(a, b int) bool { return rapid[a].Ts.Before(rapid[b].Ts) })
+	sort.Slice(dynamic, func(a, b int) bool { return dynamic[a].Ts.Before(dynamic[b].Ts) })
+
+	lastRapid := map[string]transform.EngineRapidData_t{}
+	for _, sample := range rapid {
+		u := get(sample.Metadata.Instance, sample.Ts)
+		if prev, ok := lastRapid[sample.Metadata.Instance]; ok {
+			gap := sample.Ts.Sub(prev.Ts)
+			if gap <= maxSampleGap && prev.Rpm >= motoringRpm {
+				u.MotoringHours += gap.Hours()
+				rpmSum[u.Instance] += prev.Rpm * gap.Hours()
+			}
+		}
+		lastRapid[sample.Metadata.Instance] = sample
+	}
+
+	lastDynamic := map[string]transform.EngineDynamicData_t{}
+	for _, sample := range dynamic {
+		u := get(sample.Metadata.Instance, sample.Ts)
+		if prev, ok := lastDynamic[sample.Metadata.Instance]; ok {
+			gap := sample.Ts.Sub(prev.Ts)
+			if gap <= maxSampleGap {
+				u.FuelBurnt += prev.FuelRate * gap.Hours() // fuel rate is in litres per hour
+			}
+		}
+		if sample.EngineHours > 0 {
+			u.EngineHours = sample.EngineHours / 3600 // the ecu reports seconds
+		}
+		lastDynamic[sample.Metadata.Instance] = sample
+	}
+
+	results := []engineUsage_t{} // not nil so that an empty session marshals to [] rather than null
+	for _, instance := range instances {
+		u := usage[instance]
+		if u.MotoringHours > 0 {
+			u.AverageRpm = rpmSum[instance] / u.MotoringHours
+		}
+		results = append(results, *u)
+	}
+	return results
+}
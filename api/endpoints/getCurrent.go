@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+
+	apimongo "github.com/m-h-w/nmea-logger/api/dbdriver"
+	"github.com/m-h-w/nmea-logger/storage"
+	"github.com/m-h-w/nmea-logger/transform"
+)
+
+/*
+Query structure
+---------------
+?session=<collection>&start=<RFC3339>&stop=<RFC3339> - returns the tidal current along the track between start
+and stop, oldest first, as a vector field for the map: the position with the set (degrees true, the way the
+current flows) and drift (m/s) there, from the session's snapshots. See transform/current.go.
+
+The level is picked and the results paged as for getSnapshots.go, so zooming out gives fewer, more averaged
+arrows. Snapshots without a current, e.g. with no heading, are left out.
+*/
+
+var currentFields = []string{transform.FIELD_LAT, transform.FIELD_LONG, transform.FIELD_SET, transform.FIELD_DRIFT}
+
+func GetCurrent(w http.ResponseWriter, r *http.Request) { // r is the request, w is the response
+
+	q := r.URL.Query()
+
+	session := q.Get("session")
+	start, stop, limit, ok := parseTimeRange(q)
+	if session == "" || !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	collection, resolution, err := resolveCollection(q, session, start, stop, true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query := storage.RangeQuery_t{
+		Collection: collection,
+		Field:      transform.FIELD_DRIFT,
+		Start:      start,
+		End:        stop,
+		Limit:      limit,
+		After:      q.Get("page"),
+		Descending: q.Get("order") == "desc",
+		Projection: currentFields,
+	}
+
+	result, err := apimongo.GetMeasurements(query, resolution)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
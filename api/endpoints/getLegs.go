@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	apimongo "github.com/m-h-w/nmea-logger/api/dbdriver"
+	"github.com/m-h-w/nmea-logger/storage"
+)
+
+/*
+Query structure
+---------------
+?session=<collection> - returns the course sailed in the session and the legs its track was split into, each
+with its start and end times and positions, the mark it was sailed to, the distance sailed, the VMC and the
+average TWS and TWA, so the map can show each leg. See transform/course.go.
+
+The response is the course: {"session", "start", "marks", "finish", "legs": [...]}. 404 if the session hasnt
+got a course, they are added with -course.
+*/
+
+func GetLegs(w http.ResponseWriter, r *http.Request) { // r is the request, w is the response
+
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	course, err := apimongo.GetCourse(session)
+	if err == storage.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	result, err := json.Marshal(course)
+	if err != nil {
+		log.Printf("Marshalling error in GetLegs() %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	apimongo "github.com/m-h-w/nmea-logger/api/dbdriver"
+	"github.com/m-h-w/nmea-logger/storage"
+)
+
+/*
+Query structure
+---------------
+?session=<collection>&field=<field>&start=<RFC3339>&stop=<RFC3339> - returns the documents containing <field>
+(see transform/schema.go for the field names) between start and stop, oldest first.
+
+Optional parameters:
+&limit=<n> - page size, default 1000, maximum 10000
+&page=<token> - the "next" token from the previous page
+&fields=<field>,<field> - only return these fields (plus _id and ts)
+&order=desc - newest first
+&resolution=<level> - read from a level of the session's low res pyramid, e.g. 5s or 2m, rather than the full
+resolution data. The pyramid is built with mongo-tools -l, see transform/low-res-views.go
+&maxpoints=<n> - pick the resolution automatically: the full resolution data if the range isnt too long for
+about n documents of each measurement, otherwise the finest level of the pyramid that has no more than n.
+
+The response is {"results": [...], "next": "<token>", "resolution": "<level>"}. next is empty on the last page
+and resolution is left out for the full resolution data.
+*/
+
+const defaultPageSize int64 = 1000
+const maxPageSize int64 = 10000
+const defaultMaxPoints int64 = 2000 // when picking a resolution without being told how many points are wanted
+
+func GetMeasurements(w http.ResponseWriter, r *http.Request) { // r is the request, w is the response
+
+	q := r.URL.Query()
+
+	session := q.Get("session")
+	field := q.Get("field")
+	if session == "" || field == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	start, stop, limit, ok := parseTimeRange(q)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	collection, resolution, err := resolveCollection(q, session, start, stop, false)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query := storage.RangeQuery_t{
+		Collection: collection,
+		Field:      field,
+		Start:      start,
+		End:        stop,
+		Limit:      limit,
+		After:      q.Get("page"),
+		Descending: q.Get("order") == "desc",
+	}
+	if fields := q.Get("fields"); fields != "" {
+		query.Projection = strings.Split(fields, ",")
+	}
+
+	result, err := apimongo.GetMeasurements(query, resolution)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
+
+// reads the start, stop and limit parameters shared by the time range queries. Returns false if they are
+// missing or badly formatted, or stop is before start.
+func parseTimeRange(q url.Values) (time.Time, time.Time, int64, bool) {
+
+	start, err := time.Parse(time.RFC3339, q.Get("start"))
+	if err != nil {
+		return start, start, 0, false
+	}
+
+	stop, err := time.Parse(time.RFC3339, q.Get("stop"))
+	if err != nil || stop.Before(start) {
+		return start, stop, 0, false
+	}
+
+	limit := defaultPageSize
+	if l := q.Get("limit"); l != "" {
+		limit, err = strconv.ParseInt(l, 10, 64)
+		if err != nil || limit <= 0 {
+			return start, stop, 0, false
+		}
+		if limit > maxPageSize {
+			limit = maxPageSize
+		}
+	}
+	return start, stop, limit, true
+}
+
+// Works out which collection to read a session's data from: the level of its low res pyramid given by
+// &resolution=, or the one picked for the time range by &maxpoints=, otherwise the full resolution data.
+// Snapshots only exist in the pyramid so are always picked for the time range if no level is given. Returns
+// the collection and the name of the level, "" for the full resolution data.
+func resolveCollection(q url.Values, session string, start time.Time, stop time.Time, snapshots bool) (string, string, error) {
+
+	if level := q.Get("resolution"); level != "" {
+		col, err := apimongo.LevelCollection(session, level, snapshots)
+		return col, level, err
+	}
+
+	maxPoints := defaultMaxPoints
+	if mp := q.Get("maxpoints"); mp != "" {
+		var err error
+		maxPoints, err = strconv.ParseInt(mp, 10, 64)
+		if err != nil || maxPoints <= 0 {
+			return "", "", fmt.Errorf("bad maxpoints %q", mp)
+		}
+	} else if !snapshots {
+		return session, "", nil
+	}
+	return apimongo.PickResolution(session, start, stop, maxPoints, snapshots)
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	apimongo "github.com/m-h-w/nmea-logger/api/dbdriver"
+	"github.com/m-h-w/nmea-logger/storage"
+	"github.com/m-h-w/nmea-logger/transform"
+)
+
+/*
+Query structure
+---------------
+?session=<collection>&start=<RFC3339>&stop=<RFC3339> - returns how the boat did against its polar between start
+and stop, oldest first, from the session's snapshots: boatspeed, TWS and TWA with the polar speed, polar %,
+target speed and TWA, VMG and VMC, see transform/performance.go. Charting polarperf shows where the boat was slow.
+
+The level is picked and the results paged as for getSnapshots.go. &fields= replaces the default fields. The
+response is {"results": [...], "next": "<token>", "resolution": "<level>", "polar": "<name>"}, polar being left
+out if the session wasnt compared with one, in which case there is only the VMG and VMC.
+*/
+
+// the fields returned if none are asked for
+var performanceFields = append([]string{transform.FIELD_BOATSPEED, transform.FIELD_TWS, transform.FIELD_TWA}, transform.PerformanceFields...)
+
+func GetPerformance(w http.ResponseWriter, r *http.Request) { // r is the request, w is the response
+
+	q := r.URL.Query()
+
+	session := q.Get("session")
+	start, stop, limit, ok := parseTimeRange(q)
+	if session == "" || !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	collection, resolution, err := resolveCollection(q, session, start, stop, true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// only the snapshots there is a performance for, which all have a VMG
+	query := storage.RangeQuery_t{
+		Collection: collection,
+		Field:      transform.FIELD_VMG,
+		Start:      start,
+		End:        stop,
+		Limit:      limit,
+		After:      q.Get("page"),
+		Descending: q.Get("order") == "desc",
+		Projection: performanceFields,
+	}
+	if fields := q.Get("fields"); fields != "" {
+		query.Projection = strings.Split(fields, ",")
+	}
+
+	result, err := apimongo.GetPerformance(query, resolution, session)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
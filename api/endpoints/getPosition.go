@@ -1,8 +1,11 @@
 package api
 
 import (
+	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	apimongo "github.com/m-h-w/nmea-logger/api/dbdriver"
 )
@@ -10,8 +13,13 @@ import (
 /*
 Query structure
 ---------------
-?timeframe=yymmdd - to return a whole tables worth of location points from the 6 second data table
-?start=yymmddT00.00.00.000&stop=yymmddT00.00.00.000 - to return a time frame from the high res table
+?timeframe=yymmdd - to return a whole sessions worth of location points from its low res pyramid. The level is
+picked so there are no more than about 2000 points, or &maxpoints=<n>, unless one is given with &resolution=<level>.
+The track is simplified with Douglas-Peucker (see transform/simplify.go) so a finer level is used than the number
+of points alone would allow and the points that matter to the shape of the track are the ones kept.
+&tolerance=<metres> simplifies it further, dropping positions within that distance of the track.
+?session=yymmdd&start=<RFC3339>&stop=<RFC3339> - to return a time frame from the high res table. These are
+returned a page at a time, see getMeasurements.go for the paging parameters and response format.
 
 
 */
@@ -34,12 +42,44 @@ func GetPosition(w http.ResponseWriter, r *http.Request) { // r is the request,
 			w.WriteHeader(http.StatusBadRequest)
 		} else {
 
-			log.Printf("ToDo: Validate time delta and query high res table")
+			startTime, stopTime, limit, ok := parseTimeRange(q)
+			session := q.Get("session")
+			if !ok || session == "" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			result, err := apimongo.GetHrPosition(session, startTime, stopTime, limit, q.Get("page"))
+			if err != nil {
+				log.Printf("high res position query failed %s", err)
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusOK)
+			w.Write(result)
 		}
 
 	} else { // low res position fetch
 
-		result, err := apimongo.GetLrPosition(timeFrame + "-six-second")
+		// the level of the low res pyramid with no more than about maxpoints positions for the whole session
+		collection, maxPoints, err := lowResPosition(q, timeFrame)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		tolerance := 0.0
+		if t := q.Get("tolerance"); t != "" {
+			tolerance, err = strconv.ParseFloat(t, 64)
+			if err != nil || tolerance < 0 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+		}
+
+		result, err := apimongo.GetLrPosition(collection, tolerance, maxPoints)
 		if err == nil {
 
 			w.Header().Set("Content-Type", "application/json")
@@ -51,3 +91,37 @@ func GetPosition(w http.ResponseWriter, r *http.Request) { // r is the request,
 		}
 	}
 }
+
+// simplifying the track drops most of the positions on the straight legs, so the level is picked for this many
+// times the points wanted and the track simplified down to them
+const trackHeadroom = 4
+
+// returns the low res table to read the track from and how many positions to simplify it to, 0 for all of them
+func lowResPosition(q url.Values, session string) (string, int, error) {
+
+	start, stop, err := apimongo.SessionSpan(session)
+	if err != nil {
+		return "", 0, err
+	}
+
+	if q.Get("resolution") != "" && q.Get("maxpoints") == "" {
+		collection, _, err := resolveCollection(q, session, start, stop, false)
+		return collection, 0, err
+	}
+
+	maxPoints := defaultMaxPoints
+	if mp := q.Get("maxpoints"); mp != "" {
+		maxPoints, err = strconv.ParseInt(mp, 10, 64)
+		if err != nil || maxPoints <= 0 {
+			return "", 0, fmt.Errorf("bad maxpoints %q", mp)
+		}
+	}
+
+	// resolveCollection is given its own copy so the headroom doesnt change the request
+	picking := url.Values{"maxpoints": {strconv.FormatInt(maxPoints*trackHeadroom, 10)}}
+	if level := q.Get("resolution"); level != "" {
+		picking.Set("resolution", level)
+	}
+	collection, _, err := resolveCollection(picking, session, start, stop, false)
+	return collection, int(maxPoints), err
+}
@@ -0,0 +1,76 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	apimongo "github.com/m-h-w/nmea-logger/api/dbdriver"
+	"github.com/m-h-w/nmea-logger/transform"
+)
+
+/*
+Query structure
+---------------
+No parameters - returns every session in the catalog, see transform/catalog.go
+
+Optional search parameters, all of which must match:
+&q=<text> - text in the session name, boat, event, race or crew
+&boat=<name>, &event=<name>, &crew=<name>
+&from=<RFC3339>&to=<RFC3339> - sessions sailed at any time between from and to
+&lat=<lat>&long=<long> - sessions whose bounding box contains the position
+*/
+
+func GetSessions(w http.ResponseWriter, r *http.Request) { // r is the request, w is the response
+
+	q := r.URL.Query()
+
+	filter := transform.SessionFilter_t{
+		Text:  q.Get("q"),
+		Boat:  q.Get("boat"),
+		Event: q.Get("event"),
+		Crew:  q.Get("crew"),
+	}
+
+	var err error
+	if from := q.Get("from"); from != "" {
+		if filter.From, err = time.Parse(time.RFC3339, from); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if to := q.Get("to"); to != "" {
+		if filter.To, err = time.Parse(time.RFC3339, to); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if q.Get("lat") != "" || q.Get("long") != "" {
+		lat, latErr := strconv.ParseFloat(q.Get("lat"), 64)
+		long, longErr := strconv.ParseFloat(q.Get("long"), 64)
+		if latErr != nil || longErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		filter.Near = &[2]float64{lat, long}
+	}
+
+	sessions, err := apimongo.GetSessions()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	result, err := json.Marshal(transform.SearchSessions(sessions, filter))
+	if err != nil {
+		log.Printf("Marshalling error in GetSessions() %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+
+	apimongo "github.com/m-h-w/nmea-logger/api/dbdriver"
+	"github.com/m-h-w/nmea-logger/storage"
+)
+
+/*
+Query structure
+---------------
+?session=<collection>&start=<RFC3339>&stop=<RFC3339> - returns the snapshots between start and stop, oldest
+first. A snapshot holds every channel (position, wind, speeds, heading, heel) read in one bucket of a level
+of the low res pyramid, so any chart can be drawn zoomed out from one query. See transform/low-res-views.go.
+
+The level is picked from the time range so there are no more than about 2000 snapshots, or &maxpoints=<n>,
+unless one is given with &resolution=<level>. Paging is as for getMeasurements.go (&limit=, &page=, &fields=,
+&order=desc) and so is the response.
+*/
+
+func GetSnapshots(w http.ResponseWriter, r *http.Request) { // r is the request, w is the response
+
+	q := r.URL.Query()
+
+	session := q.Get("session")
+	start, stop, limit, ok := parseTimeRange(q)
+	if session == "" || !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	collection, resolution, err := resolveCollection(q, session, start, stop, true)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	query := storage.RangeQuery_t{
+		Collection: collection,
+		Start:      start,
+		End:        stop,
+		Limit:      limit,
+		After:      q.Get("page"),
+		Descending: q.Get("order") == "desc",
+	}
+	if fields := q.Get("fields"); fields != "" {
+		query.Projection = strings.Split(fields, ",")
+	}
+
+	result, err := apimongo.GetMeasurements(query, resolution)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
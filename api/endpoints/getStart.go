@@ -0,0 +1,74 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	apimongo "github.com/m-h-w/nmea-logger/api/dbdriver"
+	"github.com/m-h-w/nmea-logger/storage"
+	"github.com/m-h-w/nmea-logger/transform"
+)
+
+/*
+Query structure
+---------------
+?session=<collection> - returns the start analysed with -gun: the line, its bias to the TWD and the favoured end,
+the SOG and distance to the line at the gun, whether the boat was over and how late it crossed, and a point for
+each second of the last minutes before the gun with the distance to the line, time to the line and time to burn
+for the pre-start replay. See transform/start.go. 404 if the start hasnt been analysed.
+
+&gun=<RFC3339> - analyses the start at that time instead, on the course's start line or on
+&pin=<lat,long>&committee=<lat,long> - the pinged ends of the line. Nothing is saved.
+*/
+
+func GetStart(w http.ResponseWriter, r *http.Request) { // r is the request, w is the response
+
+	q := r.URL.Query()
+
+	session := q.Get("session")
+	if session == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	var gun time.Time
+	var line *transform.Line_t
+	var err error
+	if g := q.Get("gun"); g != "" {
+		if gun, err = time.Parse(time.RFC3339, g); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+	if q.Get("pin") != "" || q.Get("committee") != "" {
+		pin, pinErr := transform.ParseMark(q.Get("pin"))
+		committee, committeeErr := transform.ParseMark(q.Get("committee"))
+		if pinErr != nil || committeeErr != nil || gun.IsZero() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		line = &transform.Line_t{Pin: *pin, Boat: *committee}
+	}
+
+	start, err := apimongo.GetStart(session, line, gun)
+	if err == storage.ErrNotFound {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result, err := json.Marshal(start)
+	if err != nil {
+		log.Printf("Marshalling error in GetStart() %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(result)
+}
@@ -1,154 +1,176 @@
 package api
 
 import (
-	"bufio"
 	"encoding/json"
 	"log"
 	"net/http"
-	"os"
+	"sort"
+	"strings"
 	"time"
-)
 
-var devTest bool = true
+	apimongo "github.com/m-h-w/nmea-logger/api/dbdriver"
+	"github.com/m-h-w/nmea-logger/transform"
+)
 
 /*
 Query structure
 ---------------
-?start=yymmddT00.00.00.000&stop=yymmddT00.00.00.000 - Find all the tacks (as opposed to gybes) between start and stop
-returns a json array of strings with tack times in them.
-?table=<tablename>
+?session=<collection> - returns the tacks, gybes, bear-aways and round-ups in the session, oldest first, each with
+its entry and exit times and how well it was sailed: distance lost against the target VMG, time to recover to
+target speed, minimum speed, turn rate, heading overshoot, peak heel and the TWA going in and coming out. See the
+manoeuvre package and transform/manoeuvres.go.
+
+?helm=<name> and/or ?boat=<name> instead of a session - the manoeuvres in every session sailed by that helm or
+boat, to compare helmsmen, oldest first. Only sessions whose manoeuvres have been stored with -manoeuvres are
+included, as working them out for every session would take too long for a request.
 
+Optional parameters:
+&start=<RFC3339>&stop=<RFC3339> - only the manoeuvres between start and stop, otherwise the whole session
+&type=<type>,<type> - only these types of manoeuvre: tack, gybe, bearaway, roundup
+
+The response is {"manoeuvres": [...], "summary": [...]}, the summary averaging the metrics for each helm and
+type of manoeuvre.
 */
 
-func GetTackTimes(w http.ResponseWriter, r *http.Request) { // r is the request, w is the response
-	var tacks []string
-	// parse the request and extract the parameters.
-	//https://pkg.go.dev/net/url#URL.Query
+type manoeuvreSummary_t struct {
+	Helm         string  `json:"helm"`
+	Type         string  `json:"type"`
+	Count        int     `json:"count"`
+	EntrySpeed   float64 `json:"entrySpeed"` // m/s
+	MinSpeed     float64 `json:"minSpeed"`   // m/s
+	Recovery     float64 `json:"recovery"`   // seconds, of the ones that recovered
+	Recovered    int     `json:"recovered"`
+	DistanceLost float64 `json:"distanceLost"` // metres
+	TurnRate     float64 `json:"turnRate"`
+	Overshoot    float64 `json:"overshoot"`
+	PeakHeel     float64 `json:"peakHeel"`
+}
 
-	q := r.URL.Query()
+type manoeuvres_t struct {
+	Manoeuvres []transform.ManoeuvreRecord_t `json:"manoeuvres"`
+	Summary    []manoeuvreSummary_t          `json:"summary"`
+}
 
-	//extract the paramenterss from the url Query string
-	start := q.Get("start")
-	stop := q.Get("stop")
-	table := q.Get("table")
+func GetManoeuvres(w http.ResponseWriter, r *http.Request) { // r is the request, w is the response
 
-	// check query has been formatted correctly.
-	if start == "" || stop == "" {
-		w.WriteHeader(http.StatusBadRequest)
-	}
+	q := r.URL.Query()
 
-	//check stop time is after start time and times are formatted correctly
-	startTime, err := time.Parse(time.RFC3339, start)
-	if err != nil {
+	session, helm, boat := q.Get("session"), q.Get("helm"), q.Get("boat")
+	if session == "" && helm == "" && boat == "" {
 		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	stopTime, err := time.Parse(time.RFC3339, stop)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	var start, stop time.Time
+	if q.Get("start") != "" || q.Get("stop") != "" {
+		var ok bool
+		if start, stop, _, ok = parseTimeRange(q); !ok {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
 	}
 
-	diff := stopTime.Sub(startTime)
-	if diff < 0 {
-		w.WriteHeader(http.StatusBadRequest)
+	types := map[string]bool{}
+	if t := q.Get("type"); t != "" {
+		for _, name := range strings.Split(t, ",") {
+			types[strings.TrimSpace(name)] = true
+		}
 	}
 
-	//ToDo check that start and stop times are in the range of the data set in the table
-
-	if devTest { // opens one of the raw files as opposed to querying the DB for testing
-
-		// Try to open the named file
-		ipfile, err := os.Open(table)
-		// Error if it wont open
+	sessions := []string{session}
+	if session == "" {
+		all, err := apimongo.GetSessions()
 		if err != nil {
-			log.Printf("Crashed trying to open test file:%s\n", table)
-			panic(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
 		}
-
-		scanner := bufio.NewScanner(ipfile)
-
-		for scanner.Scan() {
-			var bgJsonInput map[string]interface{}
-			err := json.Unmarshal([]byte(scanner.Text()), &bgJsonInput)
-			if err != nil {
-				log.Printf("error unmarshalling logger data %v", err)
-				continue // error in the input data so skip this iteration.
+		sessions = nil
+		for _, s := range transform.SearchSessions(all, transform.SessionFilter_t{Boat: boat}) {
+			if _, stored := s.ManoeuvresCollection(); stored && (helm == "" || strings.EqualFold(helm, s.Helm)) {
+				sessions = append(sessions, s.Name)
 			}
-			if bgJsonInput["description"] == "Wind Data" {
-				fields := bgJsonInput["fields"].(map[string]interface{})
-				ts := bgJsonInput["timestamp"].(string)
-				tack := detectTack(fields["Wind Angle"].(float64), ts)
-
-				if tack != "" {
-					tacks = append(tacks, tack)
-				} // record the timestamp of the tack
-			} else {
+		}
+	}
 
-				continue // data row doesnt contain wind data so ignore
+	result := manoeuvres_t{Manoeuvres: []transform.ManoeuvreRecord_t{}}
+	for _, s := range sessions {
+		records, err := apimongo.GetManoeuvres(s, start, stop)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		for _, m := range records {
+			if len(types) == 0 || types[m.Type] {
+				result.Manoeuvres = append(result.Manoeuvres, m)
 			}
 		}
-
-	} else { // this is the actual code that would run on the api server
-		log.Printf("write the DB Query to extract data to detect a tack between two time stamps")
-		// In some kind of loop
-		// data:=queryDB(awa,ts)
-		// tacks=detectTack(data)
 	}
+	sort.SliceStable(result.Manoeuvres, func(i, j int) bool {
+		return result.Manoeuvres[i].Entry.Before(result.Manoeuvres[j].Entry)
+	})
+	result.Summary = summariseManoeuvres(result.Manoeuvres)
 
-	log.Printf("tacks at %v", tacks)
-
-}
-
-/*
-
-Pass in a row from the data table and see if there is a tack there.
-Note: This function has state behaviour!!! It is assumed that it would execute to completion
-during a single API call.
-
-*/
+	body, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("Marshalling error in GetManoeuvres() %s\n", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-const awastb float64 = 45.00 // if AWA is <180 we are on starboard. Likely it will be <30degs
-const awapt float64 = 315.00 // if AWA is > 180 we are on port. Likely it will be >315degs
-const depth int = 10         // depth of 10 represents 2 seconds of wind data.Must be even number. When it is 5 pt and 5 stb we can declare a tack
-var i int = 0                // index into history array
-type history_t struct {
-	tack string
-	ts   string
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
 }
 
-var history [depth]history_t // the last "depth" tack decisions
-
-func detectTack(awa float64, ts string) string {
-	// store the latest decision as to what tack we are on.
-	if awa <= awastb {
-		history[i].tack = "stb"
-		history[i].ts = ts
-	} else if awa >= awapt {
-		history[i].tack = "pt"
-		history[i].ts = ts
-	} else {
-		history[i].tack = "offwind"
-	}
-	// manage the index roll over
-	if i >= depth {
-		i = 0
-	} else {
-		i++
+// averages the metrics for each helm and type of manoeuvre
+func summariseManoeuvres(records []transform.ManoeuvreRecord_t) []manoeuvreSummary_t {
+
+	sums := map[[2]string]*manoeuvreSummary_t{}
+	lost := map[[2]string]int{} // how many have a distance lost
+	for _, m := range records {
+		key := [2]string{m.Metadata.Helm, m.Type}
+		s, ok := sums[key]
+		if !ok {
+			s = &manoeuvreSummary_t{Helm: m.Metadata.Helm, Type: m.Type}
+			sums[key] = s
+		}
+		s.Count++
+		s.EntrySpeed += m.Metrics.EntrySpeed
+		s.MinSpeed += m.Metrics.MinSpeed
+		s.TurnRate += m.Metrics.TurnRate
+		s.Overshoot += m.Metrics.Overshoot
+		s.PeakHeel += m.Metrics.PeakHeel
+		if m.Metrics.Recovery != nil {
+			s.Recovery += *m.Metrics.Recovery
+			s.Recovered++
+		}
+		if m.Metrics.DistanceLost != nil {
+			s.DistanceLost += *m.Metrics.DistanceLost
+			lost[key]++
+		}
 	}
 
-	// test to see if a tack has occured
-	ptcount := 0
-	stbcount := 0
-	for i := 0; i < depth; i++ {
-		if history[i] == "pt" {
-			ptcount++
-		} else if history[i] == "stb" {
-			stbcount++
+	summary := []manoeuvreSummary_t{}
+	for key, s := range sums {
+		n := float64(s.Count)
+		s.EntrySpeed /= n
+		s.MinSpeed /= n
+		s.TurnRate /= n
+		s.Overshoot /= n
+		s.PeakHeel /= n
+		if s.Recovered != 0 {
+			s.Recovery /= float64(s.Recovered)
 		}
+		if lost[key] != 0 {
+			s.DistanceLost /= float64(lost[key])
+		}
+		summary = append(summary, *s)
 	}
-	if ptcount == stbcount && ptcount == depth/2 {
-		return history[depth/2].ts
-	}
-
-	return ""
+	sort.Slice(summary, func(i, j int) bool {
+		if summary[i].Helm != summary[j].Helm {
+			return summary[i].Helm < summary[j].Helm
+		}
+		return summary[i].Type < summary[j].Type
+	})
+	return summary
 }
@@ -22,7 +22,47 @@ func boatPosition(w http.ResponseWriter, r *http.Request) {
 
 func boatTacks(w http.ResponseWriter, r *http.Request) {
 	log.Println("Endpoint Hit: /boat/tacks")
-	api.GetTackTimes(w, r)
+	api.GetManoeuvres(w, r)
+}
+
+func boatEngine(w http.ResponseWriter, r *http.Request) {
+	log.Println("Endpoint Hit: /boat/engine")
+	api.GetEngineUsage(w, r)
+}
+
+func boatMeasurements(w http.ResponseWriter, r *http.Request) {
+	log.Println("Endpoint Hit: /boat/measurements")
+	api.GetMeasurements(w, r)
+}
+
+func boatSnapshots(w http.ResponseWriter, r *http.Request) {
+	log.Println("Endpoint Hit: /boat/snapshots")
+	api.GetSnapshots(w, r)
+}
+
+func boatPerformance(w http.ResponseWriter, r *http.Request) {
+	log.Println("Endpoint Hit: /boat/performance")
+	api.GetPerformance(w, r)
+}
+
+func boatLegs(w http.ResponseWriter, r *http.Request) {
+	log.Println("Endpoint Hit: /boat/legs")
+	api.GetLegs(w, r)
+}
+
+func boatStart(w http.ResponseWriter, r *http.Request) {
+	log.Println("Endpoint Hit: /boat/start")
+	api.GetStart(w, r)
+}
+
+func boatCurrent(w http.ResponseWriter, r *http.Request) {
+	log.Println("Endpoint Hit: /boat/current")
+	api.GetCurrent(w, r)
+}
+
+func sessions(w http.ResponseWriter, r *http.Request) {
+	log.Println("Endpoint Hit: /sessions")
+	api.GetSessions(w, r)
 }
 
 func handleRequests() {
@@ -32,6 +72,14 @@ func handleRequests() {
 	Router.HandleFunc("/", homePage)
 	Router.HandleFunc("/boat/position", boatPosition)
 	Router.HandleFunc("/boat/tacks", boatTacks)
+	Router.HandleFunc("/boat/engine", boatEngine)
+	Router.HandleFunc("/boat/measurements", boatMeasurements)
+	Router.HandleFunc("/boat/snapshots", boatSnapshots)
+	Router.HandleFunc("/boat/performance", boatPerformance)
+	Router.HandleFunc("/boat/legs", boatLegs)
+	Router.HandleFunc("/boat/start", boatStart)
+	Router.HandleFunc("/boat/current", boatCurrent)
+	Router.HandleFunc("/sessions", sessions)
 
 	log.Fatal(http.ListenAndServe(":10000", Router))
 }
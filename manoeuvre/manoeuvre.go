@@ -0,0 +1,284 @@
+package manoeuvre
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/wind"
+)
+
+/*
+Manoeuvre detection
+-------------------
+Finds the tacks, gybes, bear-aways and round-ups in a stretch of sailing. Detect is handed all the readings it
+needs and keeps nothing between calls, so the API can run it for any number of requests at once.
+
+The readings are averaged into one second steps first, with gaps of more than MAX_GAP left as gaps. A manoeuvre
+is a turn: a run of steps where the heading (or COG if there is no heading) changes faster than TURN_RATE in
+one direction, with pauses of up to MERGE_GAP, that turns the boat MIN_TURN degrees or more. Its entry and exit
+are when the turn starts and stops.
+
+What kind of manoeuvre it is comes from the TWA over SETTLE before the entry and after the exit. Turning
+the boat by some angle turns the TWA the other way by the same angle, so following the TWA through the turn
+tells whether the bow went through the wind (a tack) or the stern did (a gybe). If neither did it is a
+bear-away if the TWA got wider and a round-up if it got narrower. Apparent wind angles can be used instead of
+true if that is all there is, the answer is the same apart from close to the beam.
+
+Angles are in degrees, wind angles clockwise from the bow 0 to 360 as in the wind package. How well each
+manoeuvre was sailed is worked out by Measure, see metrics.go.
+*/
+
+const TACK = "tack"
+const GYBE = "gybe"
+const BEAR_AWAY = "bearaway"
+const ROUND_UP = "roundup"
+
+const TURN_RATE = 3.0 // degrees per second, turning faster than this is part of a manoeuvre
+const MIN_TURN = 30.0 // degrees, smaller turns are steering rather than manoeuvres
+const MERGE_GAP = 3 * time.Second
+const SETTLE = 10 * time.Second // the TWA is read over this long before and after a turn
+const MAX_GAP = 5 * time.Second // readings further apart than this arent joined up
+
+const STEP = time.Second
+
+// a reading and when it was taken
+type Reading_t struct {
+	Ts    time.Time
+	Value float64
+}
+
+// the readings for Detect, each in time order. Heading or COG is needed to find the turns and TWA to tell
+// what they are. The rest are only used by Measure.
+type Input_t struct {
+	Twa       []Reading_t
+	Heading   []Reading_t
+	Cog       []Reading_t
+	Boatspeed []Reading_t // m/s
+	Tws       []Reading_t // m/s
+	Heel      []Reading_t
+}
+
+type Manoeuvre_t struct {
+	Type      string    `bson:"type" json:"type"`   // TACK, GYBE, BEAR_AWAY or ROUND_UP
+	Entry     time.Time `bson:"entry" json:"entry"` // when the turn started
+	Exit      time.Time `bson:"exit" json:"exit"`   // and finished
+	Turn      float64   `bson:"turn" json:"turn"`   // degrees, positive to starboard
+	TwaBefore float64   `bson:"twabefore" json:"twaBefore"`
+	TwaAfter  float64   `bson:"twaafter" json:"twaAfter"`
+}
+
+// a series of one second steps. ok is false where there were no readings.
+type series_t struct {
+	start    time.Time
+	circular bool // the values are angles
+	values   []float64
+	ok       []bool
+}
+
+// Finds the manoeuvres in the readings, in time order
+func Detect(in Input_t) []Manoeuvre_t {
+
+	course := in.Heading
+	if len(course) == 0 {
+		course = in.Cog
+	}
+	if len(course) == 0 || len(in.Twa) == 0 {
+		return nil
+	}
+
+	heading := resample(course, true)
+	twa := resample(in.Twa, true)
+
+	var found []Manoeuvre_t
+	for _, turn := range findTurns(heading) {
+
+		entry := heading.time(turn[0])
+		exit := heading.time(turn[1])
+		before, ok := twa.mean(entry.Add(-SETTLE), entry)
+		after, ok2 := twa.mean(exit, exit.Add(SETTLE))
+		if !ok || !ok2 {
+			continue // cant tell what it was without the wind
+		}
+
+		m := Manoeuvre_t{Entry: entry, Exit: exit, Turn: heading.turn(turn[0], turn[1]), TwaBefore: before, TwaAfter: after}
+		m.Type = classify(before, after, m.Turn)
+		found = append(found, m)
+	}
+	return found
+}
+
+// what a turn of the boat was from the TWA before and after it
+func classify(before float64, after float64, turn float64) string {
+
+	// follow the TWA through the turn, the opposite way to the boat, ending up at after
+	end := before - turn
+	end += difference(after, end)
+	lo, hi := math.Min(before, end), math.Max(before, end)
+
+	switch {
+	case crosses(lo, hi, 0):
+		return TACK
+	case crosses(lo, hi, 180):
+		return GYBE
+	case offTheWind(after) > offTheWind(before):
+		return BEAR_AWAY
+	}
+	return ROUND_UP
+}
+
+// true if lo to hi passes through angle or any multiple of 360 from it
+func crosses(lo float64, hi float64, angle float64) bool {
+
+	k := math.Ceil((lo - angle) / 360)
+	return angle+k*360 < hi
+}
+
+// how far a wind angle is off the bow, 0 to 180
+func offTheWind(twa float64) float64 {
+	return math.Abs(difference(twa, 0))
+}
+
+// the runs of steps where the boat is turning, as the step it starts turning at and the one it stops at
+func findTurns(heading series_t) [][2]int {
+
+	var turns [][2]int
+	start, last, dir := -1, -1, 0.0
+	gap := int(MERGE_GAP / STEP)
+
+	end := func() {
+		if start >= 0 && math.Abs(heading.turn(start, last)) >= MIN_TURN {
+			turns = append(turns, [2]int{start, last})
+		}
+		start = -1
+	}
+
+	for i := 1; i < len(heading.values); i++ {
+		if !heading.ok[i] || !heading.ok[i-1] {
+			continue
+		}
+		// the rate over the steps either side, so a wave knocking the bow back doesnt split a tack in two
+		j := i + 1
+		if j >= len(heading.values) || !heading.ok[j] {
+			j = i
+		}
+		rate := heading.turn(i-1, j) / (float64(j-i+1) * STEP.Seconds())
+		if math.Abs(rate) < TURN_RATE {
+			continue
+		}
+		sign := math.Copysign(1, rate)
+		if start >= 0 && (sign != dir || i-1-last > gap) {
+			end()
+		}
+		if start < 0 {
+			start, dir = i-1, sign
+		}
+		last = i
+	}
+	end()
+	return turns
+}
+
+// averages the readings into one second steps, circular means if they are angles. Empty if there are no
+// readings.
+func resample(readings []Reading_t, circular bool) series_t {
+
+	if len(readings) == 0 {
+		return series_t{}
+	}
+	sorted := append([]Reading_t(nil), readings...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Ts.Before(sorted[j].Ts) })
+
+	s := series_t{start: sorted[0].Ts.Truncate(STEP), circular: circular}
+	n := int(sorted[len(sorted)-1].Ts.Sub(s.start)/STEP) + 1
+	sin, cos, count := make([]float64, n), make([]float64, n), make([]float64, n)
+	s.values, s.ok = make([]float64, n), make([]bool, n)
+
+	// sin holds the sum of the readings if they arent angles
+	for _, r := range sorted {
+		i := int(r.Ts.Sub(s.start) / STEP)
+		if circular {
+			sin[i] += math.Sin(r.Value * math.Pi / 180)
+			cos[i] += math.Cos(r.Value * math.Pi / 180)
+		} else {
+			sin[i] += r.Value
+		}
+		count[i]++
+		s.ok[i] = true
+	}
+
+	// fill short gaps from the step before so a dropped reading doesnt break a turn in two
+	lastOk := -1
+	for i := range s.values {
+		if s.ok[i] && circular {
+			s.values[i] = wind.Normalise(math.Atan2(sin[i], cos[i]) * 180 / math.Pi)
+			lastOk = i
+		} else if s.ok[i] {
+			s.values[i] = sin[i] / count[i]
+			lastOk = i
+		} else if lastOk >= 0 && time.Duration(i-lastOk)*STEP <= MAX_GAP {
+			s.values[i], s.ok[i] = s.values[lastOk], true
+		}
+	}
+	return s
+}
+
+func (s series_t) time(i int) time.Time {
+	return s.start.Add(time.Duration(i) * STEP)
+}
+
+// the value at t, false if there isnt one
+func (s series_t) at(t time.Time) (float64, bool) {
+
+	i := int(t.Sub(s.start) / STEP)
+	if t.Before(s.start) || i >= len(s.values) || !s.ok[i] {
+		return 0, false
+	}
+	return s.values[i], true
+}
+
+// the total turn from step i to j, following it step by step so turns of more than 180 add up
+func (s series_t) turn(i int, j int) float64 {
+
+	var total float64
+	for k := i + 1; k <= j; k++ {
+		if s.ok[k] && s.ok[k-1] {
+			total += difference(s.values[k], s.values[k-1])
+		}
+	}
+	return total
+}
+
+// the mean of the steps from from to to, circular if they are angles. false if there are none.
+func (s series_t) mean(from time.Time, to time.Time) (float64, bool) {
+
+	var sin, cos, sum float64
+	n := 0
+	for i := range s.values {
+		t := s.time(i)
+		if t.Before(from) || t.After(to) || !s.ok[i] {
+			continue
+		}
+		sin += math.Sin(s.values[i] * math.Pi / 180)
+		cos += math.Cos(s.values[i] * math.Pi / 180)
+		sum += s.values[i]
+		n++
+	}
+	switch {
+	case n == 0:
+		return 0, false
+	case s.circular:
+		return wind.Normalise(math.Atan2(sin, cos) * 180 / math.Pi), true
+	}
+	return sum / float64(n), true
+}
+
+// returns a - b in the range (-180, 180]
+func difference(a float64, b float64) float64 {
+
+	d := wind.Normalise(a - b)
+	if d > 180 {
+		d -= 360
+	}
+	return d
+}
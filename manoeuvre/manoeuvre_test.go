@@ -0,0 +1,122 @@
+package manoeuvre
+
+import (
+	"math"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/wind"
+)
+
+var START = time.Date(2021, 7, 11, 10, 0, 0, 0, time.UTC)
+
+// so many seconds of sailing, turning at rate degrees per second, positive to starboard
+type segment_t struct {
+	secs    int
+	rate    float64
+	missing bool // no readings, the boat still turns
+}
+
+// heading and TWA readings once a second for a boat starting on heading in a steady wind from twd
+func sail(heading float64, twd float64, segments []segment_t) Input_t {
+
+	var in Input_t
+	t := START
+	add := func() {
+		in.Heading = append(in.Heading, Reading_t{Ts: t, Value: wind.Normalise(heading)})
+		in.Twa = append(in.Twa, Reading_t{Ts: t, Value: wind.Normalise(twd - heading)})
+	}
+	add()
+	for _, s := range segments {
+		for i := 0; i < s.secs; i++ {
+			heading += s.rate
+			t = t.Add(time.Second)
+			if !s.missing {
+				add()
+			}
+		}
+	}
+	return in
+}
+
+var steady = segment_t{secs: 30}
+
+func TestDetect(t *testing.T) {
+
+	tests := []struct {
+		name  string
+		in    Input_t
+		types []string
+		turns []float64 // degrees, roughly
+	}{
+		{"tack onto starboard", sail(45, 0, []segment_t{steady, {secs: 10, rate: -9}, steady}), []string{TACK}, []float64{-90}},
+		{"tack onto port", sail(220, 265, []segment_t{steady, {secs: 10, rate: 9}, steady}), []string{TACK}, []float64{90}},
+		{"gybe", sail(150, 0, []segment_t{steady, {secs: 10, rate: 6}, steady}), []string{GYBE}, []float64{60}},
+		{"bear away", sail(45, 0, []segment_t{steady, {secs: 15, rate: 5}, steady}), []string{BEAR_AWAY}, []float64{75}},
+		{"round up", sail(120, 0, []segment_t{steady, {secs: 15, rate: -5}, steady}), []string{ROUND_UP}, []float64{-75}},
+		{"straight", sail(45, 0, []segment_t{steady, steady}), nil, nil},
+		{"steering", sail(45, 0, []segment_t{steady, {secs: 5, rate: 4}, steady}), nil, nil},
+		{"tack then gybe", sail(45, 0, []segment_t{steady, {secs: 10, rate: -9}, steady, {secs: 12, rate: -10}, steady, {secs: 10, rate: -6}, steady}),
+			[]string{TACK, BEAR_AWAY, GYBE}, []float64{-90, -120, -60}},
+		{"tack knocked back by a wave", sail(45, 0, []segment_t{steady, {secs: 5, rate: -9}, {secs: 1, rate: 6}, {secs: 5, rate: -9}, steady}),
+			[]string{TACK}, []float64{-84}},
+		{"tack with a dropped reading", sail(45, 0, []segment_t{steady, {secs: 5, rate: -9}, {secs: 2, rate: -9, missing: true}, {secs: 5, rate: -9}, steady}),
+			[]string{TACK}, []float64{-108}},
+		{"gap", sail(45, 0, []segment_t{steady, {secs: 20, rate: -4.5, missing: true}, steady}), nil, nil},
+		{"tack straight after a gap", sail(45, 0, []segment_t{steady, {secs: 20, missing: true}, {secs: 10, rate: -9}, steady}),
+			[]string{TACK}, []float64{-90}},
+	}
+
+	for _, tt := range tests {
+		found := Detect(tt.in)
+		if len(found) != len(tt.types) {
+			t.Errorf("%s: found %d manoeuvres, want %d: %+v", tt.name, len(found), len(tt.types), found)
+			continue
+		}
+		for i, m := range found {
+			if m.Type != tt.types[i] || math.Abs(m.Turn-tt.turns[i]) > 15 {
+				t.Errorf("%s: manoeuvre %d is a %s of %.0f, want a %s of %.0f", tt.name, i, m.Type, m.Turn, tt.types[i], tt.turns[i])
+			}
+			if !m.Entry.Before(m.Exit) {
+				t.Errorf("%s: manoeuvre %d exits at %v before it enters at %v", tt.name, i, m.Exit, m.Entry)
+			}
+		}
+	}
+}
+
+func TestDetectCog(t *testing.T) {
+
+	// no heading, so the turns come from the COG
+	in := sail(45, 0, []segment_t{steady, {secs: 10, rate: -9}, steady})
+	in.Cog, in.Heading = in.Heading, nil
+	if found := Detect(in); len(found) != 1 || found[0].Type != TACK {
+		t.Errorf("found %+v, want one tack", found)
+	}
+
+	// and nothing without the TWA
+	in.Twa = nil
+	if found := Detect(in); len(found) != 0 {
+		t.Errorf("found %+v without the TWA, want none", found)
+	}
+}
+
+// Detect keeps nothing between calls, so the API can run it for many requests at once. Run with -race.
+func TestDetectConcurrently(t *testing.T) {
+
+	in := sail(45, 0, []segment_t{steady, {secs: 10, rate: -9}, steady, {secs: 10, rate: 9}, steady})
+	want := Detect(in)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := Detect(in); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+		}()
+	}
+	wg.Wait()
+}
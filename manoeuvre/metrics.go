@@ -0,0 +1,166 @@
+package manoeuvre
+
+import (
+	"math"
+	"time"
+)
+
+/*
+Manoeuvre metrics
+-----------------
+How well a manoeuvre was sailed, worked out by Measure from the same one second steps as Detect:
+
+	- entry speed: the average boatspeed over SETTLE before the entry
+	- minimum speed: the lowest boatspeed from the entry until the boat has recovered
+	- recovery: seconds from the exit until the boatspeed is back up to RECOVERED of the target speed, if it
+	  gets there within MAX_RECOVERY
+	- distance lost: for tacks and gybes, the metres lost up or down wind against sailing at the target VMG
+	  from the entry until the boat recovered (or MAX_RECOVERY after the exit if it didnt)
+	- turn rate: the average through the turn and the fastest in any one second
+	- overshoot: how far the heading went past where it settled, SETTLE after the exit
+	- peak heel: the most heel either side from the entry to SETTLE after the exit
+
+The target speed and VMG come from a Target_t, normally the boat's polar at the TWS and TWA after the
+manoeuvre. Without one, or where the polar doesnt go, the boatspeed and VMG the boat had going in are used.
+Speeds are in m/s like the readings.
+*/
+
+const MAX_RECOVERY = 60 * time.Second
+const RECOVERED = 0.95 // of the target speed
+
+// the target boatspeed and VMG at a TWS (m/s) and TWA, false if there isnt one
+type Target_t func(tws float64, twa float64) (float64, float64, bool)
+
+type Metrics_t struct {
+	EntrySpeed   float64  `bson:"entryspeed" json:"entrySpeed"`
+	MinSpeed     float64  `bson:"minspeed" json:"minSpeed"`
+	TargetSpeed  float64  `bson:"targetspeed" json:"targetSpeed"`
+	TargetVmg    float64  `bson:"targetvmg" json:"targetVmg"`
+	Recovery     *float64 `bson:"recovery,omitempty" json:"recovery,omitempty"`         // seconds, nil if it didnt recover
+	DistanceLost *float64 `bson:"distancelost,omitempty" json:"distanceLost,omitempty"` // metres, tacks and gybes only
+	TurnRate     float64  `bson:"turnrate" json:"turnRate"`                             // degrees per second
+	PeakTurnRate float64  `bson:"peakturnrate" json:"peakTurnRate"`
+	Overshoot    float64  `bson:"overshoot" json:"overshoot"` // degrees
+	PeakHeel     float64  `bson:"peakheel" json:"peakHeel"`   // degrees
+}
+
+// Works out the metrics for manoeuvres found by Detect in the same readings. target can be nil.
+func Measure(in Input_t, found []Manoeuvre_t, target Target_t) []Metrics_t {
+
+	course := in.Heading
+	if len(course) == 0 {
+		course = in.Cog
+	}
+	heading := resample(course, true)
+	twa := resample(in.Twa, true)
+	stw := resample(in.Boatspeed, false)
+	tws := resample(in.Tws, false)
+	heel := resample(in.Heel, false)
+
+	metrics := make([]Metrics_t, len(found))
+	for k, m := range found {
+		metrics[k] = measure(m, heading, twa, stw, tws, heel, target)
+	}
+	return metrics
+}
+
+func measure(m Manoeuvre_t, heading series_t, twa series_t, stw series_t, tws series_t, heel series_t, target Target_t) Metrics_t {
+
+	var mt Metrics_t
+	settled := m.Exit.Add(SETTLE)
+
+	// the wind is measured up or down wind depending on which way the boat was going
+	upwind := offTheWind(m.TwaBefore) < 90
+	if m.Type == TACK {
+		upwind = true
+	} else if m.Type == GYBE {
+		upwind = false
+	}
+	vmgAt := func(t time.Time) (float64, bool) {
+		speed, ok := stw.at(t)
+		angle, ok2 := twa.at(t)
+		if !ok || !ok2 {
+			return 0, false
+		}
+		vmg := speed * math.Cos(angle*math.Pi/180)
+		if !upwind {
+			vmg = -vmg
+		}
+		return vmg, true
+	}
+
+	// going in
+	mt.EntrySpeed, _ = stw.mean(m.Entry.Add(-SETTLE), m.Entry)
+	var entryVmg float64
+	n := 0
+	for t := m.Entry.Add(-SETTLE); !t.After(m.Entry); t = t.Add(STEP) {
+		if v, ok := vmgAt(t); ok {
+			entryVmg += v
+			n++
+		}
+	}
+	if n != 0 {
+		entryVmg /= float64(n)
+	}
+
+	mt.TargetSpeed, mt.TargetVmg = mt.EntrySpeed, entryVmg
+	if windSpeed, ok := tws.mean(m.Exit, settled); ok && target != nil {
+		if speed, vmg, ok := target(windSpeed, m.TwaAfter); ok {
+			mt.TargetSpeed, mt.TargetVmg = speed, vmg
+		}
+	}
+
+	// coming out
+	end := m.Exit.Add(MAX_RECOVERY)
+	mt.MinSpeed = math.Inf(1)
+	for t := m.Entry; !t.After(end); t = t.Add(STEP) {
+		speed, ok := stw.at(t)
+		if !ok {
+			continue
+		}
+		mt.MinSpeed = math.Min(mt.MinSpeed, speed)
+		if !t.Before(m.Exit) && mt.Recovery == nil && mt.TargetSpeed > 0 && speed >= RECOVERED*mt.TargetSpeed {
+			recovery := t.Sub(m.Exit).Seconds()
+			mt.Recovery = &recovery
+			end = t
+		}
+	}
+	if math.IsInf(mt.MinSpeed, 1) {
+		mt.MinSpeed = 0
+	}
+
+	if m.Type == TACK || m.Type == GYBE {
+		lost := 0.0
+		for t := m.Entry; !t.After(end); t = t.Add(STEP) {
+			if v, ok := vmgAt(t); ok {
+				lost += (mt.TargetVmg - v) * STEP.Seconds()
+			}
+		}
+		mt.DistanceLost = &lost
+	}
+
+	// the turn
+	if d := m.Exit.Sub(m.Entry).Seconds(); d > 0 {
+		mt.TurnRate = math.Abs(m.Turn) / d
+	}
+	for t := m.Entry.Add(STEP); !t.After(m.Exit); t = t.Add(STEP) {
+		h, ok := heading.at(t)
+		prev, ok2 := heading.at(t.Add(-STEP))
+		if ok && ok2 {
+			mt.PeakTurnRate = math.Max(mt.PeakTurnRate, math.Abs(difference(h, prev))/STEP.Seconds())
+		}
+	}
+	if final, ok := heading.mean(settled.Add(-SETTLE/2), settled); ok {
+		for t := m.Entry; !t.After(settled); t = t.Add(STEP) {
+			if h, ok := heading.at(t); ok {
+				mt.Overshoot = math.Max(mt.Overshoot, math.Copysign(1, m.Turn)*difference(h, final))
+			}
+		}
+	}
+	for t := m.Entry; !t.After(settled); t = t.Add(STEP) {
+		if h, ok := heel.at(t); ok {
+			mt.PeakHeel = math.Max(mt.PeakHeel, math.Abs(h))
+		}
+	}
+	return mt
+}
@@ -0,0 +1,183 @@
+package mongodb
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+/*
+Batching writers. There is one writer per (db, collection) so a batch started for one collection can never be
+flushed into another. A writer is safe for concurrent use, so several goroutines can write to the same collection,
+and a transform can write to several collections in one pass by holding a writer for each.
+*/
+
+// Record the number of data points ready to write to mongo DB for each reading
+// Mongo insertMany has a limit of 1000documents. The best compromise for speed and load on the system is 100-200
+// https://stackoverflow.com/questions/36042967/mongoose-insertmany-limit
+
+type DbWriteCache_t struct {
+	Count int                         //number of documents waiting to be written
+	Mem   *[DB_WRITE_THRESHOLD][]byte //pomter to array of []byte where the bson documents are cached before they are written
+}
+
+const DB_WRITE_THRESHOLD = 100 // the threshold at which the cache is written to Mongo.
+
+type BatchWriter_t struct {
+	db         string
+	collection string
+	coll       *mongo.Collection
+
+	mu    sync.Mutex     // protects cache
+	cache DbWriteCache_t // documents waiting to be written
+	wg    sync.WaitGroup // waits for the insert threads to complete
+}
+
+// Creates a writer for a collection, creating the collection as a time-series collection if it doesnt exist.
+// The mongo connection must already be open.
+func NewBatchWriter(db string, collection string) *BatchWriter_t {
+
+	w := &BatchWriter_t{db: db, collection: collection}
+	w.coll = mongoClient.Database(db).Collection(collection)
+	w.cache.Mem = new([DB_WRITE_THRESHOLD][]byte)
+
+	if err := CreateTimeSeriesCollection(mongoClient.Database(db), collection); err != nil {
+		fmt.Printf("preparing collection %s: %s\n", collection, err)
+	}
+	return w
+}
+
+func (w *BatchWriter_t) Collection() string {
+	return w.collection
+}
+
+// adds a bson document to the cache and writes the cache to Mongo once it holds DB_WRITE_THRESHOLD documents.
+func (w *BatchWriter_t) Write(v []byte) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// write bson data to cache
+	w.cache.Mem[w.cache.Count] = v
+	w.cache.Count++
+
+	if w.cache.Count == DB_WRITE_THRESHOLD {
+		if debug {
+			fmt.Printf("write cache to DB %s\n", w.collection)
+		}
+		w.sendCache()
+	}
+}
+
+// writes anything left in the cache and waits for all the writes for this collection to finish.
+func (w *BatchWriter_t) Flush() {
+
+	w.mu.Lock()
+	if w.cache.Count != 0 {
+		if debug {
+			fmt.Printf("flushing cache to DB %s\n", w.collection)
+		}
+		w.sendCache()
+	}
+	w.mu.Unlock()
+
+	w.wg.Wait()
+}
+
+// hands the current cache to a write thread and sets up a new one. Must be called with mu held.
+// Blocks until one of the MAX_CONCURRENT_INSERTS insert slots is free.
+func (w *BatchWriter_t) sendCache() {
+
+	insertSlots <- struct{}{}
+	w.wg.Add(1)
+	go w.writeCacheToDB(w.cache) // send a COPY of the cache so that this thread can carry on filling a new one
+
+	w.cache.Mem = new([DB_WRITE_THRESHOLD][]byte)
+	w.cache.Count = 0
+}
+
+// see https://docs.mongodb.com/drivers/go/current/fundamentals/crud/write-operations/insert/
+// and https://pkg.go.dev/go.mongodb.org/mongo-driver@v1.8.0/mongo#Collection.InsertMany
+
+func (w *BatchWriter_t) writeCacheToDB(localCache DbWriteCache_t) {
+
+	defer w.wg.Done()                // sync up all the threads before the writer is flushed
+	defer func() { <-insertSlots }() // let the next batch go
+
+	if debug {
+		fmt.Printf("Writing to DB start %d\n", atomic.AddInt32(&start, 1))
+	}
+
+	docs := make([][]byte, localCache.Count)
+	for i := 0; i < localCache.Count; i++ {
+		docs[i] = WithDocumentID(localCache.Mem[i])
+	}
+
+	w.insertReliably(docs) // see reliable-insert.go
+
+	if debug {
+		fmt.Printf("Writing to DB done %d\n", atomic.AddInt32(&done, 1))
+	}
+}
+
+// Shared writers
+// --------------
+
+var writersMu sync.Mutex
+var writers = map[string]*BatchWriter_t{} // keyed by db + "/" + collection
+
+// Returns the shared writer for a collection in the active DB, creating it if this is the first write to
+// the collection during this connection.
+func Writer(collection string) *BatchWriter_t {
+
+	activeDB := os.Getenv("ACTIVEDB")
+	key := activeDB + "/" + collection
+
+	writersMu.Lock()
+	defer writersMu.Unlock()
+
+	w, ok := writers[key]
+	if !ok {
+		w = NewBatchWriter(activeDB, collection)
+		writers[key] = w
+	}
+	return w
+}
+
+// flushes every shared writer and waits for the writes to complete. The connection stays open.
+func Flush() {
+
+	writersMu.Lock()
+	all := make([]*BatchWriter_t, 0, len(writers))
+	for _, w := range writers {
+		all = append(all, w)
+	}
+	writersMu.Unlock()
+
+	for _, w := range all {
+		w.Flush()
+	}
+}
+
+// forgets the shared writer for a collection in the active DB without writing its cache.
+func discardWriter(collection string) {
+
+	writersMu.Lock()
+	defer writersMu.Unlock()
+
+	key := os.Getenv("ACTIVEDB") + "/" + collection
+	if w, ok := writers[key]; ok {
+		w.wg.Wait() // let any inserts in flight finish before the collection goes away
+		delete(writers, key)
+	}
+}
+
+func resetWriters() {
+
+	writersMu.Lock()
+	defer writersMu.Unlock()
+	writers = map[string]*BatchWriter_t{}
+}
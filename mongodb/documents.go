@@ -0,0 +1,57 @@
+package mongodb
+
+import (
+	"context"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Catalog collections. These hold documents about the data rather than measurements - the session catalog,
+calibration profiles, polars etc. They are ordinary collections, not time-series ones, and documents are
+read and replaced whole by their _id. Their names all start with CATALOG_PREFIX so they can be told apart
+from the measurement collections.
+*/
+
+const CATALOG_PREFIX = "catalog-"
+
+func IsCatalogCollection(collection string) bool {
+	return strings.HasPrefix(collection, CATALOG_PREFIX)
+}
+
+// Inserts or replaces the document with the given _id. doc must marshal to a document with that _id.
+func ReplaceDocument(collection string, id string, doc interface{}) error {
+
+	coll := ActiveDB().Collection(collection)
+	_, err := coll.ReplaceOne(context.TODO(), bson.M{"_id": id}, doc, options.Replace().SetUpsert(true))
+	return err
+}
+
+// Reads the document with the given _id into result. Returns mongo.ErrNoDocuments if there isnt one.
+func FindDocument(collection string, id string, result interface{}) error {
+
+	return ActiveDB().Collection(collection).FindOne(context.TODO(), bson.M{"_id": id}).Decode(result)
+}
+
+// Reads every document in a catalog collection into results, which must be a pointer to a slice.
+func FindAllDocuments(collection string, results interface{}) error {
+
+	cursor, err := ActiveDB().Collection(collection).Find(context.TODO(), bson.D{}, options.Find().SetSort(bson.M{"_id": 1}))
+	if err != nil {
+		return err
+	}
+	return cursor.All(context.TODO(), results)
+}
+
+func DeleteDocument(collection string, id string) error {
+
+	_, err := ActiveDB().Collection(collection).DeleteOne(context.TODO(), bson.M{"_id": id})
+	return err
+}
+
+func IsNotFound(err error) bool {
+	return err == mongo.ErrNoDocuments
+}
@@ -0,0 +1,179 @@
+package mongodb
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+Time range queries. A query returns the documents for one measurement (the documents that have Field) between
+two timestamps, sorted by time. Long ranges are read a page at a time: each page returns a token which is passed
+back in After to get the next page. The token records the timestamp and _id of the last document returned, so
+paging is stable even if more data is written while the pages are being read, unlike skip/limit paging.
+*/
+
+type RangeQuery_t struct {
+	Collection string
+	Field      string    // only documents containing this field are returned, e.g. "lat". Empty for all documents
+	Start      time.Time // inclusive. Zero leaves the range open at this end
+	End        time.Time // inclusive. Zero leaves the range open at this end
+	Descending bool      // newest first
+	Projection []string  // the fields to return. _id and ts are always returned. Empty for the whole document
+	Limit      int64     // page size. 0 returns everything in one page
+	After      string    // page token returned by the previous page, empty for the first page
+}
+
+// Reads a page of documents into results, which must be a pointer to a slice of the measurement type,
+// e.g. *[]transform.PositionData_t. Returns the token for the next page, which is empty on the last page.
+func ReadBetweenTimes(q RangeQuery_t, results interface{}) (string, error) {
+
+	filter, err := RangeFilter(q)
+	if err != nil {
+		return "", err
+	}
+
+	order := 1
+	if q.Descending {
+		order = -1
+	}
+	opts := options.Find().SetSort(bson.D{{Key: TIME_FIELD, Value: order}, {Key: "_id", Value: order}})
+
+	if q.Limit > 0 {
+		opts.SetLimit(q.Limit)
+	}
+	if len(q.Projection) != 0 {
+		projection := bson.D{{Key: "_id", Value: 1}, {Key: TIME_FIELD, Value: 1}}
+		for _, field := range q.Projection {
+			if field != "_id" && field != TIME_FIELD {
+				projection = append(projection, bson.E{Key: field, Value: 1})
+			}
+		}
+		opts.SetProjection(projection)
+	}
+
+	cursor, err := ActiveDB().Collection(q.Collection).Find(context.TODO(), filter, opts)
+	if err != nil {
+		return "", err
+	}
+
+	// decode the raw documents first so the last one can be used to make the page token
+	var raws []bson.Raw
+	if err := cursor.All(context.TODO(), &raws); err != nil {
+		return "", err
+	}
+	if err := DecodeAll(raws, results); err != nil {
+		return "", err
+	}
+
+	if q.Limit == 0 || int64(len(raws)) < q.Limit {
+		return "", nil // nothing more to read
+	}
+	return PageToken(raws[len(raws)-1]), nil
+}
+
+// Builds the mongo filter for a range query, including the position of the page to start from.
+func RangeFilter(q RangeQuery_t) (bson.M, error) {
+
+	filter := bson.M{}
+	if q.Field != "" {
+		filter[q.Field] = bson.M{"$exists": true}
+	}
+
+	tsFilter := bson.M{}
+	if !q.Start.IsZero() {
+		tsFilter["$gte"] = q.Start
+	}
+	if !q.End.IsZero() {
+		tsFilter["$lte"] = q.End
+	}
+	if len(tsFilter) != 0 {
+		filter[TIME_FIELD] = tsFilter
+	}
+
+	if q.After != "" {
+		ts, id, err := ParsePageToken(q.After)
+		if err != nil {
+			return nil, err
+		}
+
+		// carry on after the last document: a later timestamp, or the same timestamp and a later _id
+		cmp := "$gt"
+		if q.Descending {
+			cmp = "$lt"
+		}
+		filter["$or"] = bson.A{
+			bson.M{TIME_FIELD: bson.M{cmp: ts}},
+			bson.M{TIME_FIELD: ts, "_id": bson.M{cmp: id}},
+		}
+	}
+	return filter, nil
+}
+
+// Page tokens are "<ts as RFC3339Nano>|<_id>", base64 encoded so they can go in a url. Collections written
+// before deterministic ids have object ids, which are marked with an "oid:" prefix so they compare correctly.
+func PageToken(last bson.Raw) string {
+
+	ts, _ := last.Lookup(TIME_FIELD).TimeOK()
+
+	id, ok := last.Lookup("_id").StringValueOK()
+	if oid, isOid := last.Lookup("_id").ObjectIDOK(); !ok && isOid {
+		id = "oid:" + oid.Hex()
+	}
+	return base64.URLEncoding.EncodeToString([]byte(ts.UTC().Format(time.RFC3339Nano) + "|" + id))
+}
+
+// Returns the timestamp and _id recorded in a page token. The _id is either a string or an object id.
+func ParsePageToken(token string) (time.Time, interface{}, error) {
+
+	decoded, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid page token: %s", err)
+	}
+
+	parts := strings.SplitN(string(decoded), "|", 2)
+	if len(parts) != 2 {
+		return time.Time{}, "", fmt.Errorf("invalid page token")
+	}
+
+	ts, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return time.Time{}, "", fmt.Errorf("invalid page token: %s", err)
+	}
+
+	if strings.HasPrefix(parts[1], "oid:") {
+		oid, err := primitive.ObjectIDFromHex(strings.TrimPrefix(parts[1], "oid:"))
+		if err != nil {
+			return time.Time{}, "", fmt.Errorf("invalid page token: %s", err)
+		}
+		return ts, oid, nil
+	}
+	return ts, parts[1], nil
+}
+
+// Decodes raw documents into results, which must be a pointer to a slice.
+func DecodeAll(raws []bson.Raw, results interface{}) error {
+
+	slice := reflect.ValueOf(results)
+	if slice.Kind() != reflect.Ptr || slice.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("results must be a pointer to a slice, not %T", results)
+	}
+	slice = slice.Elem()
+	elemType := slice.Type().Elem()
+
+	for _, raw := range raws {
+		elem := reflect.New(elemType)
+		if err := bson.Unmarshal(raw, elem.Interface()); err != nil {
+			return err
+		}
+		slice.Set(reflect.Append(slice, elem.Elem()))
+	}
+	return nil
+}
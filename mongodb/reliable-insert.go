@@ -0,0 +1,292 @@
+package mongodb
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/mongo/driver/topology"
+)
+
+/*
+Inserting batches so that a flaky connection to Atlas doesnt lose an import:
+
+	- at most MAX_CONCURRENT_INSERTS batches are written at once across all the writers. Writers block when
+	  all the slots are taken, which stops a fast transform running away from a slow network.
+	- transient errors (network, timeouts, server selection, anything labelled retryable) are retried with
+	  exponential backoff, up to MAX_INSERT_RETRIES times.
+	- every document gets a deterministic _id made from a hash of its contents, and documents whose _id is
+	  already in the collection are skipped. Re-running an import, or retrying a batch that was half written
+	  before the connection dropped, doesnt duplicate data. This has to be checked explicitly because
+	  time-series collections dont have a unique index on _id. The catch is that two readings with the same
+	  ts, source and values are the same document as far as this is concerned, and only the first is kept.
+	- documents that still cant be written are appended to a dead-letter file as extended json, one per line,
+	  instead of panicing. They can be loaded later with mongoimport.
+*/
+
+const MAX_CONCURRENT_INSERTS = 4
+const MAX_INSERT_RETRIES = 6
+const INITIAL_BACKOFF = 500 * time.Millisecond // doubles on each retry, 500ms -> 16s
+const MAX_BACKOFF = 30 * time.Second
+
+var insertSlots = make(chan struct{}, MAX_CONCURRENT_INSERTS)
+
+// Returns v with a deterministic _id added, made from the sha1 of the document. Documents that already
+// have an _id are returned unchanged. The whole document goes into the hash, so identical readings with the
+// same ts and source get the same _id and all but one of them are dropped as duplicates. For the logger that
+// is a sentence repeated within the same millisecond, which carries nothing new. Anything that needs to keep
+// repeats must put something that tells them apart (eg a sequence number) in the document before it is written.
+func WithDocumentID(v []byte) []byte {
+
+	if _, err := bson.Raw(v).LookupErr("_id"); err == nil {
+		return v
+	}
+
+	sum := sha1.Sum(v)
+	id := hex.EncodeToString(sum[:])
+
+	// _id goes first by convention. Unmarshal into a bson.D to keep the order of the rest of the document
+	var doc bson.D
+	if err := bson.Unmarshal(v, &doc); err != nil {
+		return v // not valid bson - let the insert report it
+	}
+	doc = append(bson.D{{Key: "_id", Value: id}}, doc...)
+
+	withID, err := bson.Marshal(doc)
+	if err != nil {
+		return v
+	}
+	return withID
+}
+
+// inserts docs into the writer's collection, retrying transient errors and dead-lettering what cant be written.
+func (w *BatchWriter_t) insertReliably(docs [][]byte) {
+
+	backoff := INITIAL_BACKOFF
+	pending := docs
+
+	for attempt := 0; ; attempt++ {
+
+		var err error
+		pending, err = w.removeExisting(pending)
+
+		if err == nil {
+			if len(pending) == 0 {
+				return // everything is already in the collection
+			}
+			err = w.insert(pending)
+			if err == nil {
+				return
+			}
+		}
+
+		failed, transient := classifyInsertError(err, pending)
+		if len(failed) == 0 {
+			return // only duplicate key errors, which means the documents are there already
+		}
+
+		if !transient || attempt == MAX_INSERT_RETRIES {
+			fmt.Printf("giving up on %d documents for %s after %d attempts: %s\n", len(failed), w.collection, attempt+1, err)
+			w.deadLetter(failed, err)
+			return
+		}
+
+		if debug {
+			fmt.Printf("transient error writing to %s, retrying in %v: %s\n", w.collection, backoff, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > MAX_BACKOFF {
+			backoff = MAX_BACKOFF
+		}
+		pending = failed
+	}
+}
+
+func (w *BatchWriter_t) insert(docs [][]byte) error {
+
+	// Copy the cache into an []interface {} - Not 100% sure why this is necessary.
+	// I cant coerce the compiler to cast the array of bson strings to an array of interface{}
+	var ifDocs []interface{} = make([]interface{}, len(docs))
+	for i := range docs {
+		ifDocs[i] = docs[i]
+	}
+
+	// unordered so that one bad document doesnt stop the rest of the batch
+	_, err := w.coll.InsertMany(context.TODO(), ifDocs, options.InsertMany().SetOrdered(false))
+	return err
+}
+
+// returns the documents whose _id isnt in the collection yet. The query is limited to the time range of the
+// batch so that it only has to look at the buckets the batch would have gone into.
+func (w *BatchWriter_t) removeExisting(docs [][]byte) ([][]byte, error) {
+
+	if len(docs) == 0 {
+		return docs, nil
+	}
+
+	var ids []interface{}
+	var first, last time.Time
+	for i, doc := range docs {
+		raw := bson.Raw(doc)
+		ids = append(ids, raw.Lookup("_id"))
+		ts, _ := raw.Lookup(TIME_FIELD).TimeOK()
+		if i == 0 || ts.Before(first) {
+			first = ts
+		}
+		if i == 0 || ts.After(last) {
+			last = ts
+		}
+	}
+
+	filter := bson.M{
+		"_id":      bson.M{"$in": ids},
+		TIME_FIELD: bson.M{"$gte": first, "$lte": last},
+	}
+	cursor, err := w.coll.Find(context.TODO(), filter, options.Find().SetProjection(bson.M{"_id": 1}))
+	if err != nil {
+		return docs, err
+	}
+
+	var found []bson.Raw
+	if err := cursor.All(context.TODO(), &found); err != nil {
+		return docs, err
+	}
+	if len(found) == 0 {
+		return docs, nil
+	}
+
+	existing := map[string]bool{}
+	for _, f := range found {
+		existing[f.Lookup("_id").String()] = true
+	}
+
+	var missing [][]byte
+	for _, doc := range docs {
+		if !existing[bson.Raw(doc).Lookup("_id").String()] {
+			missing = append(missing, doc)
+		}
+	}
+
+	if debug {
+		fmt.Printf("%d of %d documents already in %s\n", len(docs)-len(missing), len(docs), w.collection)
+	}
+	return missing, nil
+}
+
+// works out which of the documents in a failed insert need writing again and whether trying again might work.
+func classifyInsertError(err error, docs [][]byte) ([][]byte, bool) {
+
+	var bulkErr mongo.BulkWriteException
+	if errors.As(err, &bulkErr) {
+
+		var failed [][]byte
+		for _, we := range bulkErr.WriteErrors {
+			if we.Code == 11000 { // duplicate key - already written
+				continue
+			}
+			failed = append(failed, docs[we.Index])
+		}
+
+		if bulkErr.WriteConcernError != nil && len(bulkErr.WriteErrors) == 0 {
+			// the writes may or may not have made it. Try them all again, the existing
+			// documents are removed before the retry.
+			return docs, true
+		}
+		return failed, bulkErr.HasErrorLabel("RetryableWriteError")
+	}
+
+	return docs, isTransient(err)
+}
+
+func isTransient(err error) bool {
+
+	if mongo.IsNetworkError(err) || mongo.IsTimeout(err) {
+		return true
+	}
+
+	var selectionErr topology.ServerSelectionError
+	if errors.As(err, &selectionErr) {
+		return true
+	}
+
+	var serverErr mongo.ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.HasErrorLabel("RetryableWriteError") || serverErr.HasErrorLabel("TransientTransactionError")
+	}
+	return false
+}
+
+// Dead letters
+// ------------
+
+var deadLetterMu sync.Mutex
+var deadLetterCount int
+var deadLetterFiles = map[string]bool{}
+
+// the dead-letter file for a collection is <collection>-deadletter.json in DEADLETTER_DIR, or the current
+// directory if that isnt set.
+func DeadLetterFile(collection string) string {
+	return filepath.Join(os.Getenv("DEADLETTER_DIR"), collection+"-deadletter.json")
+}
+
+// Returns the number of documents written to dead-letter files since the program started.
+func DeadLetterCount() int {
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	return deadLetterCount
+}
+
+// Returns the dead-letter files written to since the program started, sorted.
+func DeadLetterFiles() []string {
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	var files []string
+	for f := range deadLetterFiles {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func (w *BatchWriter_t) deadLetter(docs [][]byte, cause error) {
+
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+
+	fileName := DeadLetterFile(w.collection)
+	f, err := os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		// nowhere left to put them, so this is the end of the road
+		fmt.Printf("unable to open dead-letter file %s: %s\n", fileName, err)
+		panic(cause)
+	}
+	defer f.Close()
+	deadLetterFiles[fileName] = true
+
+	for _, doc := range docs {
+		line, err := bson.MarshalExtJSON(bson.Raw(doc), true, false)
+		if err != nil {
+			fmt.Printf("unable to convert document to json for the dead-letter file: %s\n", err)
+			continue
+		}
+		if _, err := f.Write(append(line, '\n')); err != nil {
+			fmt.Printf("unable to write to dead-letter file %s: %s\n", fileName, err)
+			panic(cause)
+		}
+		deadLetterCount++
+	}
+}
@@ -0,0 +1,160 @@
+package mongodb
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+/*
+All the measurement collections are created as native Mongo time-series collections. Every document
+written by the transform package has a "ts" timestamp and a "metadata" sub document, so these are used
+as the time and meta fields. Only the meta field can be updated once a document is written, see
+https://docs.mongodb.com/manual/core/timeseries/timeseries-limitations/
+
+Mongo wont create a time-series collection implicitly on the first insert, so the collection is created
+when a writer is created for it, see NewBatchWriter.
+
+Deleting documents from a time-series collection by anything other than the meta field needs server 7.0
+or later. Resuming a derived collection deletes its last bucket by ts (see transform/import-mode.go), so
+MIN_SERVER_VERSION is checked when the store is opened.
+*/
+
+const TIME_FIELD = "ts"
+const META_FIELD = "metadata"
+const GRANULARITY = "seconds" // the B&G sends most readings at 1-10Hz
+const MIN_SERVER_VERSION = 7  // major version, for DeleteBetweenTimes
+
+// secondary indexes added to every time-series collection. Range queries filter on a measurement
+// field and a time range, and the data source is the only meta field that is queried on.
+var timeSeriesIndexes = []mongo.IndexModel{
+	{Keys: bson.D{{Key: META_FIELD + ".source", Value: 1}, {Key: TIME_FIELD, Value: 1}}},
+	{Keys: bson.D{{Key: TIME_FIELD, Value: 1}}},
+}
+
+// the part of a collection specification that describes a time-series collection
+type timeSeriesSpec_t struct {
+	TimeSeries struct {
+		TimeField   string `bson:"timeField"`
+		MetaField   string `bson:"metaField"`
+		Granularity string `bson:"granularity"`
+	} `bson:"timeseries"`
+}
+
+// Creates collection as a time-series collection with the standard indexes. If it already exists its schema
+// is checked instead, so it is safe to call every time a collection is written to.
+func CreateTimeSeriesCollection(db *mongo.Database, collection string) error {
+
+	names, err := db.ListCollectionNames(context.TODO(), bson.M{"name": collection})
+	if err != nil {
+		return err
+	}
+
+	if len(names) != 0 { // already there, so make sure it is what we expect
+		return CheckTimeSeriesSchema(db, collection)
+	}
+
+	if debug {
+		fmt.Printf("Creating time-series collection %s\n", collection)
+	}
+
+	tsOpts := options.TimeSeries().SetTimeField(TIME_FIELD).SetMetaField(META_FIELD).SetGranularity(GRANULARITY)
+	if err := db.CreateCollection(context.TODO(), collection, options.CreateCollection().SetTimeSeriesOptions(tsOpts)); err != nil {
+		return err
+	}
+
+	_, err = db.Collection(collection).Indexes().CreateMany(context.TODO(), timeSeriesIndexes)
+	return err
+}
+
+// Checks that collection is a time-series collection using the time field, meta field and granularity above.
+// Collections written before time-series support was added are plain collections and fail this check.
+func CheckTimeSeriesSchema(db *mongo.Database, collection string) error {
+
+	specs, err := db.ListCollectionSpecifications(context.TODO(), bson.M{"name": collection})
+	if err != nil {
+		return err
+	}
+	if len(specs) == 0 {
+		return fmt.Errorf("collection %s does not exist", collection)
+	}
+
+	spec := specs[0]
+	if spec.Type != "timeseries" {
+		return fmt.Errorf("collection %s is a %s collection, not a time-series collection", collection, spec.Type)
+	}
+
+	var ts timeSeriesSpec_t
+	if err := bson.Unmarshal(spec.Options, &ts); err != nil {
+		return err
+	}
+
+	if ts.TimeSeries.TimeField != TIME_FIELD || ts.TimeSeries.MetaField != META_FIELD {
+		return fmt.Errorf("collection %s has time field %q and meta field %q, expected %q and %q",
+			collection, ts.TimeSeries.TimeField, ts.TimeSeries.MetaField, TIME_FIELD, META_FIELD)
+	}
+	if ts.TimeSeries.Granularity != GRANULARITY {
+		return fmt.Errorf("collection %s has granularity %q, expected %q", collection, ts.TimeSeries.Granularity, GRANULARITY)
+	}
+
+	return nil
+}
+
+// Checks the schema of every collection in the database and logs the ones that dont match. This is called
+// at startup so that problems show up before a query runs against a collection with the wrong layout.
+// Returns the names of the collections that failed the check.
+func CheckAllSchemas(db *mongo.Database) []string {
+
+	var failed []string
+
+	names, err := db.ListCollectionNames(context.TODO(), bson.D{})
+	if err != nil {
+		log.Printf("unable to list collections to check their schema: %s\n", err)
+		return failed
+	}
+
+	for _, name := range names {
+		if IsCatalogCollection(name) {
+			continue // these are ordinary collections, see documents.go
+		}
+		if strings.HasPrefix(name, "system.") {
+			continue // mongo's own, eg the system.buckets behind each time-series collection
+		}
+		if err := CheckTimeSeriesSchema(db, name); err != nil {
+			log.Printf("schema check: %s\n", err)
+			failed = append(failed, name)
+		}
+	}
+	return failed
+}
+
+// Returns an error if the server is older than MIN_SERVER_VERSION
+func CheckServerVersion(db *mongo.Database) error {
+
+	var info struct {
+		Version      string  `bson:"version"`
+		VersionArray []int32 `bson:"versionArray"`
+	}
+	if err := db.RunCommand(context.TODO(), bson.D{{Key: "buildInfo", Value: 1}}).Decode(&info); err != nil {
+		return fmt.Errorf("unable to read the server version: %s", err)
+	}
+	if len(info.VersionArray) == 0 || info.VersionArray[0] < MIN_SERVER_VERSION {
+		return fmt.Errorf("server version %s is older than %d.0, which is needed to delete from time-series collections by ts", info.Version, MIN_SERVER_VERSION)
+	}
+	return nil
+}
+
+// Deletes the documents in a time-series collection with a timestamp between start and end (inclusive),
+// in one go. Needs MIN_SERVER_VERSION.
+func DeleteBetweenTimes(collection string, start time.Time, end time.Time) error {
+
+	filter := bson.M{TIME_FIELD: bson.M{"$gte": start, "$lte": end}}
+	_, err := ActiveDB().Collection(collection).DeleteMany(context.TODO(), filter)
+	return err
+}
@@ -0,0 +1,536 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+/*
+Store backed by local files, for running without a connection to Atlas. Each collection is a file of bson
+documents one after another, <dir>/<db>/<collection>.bson, which is the same layout mongodump uses so a
+collection can be loaded into Atlas later with mongorestore.
+
+Documents get the same deterministic _id as they do in Mongo and duplicates are skipped, so re-running an import
+into the local store is also safe. Range queries read the whole file, which is fine for a day or two of sailing.
+*/
+
+const LOCAL_FILE_EXT = ".bson"
+
+type localStore struct {
+	dir string // the directory holding this db's collections
+
+	mu      sync.Mutex
+	writers map[string]*localWriter
+}
+
+func openLocalStore(dir string, db string) *localStore {
+
+	s := &localStore{dir: filepath.Join(dir, db), writers: map[string]*localWriter{}}
+
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		fmt.Printf("unable to create local store directory %s: %s\n", s.dir, err)
+		os.Exit(1)
+	}
+	if debug {
+		fmt.Printf("using local store in %s\n", s.dir)
+	}
+	return s
+}
+
+func (s *localStore) path(collection string) string {
+	return filepath.Join(s.dir, collection+LOCAL_FILE_EXT)
+}
+
+func (s *localStore) Writer(collection string) Writer {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	w, ok := s.writers[collection]
+	if !ok {
+		w = newLocalWriter(s.path(collection))
+		s.writers[collection] = w
+	}
+	return w
+}
+
+func (s *localStore) Range(collection string, field string, start time.Time, end time.Time) (Cursor, error) {
+
+	matches, err := s.scan(collection, field, start, end)
+	if err != nil {
+		return nil, err
+	}
+	return &sliceCursor{docs: matches, i: -1}, nil
+}
+
+// the local version of mongodb.ReadBetweenTimes(). Everything is done in memory after reading the file.
+func (s *localStore) Query(q RangeQuery_t, results interface{}) (string, error) {
+
+	matches, err := s.scan(q.Collection, q.Field, q.Start, q.End)
+	if err != nil {
+		return "", err
+	}
+
+	if q.Descending {
+		for a, b := 0, len(matches)-1; a < b; a, b = a+1, b-1 {
+			matches[a], matches[b] = matches[b], matches[a]
+		}
+	}
+
+	// skip to the document after the one the page token points at
+	if q.After != "" {
+		ts, id, err := mongodb.ParsePageToken(q.After)
+		if err != nil {
+			return "", err
+		}
+		afterID := fmt.Sprint(id)
+		if oid, ok := id.(primitive.ObjectID); ok {
+			afterID = oid.Hex()
+		}
+
+		first := len(matches)
+		for i, doc := range matches {
+			docTs := doc.Lookup(mongodb.TIME_FIELD).Time()
+			later := docTs.After(ts) || (docTs.Equal(ts) && idKey(doc) > afterID)
+			if q.Descending {
+				later = docTs.Before(ts) || (docTs.Equal(ts) && idKey(doc) < afterID)
+			}
+			if later {
+				first = i
+				break
+			}
+		}
+		matches = matches[first:]
+	}
+
+	if q.Limit > 0 && int64(len(matches)) > q.Limit {
+		matches = matches[:q.Limit]
+	}
+
+	if len(q.Projection) != 0 {
+		for i := range matches {
+			matches[i] = project(matches[i], q.Projection)
+		}
+	}
+
+	if err := mongodb.DecodeAll(matches, results); err != nil {
+		return "", err
+	}
+
+	if q.Limit == 0 || int64(len(matches)) < q.Limit {
+		return "", nil
+	}
+	return mongodb.PageToken(matches[len(matches)-1]), nil
+}
+
+// returns the documents in a collection containing field with a timestamp between start and end, sorted by
+// timestamp and then _id, the same order as the mongo queries.
+func (s *localStore) scan(collection string, field string, start time.Time, end time.Time) ([]bson.Raw, error) {
+
+	docs, err := readBsonFile(s.path(collection))
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []bson.Raw
+	for _, doc := range docs {
+
+		if field != "" {
+			if _, err := doc.LookupErr(strings.Split(field, ".")...); err != nil {
+				continue
+			}
+		}
+
+		ts, ok := doc.Lookup(mongodb.TIME_FIELD).TimeOK()
+		if !ok {
+			continue
+		}
+		if (!start.IsZero() && ts.Before(start)) || (!end.IsZero() && ts.After(end)) {
+			continue
+		}
+		matches = append(matches, doc)
+	}
+
+	// documents are mostly written in time order already, but the transform doesnt guarantee it
+	sort.SliceStable(matches, func(a, b int) bool {
+		tsA := matches[a].Lookup(mongodb.TIME_FIELD).Time()
+		tsB := matches[b].Lookup(mongodb.TIME_FIELD).Time()
+		if tsA.Equal(tsB) {
+			return idKey(matches[a]) < idKey(matches[b])
+		}
+		return tsA.Before(tsB)
+	})
+
+	return matches, nil
+}
+
+// the _id of a document as a string, for sorting. Object ids sort the same way as their hex.
+func idKey(doc bson.Raw) string {
+
+	id := doc.Lookup("_id")
+	if s, ok := id.StringValueOK(); ok {
+		return s
+	}
+	if oid, ok := id.ObjectIDOK(); ok {
+		return oid.Hex()
+	}
+	return id.String()
+}
+
+// returns a copy of doc with only _id, ts and the projected fields. Projections on a sub document field,
+// e.g. "metadata.source", return the whole sub document.
+func project(doc bson.Raw, fields []string) bson.Raw {
+
+	keep := map[string]bool{"_id": true, mongodb.TIME_FIELD: true}
+	for _, field := range fields {
+		keep[strings.Split(field, ".")[0]] = true
+	}
+
+	projected := bson.D{}
+	elems, err := doc.Elements()
+	if err != nil {
+		return doc
+	}
+	for _, elem := range elems {
+		if keep[elem.Key()] {
+			projected = append(projected, bson.E{Key: elem.Key(), Value: elem.Value()})
+		}
+	}
+
+	raw, err := bson.Marshal(projected)
+	if err != nil {
+		return doc
+	}
+	return raw
+}
+
+func (s *localStore) Count(collection string) (int64, error) {
+
+	docs, err := readBsonFile(s.path(collection))
+	return int64(len(docs)), err
+}
+
+func (s *localStore) ListCollections() ([]string, error) {
+
+	files, err := filepath.Glob(filepath.Join(s.dir, "*"+LOCAL_FILE_EXT))
+	if err != nil {
+		return nil, err
+	}
+
+	colls := []string{}
+	for _, file := range files {
+		colls = append(colls, strings.TrimSuffix(filepath.Base(file), LOCAL_FILE_EXT))
+	}
+	return colls, nil
+}
+
+func (s *localStore) ListSessions() ([]string, error) {
+
+	colls, err := s.ListCollections()
+	if err != nil {
+		return nil, err
+	}
+	return sessionsFromCollections(colls), nil
+}
+
+func (s *localStore) Drop(collection string) error {
+
+	s.mu.Lock()
+	delete(s.writers, collection) // anything not yet written is discarded
+	s.mu.Unlock()
+
+	err := os.Remove(s.path(collection))
+	if os.IsNotExist(err) {
+		return nil // same as Mongo, dropping a collection that isnt there isnt an error
+	}
+	return err
+}
+
+// catalog documents are kept in the same bson file format as the measurements. Put rewrites the whole file,
+// which is fine for the handful of documents in a catalog.
+func (s *localStore) Put(collection string, id string, doc interface{}) error {
+
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if docID, ok := bson.Raw(raw).Lookup("_id").StringValueOK(); !ok || docID != id {
+		return fmt.Errorf("document for %s does not have _id %s", collection, id)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	docs, err := readBsonFile(s.path(collection))
+	if err != nil {
+		return err
+	}
+
+	replaced := false
+	for i, existing := range docs {
+		if idKey(existing) == id {
+			docs[i] = raw
+			replaced = true
+		}
+	}
+	if !replaced {
+		docs = append(docs, raw)
+	}
+	return writeBsonFile(s.path(collection), docs)
+}
+
+func (s *localStore) Get(collection string, id string, result interface{}) error {
+
+	docs, err := readBsonFile(s.path(collection))
+	if err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if idKey(doc) == id {
+			return bson.Unmarshal(doc, result)
+		}
+	}
+	return ErrNotFound
+}
+
+func (s *localStore) GetAll(collection string, results interface{}) error {
+
+	docs, err := readBsonFile(s.path(collection))
+	if err != nil {
+		return err
+	}
+	sort.Slice(docs, func(a, b int) bool { return idKey(docs[a]) < idKey(docs[b]) })
+	return mongodb.DecodeAll(docs, results)
+}
+
+func (s *localStore) Delete(collection string, id string) error {
+	return s.deleteWhere(collection, func(doc bson.Raw) bool { return idKey(doc) == id })
+}
+
+func (s *localStore) DeleteRange(collection string, start time.Time, end time.Time) error {
+
+	return s.deleteWhere(collection, func(doc bson.Raw) bool {
+		ts, ok := doc.Lookup(mongodb.TIME_FIELD).TimeOK()
+		return ok && !ts.Before(start) && !ts.After(end)
+	})
+}
+
+// rewrites a collection's file without the documents that match
+func (s *localStore) deleteWhere(collection string, match func(doc bson.Raw) bool) error {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	docs, err := readBsonFile(s.path(collection))
+	if err != nil {
+		return err
+	}
+
+	kept := docs[:0]
+	var deleted []string
+	for _, doc := range docs {
+		if !match(doc) {
+			kept = append(kept, doc)
+		} else {
+			deleted = append(deleted, doc.Lookup("_id").String())
+		}
+	}
+
+	// so the writer doesnt skip the document if it is written again
+	if w, ok := s.writers[collection]; ok {
+		w.mu.Lock()
+		for _, d := range deleted {
+			delete(w.ids, d)
+		}
+		w.mu.Unlock()
+	}
+	return writeBsonFile(s.path(collection), kept)
+}
+
+func (s *localStore) Flush() {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, w := range s.writers {
+		w.Flush()
+	}
+}
+
+func (s *localStore) Close() {
+	s.Flush()
+}
+
+// Writer for a local collection file
+
+type localWriter struct {
+	path string
+
+	mu      sync.Mutex
+	pending [][]byte
+	ids     map[string]bool // _ids already in the file, so re-runs dont duplicate documents
+}
+
+func newLocalWriter(path string) *localWriter {
+
+	w := &localWriter{path: path, ids: map[string]bool{}}
+
+	docs, err := readBsonFile(path)
+	if err != nil {
+		fmt.Printf("unable to read %s: %s\n", path, err)
+	}
+	for _, doc := range docs {
+		w.ids[doc.Lookup("_id").String()] = true
+	}
+	return w
+}
+
+func (w *localWriter) Write(doc []byte) {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	doc = mongodb.WithDocumentID(doc)
+	id := bson.Raw(doc).Lookup("_id").String()
+	if w.ids[id] {
+		return
+	}
+	w.ids[id] = true
+	w.pending = append(w.pending, doc)
+
+	if len(w.pending) >= mongodb.DB_WRITE_THRESHOLD {
+		w.writePending()
+	}
+}
+
+func (w *localWriter) Flush() {
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writePending()
+}
+
+// appends the pending documents to the collection file. Must be called with mu held.
+func (w *localWriter) writePending() {
+
+	if len(w.pending) == 0 {
+		return
+	}
+
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		panic(err) // the local disk is the last resort, there is nowhere else to put the data
+	}
+	defer f.Close()
+
+	for _, doc := range w.pending {
+		if _, err := f.Write(doc); err != nil {
+			panic(err)
+		}
+	}
+	check(f.Sync())
+	w.pending = w.pending[:0]
+}
+
+// reads a file of bson documents. A missing file is an empty collection.
+func readBsonFile(path string) ([]bson.Raw, error) {
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var docs []bson.Raw
+	for len(data) > 0 {
+
+		// every bson document starts with its length as a little endian int32
+		if len(data) < 4 {
+			return docs, fmt.Errorf("%s: truncated document at end of file", path)
+		}
+		length := int(binary.LittleEndian.Uint32(data[:4]))
+		if length < 5 || length > len(data) {
+			return docs, fmt.Errorf("%s: truncated document at end of file", path)
+		}
+
+		doc := bson.Raw(data[:length])
+		if err := doc.Validate(); err != nil {
+			return docs, fmt.Errorf("%s: %s", path, err)
+		}
+		docs = append(docs, doc)
+		data = data[length:]
+	}
+	return docs, nil
+}
+
+// replaces a bson file with docs. The new file is written alongside and renamed over the old one so a crash
+// part way through doesnt lose the catalog.
+func writeBsonFile(path string, docs []bson.Raw) error {
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	for _, doc := range docs {
+		if _, err := f.Write(doc); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func check(e error) {
+	if e != nil {
+		panic(e)
+	}
+}
+
+// cursor over documents already in memory
+type sliceCursor struct {
+	docs []bson.Raw
+	i    int
+}
+
+func (c *sliceCursor) Next() bool {
+	c.i++
+	return c.i < len(c.docs)
+}
+
+func (c *sliceCursor) Decode(v interface{}) error {
+	return bson.Unmarshal(c.docs[c.i], v)
+}
+
+func (c *sliceCursor) Current() bson.Raw {
+	return c.docs[c.i]
+}
+
+func (c *sliceCursor) Err() error {
+	return nil
+}
+
+func (c *sliceCursor) Close() error {
+	return nil
+}
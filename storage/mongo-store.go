@@ -0,0 +1,131 @@
+package storage
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// Store backed by Mongo Atlas. This is a thin layer over the mongodb package, which holds the connection.
+type mongoStore struct{}
+
+func openMongoStore() *mongoStore {
+
+	mongodb.InitMongoConnection()
+
+	// check the collections were created as time-series collections before anything reads them
+	failed := mongodb.CheckAllSchemas(mongodb.ActiveDB())
+	if len(failed) != 0 {
+		log.Printf("%d collections are not time-series collections: %v", len(failed), failed)
+	}
+	if err := mongodb.CheckServerVersion(mongodb.ActiveDB()); err != nil {
+		log.Printf("%s. Resuming an import or a derived collection wont work", err)
+	}
+	return &mongoStore{}
+}
+
+func (s *mongoStore) Writer(collection string) Writer {
+	return mongodb.Writer(collection)
+}
+
+func (s *mongoStore) Range(collection string, field string, start time.Time, end time.Time) (Cursor, error) {
+
+	filter, err := mongodb.RangeFilter(RangeQuery_t{Collection: collection, Field: field, Start: start, End: end})
+	if err != nil {
+		return nil, err
+	}
+
+	cursor, err := mongodb.Find(collection, filter, options.Find().SetSort(bson.D{{Key: mongodb.TIME_FIELD, Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+	return &mongoCursor{cursor: cursor}, nil
+}
+
+func (s *mongoStore) Query(q RangeQuery_t, results interface{}) (string, error) {
+	return mongodb.ReadBetweenTimes(q, results)
+}
+
+func (s *mongoStore) Count(collection string) (int64, error) {
+	return mongodb.CountDocuments(collection)
+}
+
+func (s *mongoStore) ListCollections() ([]string, error) {
+	return mongodb.CollectionNames()
+}
+
+func (s *mongoStore) ListSessions() ([]string, error) {
+
+	colls, err := mongodb.CollectionNames()
+	if err != nil {
+		return nil, err
+	}
+	return sessionsFromCollections(colls), nil
+}
+
+func (s *mongoStore) Drop(collection string) error {
+	return mongodb.DropCollection(collection)
+}
+
+func (s *mongoStore) Put(collection string, id string, doc interface{}) error {
+	return mongodb.ReplaceDocument(collection, id, doc)
+}
+
+func (s *mongoStore) Get(collection string, id string, result interface{}) error {
+
+	err := mongodb.FindDocument(collection, id, result)
+	if mongodb.IsNotFound(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *mongoStore) GetAll(collection string, results interface{}) error {
+	return mongodb.FindAllDocuments(collection, results)
+}
+
+func (s *mongoStore) Delete(collection string, id string) error {
+	return mongodb.DeleteDocument(collection, id)
+}
+
+func (s *mongoStore) DeleteRange(collection string, start time.Time, end time.Time) error {
+	return mongodb.DeleteBetweenTimes(collection, start, end)
+}
+
+func (s *mongoStore) Flush() {
+	mongodb.Flush()
+}
+
+func (s *mongoStore) Close() {
+	mongodb.CloseMongoConnection("")
+}
+
+// wraps a mongo cursor so it satisfies Cursor
+type mongoCursor struct {
+	cursor *mongo.Cursor
+}
+
+func (c *mongoCursor) Next() bool {
+	return c.cursor.Next(context.TODO())
+}
+
+func (c *mongoCursor) Decode(v interface{}) error {
+	return c.cursor.Decode(v)
+}
+
+func (c *mongoCursor) Current() bson.Raw {
+	return c.cursor.Current
+}
+
+func (c *mongoCursor) Err() error {
+	return c.cursor.Err()
+}
+
+func (c *mongoCursor) Close() error {
+	return c.cursor.Close(context.TODO())
+}
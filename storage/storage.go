@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/mongodb"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+The storage package hides where the data lives. The transform tools, low-res views and the API all go through
+a Store, which is either Mongo Atlas (the mongodb package) or a directory of local files, so everything can
+run on a laptop or on the boat without a network connection.
+
+The backend is picked by the STORAGE_BACKEND environment variable:
+
+	STORAGE_BACKEND=mongo	(default) uses MONGODB_URI and ACTIVEDB, see mongodb/mongo-access.go
+	STORAGE_BACKEND=local	stores each collection as a file of bson documents under LOCAL_STORE_DIR/ACTIVEDB
+*/
+
+var debug bool = true
+
+const BACKEND_MONGO = "mongo"
+const BACKEND_LOCAL = "local"
+const DEFAULT_LOCAL_DIR = "nmea-data"
+
+// Writes bson documents to a collection in batches. Safe for concurrent use.
+type Writer interface {
+	Write(doc []byte)
+	Flush() // writes anything waiting and waits for the writes to finish
+}
+
+// Iterates over the results of a query in time order.
+type Cursor interface {
+	Next() bool
+	Decode(v interface{}) error // decodes the current document into v
+	Current() bson.Raw
+	Err() error
+	Close() error
+}
+
+type Store interface {
+	// Returns the shared batching writer for a collection, creating the collection if needed
+	Writer(collection string) Writer
+
+	// Returns the documents in a collection that contain field and have a timestamp between start and end
+	// (inclusive), sorted by timestamp. An empty field matches every document and a zero start or end time
+	// leaves that end of the range open.
+	Range(collection string, field string, start time.Time, end time.Time) (Cursor, error)
+
+	// Reads a page of a time range query into results, which must be a pointer to a slice. Returns the token
+	// for the next page, empty on the last page. See mongodb/range-query.go
+	Query(q RangeQuery_t, results interface{}) (string, error)
+
+	Count(collection string) (int64, error)
+	ListCollections() ([]string, error)
+	ListSessions() ([]string, error)
+	Drop(collection string) error
+
+	// Deletes the documents in a collection with a timestamp between start and end (inclusive). On Mongo this
+	// needs server 7.0 or later, see mongodb.MIN_SERVER_VERSION
+	DeleteRange(collection string, start time.Time, end time.Time) error
+
+	// Catalog documents (sessions, calibrations etc) are kept in ordinary collections named CATALOG_PREFIX + name
+	// and are read and written whole by _id. doc must marshal to a bson document with the given _id.
+	Put(collection string, id string, doc interface{}) error
+	Get(collection string, id string, result interface{}) error // returns ErrNotFound if there is no such document
+	GetAll(collection string, results interface{}) error        // results must be a pointer to a slice
+	Delete(collection string, id string) error
+
+	Flush() // flushes every writer
+	Close() // flushes every writer and releases the backend
+}
+
+const CATALOG_PREFIX = mongodb.CATALOG_PREFIX
+
+var ErrNotFound = errors.New("document not found")
+
+// the same query is used for both backends
+type RangeQuery_t = mongodb.RangeQuery_t
+
+// Opens the store picked by STORAGE_BACKEND. Only one store should be open at a time.
+func Open() Store {
+
+	switch backend := os.Getenv("STORAGE_BACKEND"); backend {
+	case "", BACKEND_MONGO:
+		return openMongoStore()
+	case BACKEND_LOCAL:
+		dir := os.Getenv("LOCAL_STORE_DIR")
+		if dir == "" {
+			dir = DEFAULT_LOCAL_DIR
+		}
+		return openLocalStore(dir, os.Getenv("ACTIVEDB"))
+	default:
+		fmt.Printf("Unknown STORAGE_BACKEND %s, expected %s or %s\n", backend, BACKEND_MONGO, BACKEND_LOCAL)
+		os.Exit(1)
+	}
+	return nil
+}
+
+// Returns true if the collection exists in the store
+func Exists(s Store, collection string) bool {
+
+	colls, err := s.ListCollections()
+	if err != nil {
+		return false
+	}
+	for _, col := range colls {
+		if col == collection {
+			return true
+		}
+	}
+	return false
+}
+
+// Decodes every document left in cursor into results, which must be a pointer to a slice.
+// The equivalent of mongo.Cursor.All()
+func All(cursor Cursor, results interface{}) error {
+
+	defer cursor.Close()
+
+	var raws []bson.Raw
+	for cursor.Next() {
+		// the mongo cursor reuses its buffer so take a copy
+		raws = append(raws, append(bson.Raw(nil), cursor.Current()...))
+	}
+	if err := cursor.Err(); err != nil {
+		return err
+	}
+	return mongodb.DecodeAll(raws, results)
+}
+
+// The suffixes of the collections derived from a session, from transform: the engine and battery data, the
+// manoeuvres, and the backups left by calibration and migration. Low res views are <collection>-lowres-<level>
+// with an optional "-snapshots" and are matched on LOW_RES_INFIX instead. Keep these in step with transform.
+var derivedSuffixes = []string{"-engine-rapid", "-engine-dynamic", "-battery", "-dc-status", "-manoeuvres", "-uncalibrated", "-legacy"}
+
+const LOW_RES_INFIX = "-lowres-"
+
+// Returns true if collection was derived from session, e.g. <session>-battery or <session>-lowres-5s. A
+// session called <session>-am is a session in its own right, not one of these.
+func IsDerived(session string, collection string) bool {
+
+	if !strings.HasPrefix(collection, session+"-") {
+		return false
+	}
+	rest := strings.TrimPrefix(collection, session)
+	if strings.HasPrefix(rest, LOW_RES_INFIX) {
+		return true
+	}
+	for _, suffix := range derivedSuffixes {
+		if rest == suffix || strings.HasPrefix(rest, suffix+LOW_RES_INFIX) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sessions are the collections written by the transform. Everything derived from a session (low res views,
+// engine data etc) is named <session>-<suffix>, so any collection that is another collection's name plus one
+// of those suffixes is left out, as are the catalog collections. The session catalog in transform/catalog.go
+// has much more detail about each session.
+func sessionsFromCollections(colls []string) []string {
+
+	sort.Strings(colls)
+	sessions := []string{}
+
+	for _, col := range colls {
+		if mongodb.IsCatalogCollection(col) {
+			continue
+		}
+		derived := false
+		for _, other := range colls {
+			if other != col && IsDerived(other, col) {
+				derived = true
+				break
+			}
+		}
+		if !derived {
+			sessions = append(sessions, col)
+		}
+	}
+	return sessions
+}
@@ -0,0 +1,20 @@
+package storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSessionsFromCollections(t *testing.T) {
+
+	colls := []string{
+		"race", "race-am", "race-pm", "race-battery", "race-engine-rapid", "race-engine-rapid-lowres-5s",
+		"race-lowres-5s", "race-lowres-5s-snapshots", "race-manoeuvres", "race-am-lowres-1m", "race-am-uncalibrated",
+		"delivery-dc-status",
+	}
+	want := []string{"delivery-dc-status", "race", "race-am", "race-pm"}
+
+	if got := sessionsFromCollections(colls); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -5,11 +5,17 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/m-h-w/nmea-logger/mongodb"
 	"github.com/m-h-w/nmea-logger/transform"
+	"github.com/m-h-w/nmea-logger/wind"
 )
 
 //This code is a test harness that drives the various modules that transform data and write/read from the DB
@@ -17,13 +23,33 @@ import (
 
 // structure containing any settings entered from the command line
 type commandLineSettings_t struct {
-	help        bool   // prints out usage info
-	transform   bool   // transforms the data from the b&g logger to a more db friendly format
-	dispFields  bool   // display the different data fields in the logger data
-	file        string // take input from a file: -file <filename>
-	sailNjord   bool   // convert B&G output file to Sailnjord format for core readings
-	collection  string // specify the collection to write to
-	lowResTable bool   // generate a low resolution table to help the UI scale.
+	help        bool                       // prints out usage info
+	transform   bool                       // transforms the data from the b&g logger to a more db friendly format
+	dispFields  bool                       // display the different data fields in the logger data
+	file        string                     // take input from a file: -file <filename>
+	sailNjord   bool                       // convert B&G output file to Sailnjord format for core readings
+	collection  string                     // specify the collection to write to
+	lowResTable bool                       // generate a low resolution table to help the UI scale.
+	levels      []time.Duration            // resolutions of the low resolution tables
+	tolerance   float64                    // metres the position track in the low resolution tables is simplified to
+	follow      string                     // directory of logger files to ingest as they are written
+	migrate     bool                       // rewrite a collection to the current field naming scheme
+	catalog     bool                       // rebuild the session catalog entry for -col, or every session if -col isnt given
+	mode        transform.ImportMode_t     // what -t, -l and -manoeuvres do if the collection exists: fail, overwrite, append or resume
+	addCal      string                     // json file holding a calibration profile to add for -boat
+	recalibrate bool                       // apply a calibration profile to the session in -col
+	calVersion  int                        // version of the calibration profile for -t and -recalibrate, 0 for the latest
+	estimateCal bool                       // estimate a calibration profile for -boat from the sessions in -col
+	polar       bool                       // build polars for -boat from the sessions in -col
+	percentiles []float64                  // of the boatspeed in each bin, a polar for each
+	polarFormat string                     // the format polars are written in, or all of them if empty
+	addPolar    string                     // Expedition or OpenCPN file holding a polar to add for -boat as -polarname
+	polarName   string                     // the polar -addpolar saves and -l compares the snapshots with
+	manoeuvres  bool                       // find and measure the manoeuvres in -col and store them
+	course      string                     // json or GPX file holding the course sailed in -col
+	gun         time.Time                  // start time to analyse the start of -col at
+	startLine   *transform.Line_t          // pinged ends of the start line, the course's start line if nil
+	details     transform.SessionDetails_t // boat, crew, helm, event and race recorded in the session catalog
 }
 
 func parseCommandLine() *commandLineSettings_t {
@@ -32,10 +58,39 @@ func parseCommandLine() *commandLineSettings_t {
 	helpPtr := flag.Bool("h", false, "Prints out usage info")
 	transformPtr := flag.Bool("t", false, "Transform the input file to a db friendly format")
 	dispFieldPtr := flag.Bool("f", false, "Display the different data fields contained in the input file")
-	fileNamePtr := flag.String("file", "", "Take input from a file -file <filename> ")
+	fileNamePtr := flag.String("file", "", "Take input from a file -file <filename>, or - for stdin ")
 	sailNjordPtr := flag.Bool("sn", false, "Transform fileinput to Sail Njord format")
 	colPtr := flag.String("col", "", "Collection (Table) to write to in the DB")
-	lowResPtr := flag.Bool("l", false, "generates a low resolution table, with default resolution 6 seconds")
+	followPtr := flag.String("follow", "", "Ingest the logger files in a directory into -col as they are written -follow <dir>")
+	lowResPtr := flag.Bool("l", false, "generates low resolution views and snapshots of all the measurements at each of the -levels")
+	levelsPtr := flag.String("levels", transform.DEFAULT_PYRAMID, "Comma separated resolutions of the tables built by -l")
+	tolerancePtr := flag.Float64("tolerance", transform.TRACK_TOLERANCE, "Metres the position track built by -l is simplified to, 0 keeps every position")
+	migratePtr := flag.Bool("migrate", false, "Rewrite the collection given by -col to the current field names")
+	catalogPtr := flag.Bool("catalog", false, "Rebuild the session catalog entry for -col, or for every session if -col is not given")
+	boatPtr := flag.String("boat", "", "Boat name to record in the session catalog")
+	crewPtr := flag.String("crew", "", "Comma separated crew names to record in the session catalog")
+	helmPtr := flag.String("helm", "", "Helm to record in the session catalog, so manoeuvres can be compared between helmsmen")
+	eventPtr := flag.String("event", "", "Event name to record in the session catalog")
+	racePtr := flag.String("race", "", "Race name to record in the session catalog")
+	addCalPtr := flag.String("addcal", "", "Add the calibration profile in a json file as the next version for its boat, or -boat")
+	recalibratePtr := flag.Bool("recalibrate", false, "Apply the boat's calibration profile to the session in -col again")
+	calVersionPtr := flag.Int("calversion", 0, "Version of the boat's calibration profile used by -t and -recalibrate, 0 for the latest")
+	estimateCalPtr := flag.Bool("estimatecal", false, "Estimate a calibration profile for -boat from the comma separated sessions in -col")
+	polarPtr := flag.Bool("polar", false, "Build polars for -boat from the comma separated sessions in -col")
+	percentilesPtr := flag.String("percentiles", "50,90", "Comma separated percentiles of boatspeed for -polar, a polar is built for each")
+	polarFormatPtr := flag.String("polarformat", "", "Format -polar writes: "+strings.Join(transform.PolarFormats, ", ")+". All of them if not given")
+	manoeuvresPtr := flag.Bool("manoeuvres", false, "Find and measure the tacks, gybes, bear-aways and round-ups in -col and store them in <col>-manoeuvres")
+	coursePtr := flag.String("course", "", "Add the course sailed in -col from a json or GPX file and split the session into legs")
+	gunPtr := flag.String("gun", "", "Analyse the start of -col at this RFC3339 time, on the line from -pin and -committee or the course's start line")
+	pinPtr := flag.String("pin", "", "lat,long of the pin end of the start line for -gun")
+	committeePtr := flag.String("committee", "", "lat,long of the committee boat end of the start line for -gun")
+	addPolarPtr := flag.String("addpolar", "", "Add the polar in an Expedition or OpenCPN file for -boat, named -polarname")
+	polarNamePtr := flag.String("polarname", "", "Name of the polar -addpolar saves, and that -l compares the snapshots with. -l uses the boat's latest polar if not given")
+	markPtr := flag.String("mark", "", "lat,long of the mark -l works out the VMC towards")
+	heelPtr := flag.Bool("heel", true, "Correct the apparent wind for heel when working out the true wind for -t and -sn")
+	leewayPtr := flag.Float64("leeway", wind.LEEWAY_COEFFICIENT, "Leeway coefficient for the true wind for -t and -sn, 0 for no leeway correction")
+	workersPtr := flag.Int("workers", runtime.NumCPU(), "Number of goroutines decoding the input file for -t")
+	modePtr := flag.String("mode", string(transform.MODE_FAIL), "What -t, -l and -manoeuvres do if the collection exists: fail, overwrite, append or resume")
 
 	flag.Parse()
 
@@ -48,10 +103,140 @@ func parseCommandLine() *commandLineSettings_t {
 	settings.sailNjord = *sailNjordPtr
 	settings.collection = *colPtr
 	settings.lowResTable = *lowResPtr
+	levels, err := transform.ParseLevels(*levelsPtr)
+	if err != nil {
+		fmt.Printf("%s\r\n", err)
+		os.Exit(1)
+	}
+	settings.levels = levels
+	settings.tolerance = *tolerancePtr
+	settings.follow = *followPtr
+	settings.migrate = *migratePtr
+	settings.catalog = *catalogPtr
+	settings.addCal = *addCalPtr
+	settings.recalibrate = *recalibratePtr
+	settings.calVersion = *calVersionPtr
+	settings.estimateCal = *estimateCalPtr
+	settings.polar = *polarPtr
+	settings.polarFormat = *polarFormatPtr
+	percentiles, err := transform.ParsePercentiles(*percentilesPtr)
+	if err != nil {
+		fmt.Printf("%s\r\n", err)
+		os.Exit(1)
+	}
+	settings.percentiles = percentiles
+	settings.manoeuvres = *manoeuvresPtr
+	settings.course = *coursePtr
+	settings.addPolar = *addPolarPtr
+	if *gunPtr != "" {
+		if settings.gun, err = time.Parse(time.RFC3339, *gunPtr); err != nil {
+			fmt.Printf("bad -gun time: %s\r\n", err)
+			os.Exit(1)
+		}
+	}
+	if *pinPtr != "" || *committeePtr != "" {
+		pin, err := transform.ParseMark(*pinPtr)
+		if err != nil {
+			fmt.Printf("%s\r\n", err)
+			os.Exit(1)
+		}
+		committee, err := transform.ParseMark(*committeePtr)
+		if err != nil {
+			fmt.Printf("%s\r\n", err)
+			os.Exit(1)
+		}
+		settings.startLine = &transform.Line_t{Pin: *pin, Boat: *committee}
+	}
+	settings.polarName = *polarNamePtr
+	transform.TargetPolar = *polarNamePtr
+	if *markPtr != "" {
+		if transform.PerformanceMark, err = transform.ParseMark(*markPtr); err != nil {
+			fmt.Printf("%s\r\n", err)
+			os.Exit(1)
+		}
+	}
+	transform.CalibrationVersion = *calVersionPtr
+
+	transform.Workers = *workersPtr
+	transform.WindCorrection = transform.WindCorrection_t{Heel: *heelPtr, Leeway: *leewayPtr}
+
+	mode, err := transform.ParseImportMode(*modePtr)
+	if err != nil {
+		fmt.Printf("%s\r\n", err)
+		os.Exit(1)
+	}
+	settings.mode = mode
+
+	settings.details.Boat = *boatPtr
+	settings.details.Helm = *helmPtr
+	settings.details.Event = *eventPtr
+	settings.details.Race = *racePtr
+	if *crewPtr != "" {
+		for _, c := range strings.Split(*crewPtr, ",") {
+			settings.details.Crew = append(settings.details.Crew, strings.TrimSpace(c))
+		}
+	}
 
 	return settings
 }
 
+// Estimates a calibration profile and writes it to <boat>-calibration.json with how confident each part of it
+// is. Once it has been looked over it can be added with -addcal.
+func estimateCalibration(sessions []string, boat string) {
+
+	est, err := transform.EstimateCalibration(sessions, boat)
+	if err != nil {
+		fmt.Printf("%s\r\n", err)
+		os.Exit(1)
+	}
+
+	file := boat + "-calibration.json"
+	data, err := json.MarshalIndent(est, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(file, data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("unable to write %s: %s\r\n", file, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("estimated calibration from %d steady windows written to %s\r\n", est.Windows, file)
+	for _, note := range est.Notes {
+		fmt.Printf("  %s\r\n", note)
+	}
+}
+
+// Builds polars and writes each one out as <boat>-p<percentile>-<format>.txt, in one format or all of them
+func buildPolars(sessions []string, boat string, percentiles []float64, format string) {
+
+	formats := transform.PolarFormats
+	if format != "" {
+		formats = []string{format}
+	}
+
+	polars, err := transform.BuildPolars(sessions, boat, percentiles)
+	if err != nil {
+		fmt.Printf("%s\r\n", err)
+		os.Exit(1)
+	}
+
+	for _, polar := range polars {
+		for _, f := range formats {
+			text, err := polar.Format(f)
+			if err != nil {
+				fmt.Printf("%s\r\n", err)
+				os.Exit(1)
+			}
+			file := fmt.Sprintf("%s-%s.txt", polar.Name, f)
+			if err := ioutil.WriteFile(file, []byte(text), 0644); err != nil {
+				fmt.Printf("unable to write %s: %s\r\n", file, err)
+				os.Exit(1)
+			}
+			fmt.Printf("written %s\r\n", file)
+		}
+	}
+}
+
 // looks at the json data from the logger and counts the number of unique descriptions. Descriptions are
 // the different sensor types that get logged from the B&G
 
@@ -185,20 +370,17 @@ func main() {
 
 		if settings.file != "" && settings.collection != "" {
 
-			//Check if collection already exists and stop if it does. for now it would need to be
-			//deleted manually using the Atlas UI.
-
-			colls := mongodb.ListCollections()
-
-			for _, col := range colls {
-				if col == settings.collection {
-					fmt.Printf("Collection %s exists already \r\n", settings.collection)
-					os.Exit(1)
+			// what happens if the collection already exists depends on -mode, see transform/import-mode.go
+			fmt.Printf("transforming file to MongDB format\r\nWriting to Collection:%s\r\n", settings.collection)
+			if settings.file == "-" { // straight from the analyzer, e.g. analyzer -nv | mongo-tools -t -file - -col <collection>
+				if err := transform.TransformStream(os.Stdin, "stdin", settings.collection, settings.details, settings.mode); err != nil {
+					fmt.Printf("%s\r\n", err)
+				}
+			} else {
+				if err := transform.TransformToMongoFormat(settings.file, settings.collection, settings.details, settings.mode); err != nil { // uses the function in the transform module
+					fmt.Printf("%s\r\n", err)
 				}
 			}
-
-			fmt.Printf("transforming file to MongDB format\r\nWriting to Collection:%s\r\n", settings.collection)
-			transform.TransformToMongoFormat(settings.file, settings.collection) // uses the function in the transform module
 			os.Exit(1)
 
 		} else {
@@ -207,19 +389,161 @@ func main() {
 			os.Exit(1)
 
 		}
+	} else if settings.follow != "" { // ingest the live logger output as it is written
+
+		if settings.collection != "" {
+
+			// stop cleanly on ctrl-c or a kill so that everything read has been written and checkpointed
+			stop := make(chan struct{})
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-signals
+				fmt.Printf("stopping\r\n")
+				close(stop)
+			}()
+
+			if err := transform.FollowLogger(settings.follow, settings.collection, settings.details, stop); err != nil {
+				fmt.Printf("%s\r\n", err)
+				os.Exit(1)
+			}
+
+		} else {
+			fmt.Printf("-follow must be used in conjuction with -col <collection name>\r\n")
+			os.Exit(1)
+		}
+
 	} else if settings.lowResTable {
 
-		/* build a low resolution data table default = 6 second position data. The thinking here is to drive the UI from a
+		/* build low resolution data tables, by default at 1s, 5s, 30s, 2m and 10m. The thinking here is to drive the UI from a
 		map view so that points of interest can be identified spatially and the times at which the happend then used to
 		pull back higher resolution data from the main collection.
 		*/
 
 		if settings.collection != "" {
-			transform.GenerateLowResView(6, settings.collection)
+			if err := transform.GenerateLowResView(settings.levels, settings.collection, settings.tolerance, settings.mode); err != nil {
+				fmt.Printf("%s\r\n", err)
+				os.Exit(1)
+			}
 		} else {
 			fmt.Printf("-l must be used in conjuction with -col <collection name>")
 		}
 
+	} else if settings.migrate { // bring an old collection up to the current schema, see transform/schema.go
+
+		if settings.collection != "" {
+			fmt.Printf("migrating collection %s to the current field names\r\n", settings.collection)
+			transform.MigrateCollection(settings.collection)
+		} else {
+			fmt.Printf("-migrate must be used in conjuction with -col <collection name>\r\n")
+			os.Exit(1)
+		}
+
+	} else if settings.addCal != "" { // add a calibration profile, see transform/calibration.go
+
+		cal, err := transform.AddCalibrationFile(settings.addCal, settings.details.Boat)
+		if err != nil {
+			fmt.Printf("%s\r\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("added calibration %s\r\n", cal.Id)
+
+	} else if settings.estimateCal { // work out a calibration profile from sailing data, for review
+
+		if settings.collection != "" && settings.details.Boat != "" {
+			estimateCalibration(strings.Split(settings.collection, ","), settings.details.Boat)
+		} else {
+			fmt.Printf("-estimatecal must be used in conjuction with -col <sessions> and -boat <boat>\r\n")
+			os.Exit(1)
+		}
+
+	} else if settings.manoeuvres { // tacks, gybes etc and how well they were sailed, see transform/manoeuvres.go
+
+		if settings.collection != "" {
+			if err := transform.BuildManoeuvres(settings.collection, settings.mode); err != nil {
+				fmt.Printf("%s\r\n", err)
+				os.Exit(1)
+			}
+		} else {
+			fmt.Printf("-manoeuvres must be used in conjuction with -col <session>\r\n")
+			os.Exit(1)
+		}
+
+	} else if settings.course != "" { // race legs, see transform/course.go
+
+		if settings.collection != "" {
+			course, err := transform.AddCourseFile(settings.course, settings.collection)
+			if err != nil {
+				fmt.Printf("%s\r\n", err)
+				os.Exit(1)
+			}
+			for _, leg := range course.Legs {
+				fmt.Printf("leg %d %s to %s: %s to %s, %.0fm sailed, vmc %.2f kts, current %.1f kts to %.0f\r\n", leg.Number, leg.From, leg.To,
+					leg.Start.Format("15:04:05"), leg.End.Format("15:04:05"), leg.Distance, leg.Vmc*transform.MS2KNOTS, leg.Drift*transform.MS2KNOTS, leg.Set)
+			}
+			fmt.Printf("%d legs sailed\r\n", len(course.Legs))
+		} else {
+			fmt.Printf("-course must be used in conjuction with -col <session>\r\n")
+			os.Exit(1)
+		}
+
+	} else if !settings.gun.IsZero() { // start line analysis, see transform/start.go
+
+		if settings.collection != "" {
+			start, err := transform.AddStart(settings.collection, settings.startLine, settings.gun)
+			if err != nil {
+				fmt.Printf("%s\r\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("%.0fm line, %.0f degrees of bias, %s end favoured by %.0fm\r\n", start.Length, start.Bias, start.Favoured, start.BiasDistance)
+			fmt.Printf("at the gun: %.0fm from the line at %.1f kts, over: %t\r\n", start.DistanceAtGun, start.SpeedAtGun*transform.MS2KNOTS, start.Over)
+			if start.Late != nil {
+				fmt.Printf("crossed the line %.0f seconds after the gun\r\n", *start.Late)
+			}
+		} else {
+			fmt.Printf("-gun must be used in conjuction with -col <session>\r\n")
+			os.Exit(1)
+		}
+
+	} else if settings.addPolar != "" { // add a polar from elsewhere, see transform/polars.go
+
+		if settings.details.Boat != "" && settings.polarName != "" {
+			polar, err := transform.AddPolarFile(settings.addPolar, settings.details.Boat, settings.polarName)
+			if err != nil {
+				fmt.Printf("%s\r\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("added polar %s: %d wind speeds and %d angles\r\n", polar.Name, len(polar.Tws), len(polar.Twa))
+		} else {
+			fmt.Printf("-addpolar must be used in conjuction with -boat <boat> and -polarname <name>\r\n")
+			os.Exit(1)
+		}
+
+	} else if settings.polar { // polars from sailing data, see transform/polars.go
+
+		if settings.collection != "" && settings.details.Boat != "" {
+			buildPolars(strings.Split(settings.collection, ","), settings.details.Boat, settings.percentiles, settings.polarFormat)
+		} else {
+			fmt.Printf("-polar must be used in conjuction with -col <sessions> and -boat <boat>\r\n")
+			os.Exit(1)
+		}
+
+	} else if settings.recalibrate { // calibrate a session that has already been imported
+
+		if settings.collection != "" {
+			if err := transform.RecalibrateSession(settings.collection, settings.details.Boat, settings.calVersion); err != nil {
+				fmt.Printf("%s\r\n", err)
+				os.Exit(1)
+			}
+		} else {
+			fmt.Printf("-recalibrate must be used in conjuction with -col <collection name>\r\n")
+			os.Exit(1)
+		}
+
+	} else if settings.catalog { // (re)build session catalog entries from the data already in the store
+
+		transform.CatalogSession(settings.collection, settings.details)
+
 	} else if settings.sailNjord { // Create a Sail Njord compatible file
 
 		if settings.file != "" {
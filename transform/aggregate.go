@@ -0,0 +1,265 @@
+package transform
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Aggregating readings into buckets for the low res tables
+---------------------------------------------------------
+Each reading field in a bucket is stored as its mean, with its min, max, standard deviation and number of
+readings in a "stats" sub document:
+
+	{ts: <bucket start>, metadata: {source, resolution}, windangle: 41.2, windspeed: 6.3,
+	 stats: {windangle: {min: 35.1, max: 48.0, stddev: 3.2, n: 60}, windspeed: {...}}}
+
+so the low res tables can be queried and drawn the same way as the full resolution data, and a chart can
+show the spread as well as the average.
+
+Angles that wrap round (see CircularFields) use circular statistics: the mean of 350 and 10 is 0, not 180.
+Their min and max are the readings furthest anticlockwise and clockwise of the mean, so min is greater than
+max when the readings straddle north, and their stddev is the circular standard deviation in degrees.
+
+A direction and speed read together (see VectorFields), like the set and drift of the current, are averaged
+as a vector: the mean set is the direction of the mean north and east components and the mean drift their
+length, so a current that turns while it slackens averages out weaker rather than at its mean strength. Their
+min, max and stddev are worked out as for any other angle and speed, with min and max either side of the mean.
+*/
+
+const FIELD_STATS = "stats"
+
+type Stats_t struct {
+	Mean   float64 `bson:"-" json:"-"` // stored in the reading field itself
+	Min    float64 `bson:"min" json:"min"`
+	Max    float64 `bson:"max" json:"max"`
+	StdDev float64 `bson:"stddev" json:"stdDev"`
+	N      int     `bson:"n" json:"n"`
+}
+
+// the readings for one bucket of a low res table
+type bucket_t struct {
+	start     time.Time
+	source    string
+	reference string   // of the directions in true wind buckets, see truewind.go. Empty for everything else
+	channels  []string // in the order they were first seen
+	values    map[string][]float64
+}
+
+func newBucket(start time.Time, source string) *bucket_t {
+	return &bucket_t{start: start, source: source, values: map[string][]float64{}}
+}
+
+func (b *bucket_t) add(channel string, v float64) {
+
+	if _, ok := b.values[channel]; !ok {
+		b.channels = append(b.channels, channel)
+	}
+	b.values[channel] = append(b.values[channel], v)
+}
+
+// adds every reading field in doc, i.e. every top level number
+func (b *bucket_t) addDocument(doc bson.Raw) {
+
+	elements, err := doc.Elements()
+	if err != nil {
+		return
+	}
+	for _, e := range elements {
+		if v, ok := e.Value().DoubleOK(); ok {
+			b.add(e.Key(), v)
+		}
+	}
+}
+
+// the bucket as a document for a low res table, with the channels in order, or nil if it is empty
+func (b *bucket_t) document(id string, resolution int64, order []string) bson.D {
+
+	if len(b.channels) == 0 {
+		return nil
+	}
+
+	channels := b.channels
+	if order != nil {
+		channels = nil
+		for _, ch := range order {
+			if _, ok := b.values[ch]; ok {
+				channels = append(channels, ch)
+			}
+		}
+	}
+
+	metadata := bson.D{{Key: FIELD_SOURCE, Value: b.source}, {Key: "resolution", Value: resolution}}
+	if b.reference != "" {
+		metadata = append(metadata, bson.E{Key: "reference", Value: b.reference})
+	}
+	doc := bson.D{
+		{Key: "_id", Value: id},
+		{Key: FIELD_TS, Value: b.start},
+		{Key: FIELD_METADATA, Value: metadata},
+	}
+	vectors := b.vectorStats()
+	stats := bson.D{}
+	for _, ch := range channels {
+		st, ok := vectors[ch]
+		if !ok {
+			st = Aggregate(ch, b.values[ch])
+		}
+		doc = append(doc, bson.E{Key: ch, Value: st.Mean})
+		stats = append(stats, bson.E{Key: ch, Value: st})
+	}
+	return append(doc, bson.E{Key: FIELD_STATS, Value: stats})
+}
+
+// the statistics for the directions and speeds in the bucket that are averaged as vectors, by channel. A pair
+// is only aggregated together if every reading of one has a reading of the other.
+func (b *bucket_t) vectorStats() map[string]Stats_t {
+
+	stats := map[string]Stats_t{}
+	for direction, speed := range VectorFields {
+		directions, speeds := b.values[direction], b.values[speed]
+		if len(directions) == 0 || len(directions) != len(speeds) {
+			continue
+		}
+
+		var north, east float64
+		for i, d := range directions {
+			north += speeds[i] * math.Cos(d*math.Pi/180)
+			east += speeds[i] * math.Sin(d*math.Pi/180)
+		}
+		n := float64(len(directions))
+		north, east = north/n, east/n
+
+		dir := circularStats(directions)
+		dir.Mean = normaliseDegrees(math.Atan2(east, north) * 180 / math.Pi)
+		dir.Min, dir.Max = circularRange(directions, dir.Mean)
+		spd := linearStats(speeds)
+		spd.Mean = math.Hypot(north, east)
+
+		stats[direction], stats[speed] = dir, spd
+	}
+	return stats
+}
+
+// the statistics for readings of field, circular ones for angles that wrap round
+func Aggregate(field string, values []float64) Stats_t {
+
+	if CircularFields[field] {
+		return circularStats(values)
+	}
+	return linearStats(values)
+}
+
+func linearStats(values []float64) Stats_t {
+
+	st := Stats_t{N: len(values)}
+	if st.N == 0 {
+		return st
+	}
+
+	st.Min, st.Max = values[0], values[0]
+	var sum float64
+	for _, v := range values {
+		sum += v
+		st.Min = math.Min(st.Min, v)
+		st.Max = math.Max(st.Max, v)
+	}
+	st.Mean = sum / float64(st.N)
+
+	var sumSq float64
+	for _, v := range values {
+		sumSq += (v - st.Mean) * (v - st.Mean)
+	}
+	st.StdDev = math.Sqrt(sumSq / float64(st.N))
+	return st
+}
+
+// values in degrees
+func circularStats(values []float64) Stats_t {
+
+	st := Stats_t{N: len(values)}
+	if st.N == 0 {
+		return st
+	}
+
+	var sumSin, sumCos float64
+	for _, v := range values {
+		sumSin += math.Sin(v * math.Pi / 180)
+		sumCos += math.Cos(v * math.Pi / 180)
+	}
+	st.Mean = normaliseDegrees(math.Atan2(sumSin, sumCos) * 180 / math.Pi)
+
+	// mean resultant length, 1 when the readings all agree and 0 when they are spread evenly round the circle
+	r := math.Hypot(sumSin, sumCos) / float64(st.N)
+	if r < 1e-12 {
+		st.StdDev = 180 // no meaningful direction
+	} else {
+		st.StdDev = math.Sqrt(-2*math.Log(math.Min(r, 1))) * 180 / math.Pi
+	}
+
+	st.Min, st.Max = circularRange(values, st.Mean)
+	return st
+}
+
+// the readings furthest anticlockwise and clockwise of mean
+func circularRange(values []float64, mean float64) (float64, float64) {
+
+	var minDev, maxDev float64
+	for _, v := range values {
+		d := angleDifference(v, mean)
+		minDev = math.Min(minDev, d)
+		maxDev = math.Max(maxDev, d)
+	}
+	return normaliseDegrees(mean + minDev), normaliseDegrees(mean + maxDev)
+}
+
+// returns a in the range [0, 360)
+func normaliseDegrees(a float64) float64 {
+
+	a = math.Mod(a, 360)
+	if a < 0 {
+		a += 360
+	}
+	if a >= 360 { // a tiny negative angle rounds to 360 when added to it
+		a = 0
+	}
+	return a
+}
+
+// returns a - b in the range (-180, 180]
+func angleDifference(a float64, b float64) float64 {
+
+	d := normaliseDegrees(a - b)
+	if d > 180 {
+		d -= 360
+	}
+	return d
+}
+
+// a bucket key for a measurement from one source. True wind referenced to true and to magnetic north come from
+// the same source, so are kept apart by their reference.
+type bucketKey_t struct {
+	field     string
+	source    string
+	reference string
+}
+
+// the buckets being filled while building a low res view, one per measurement and source
+type buckets_t map[bucketKey_t]*bucket_t
+
+// returns the keys in a fixed order so the tables are written the same way every time
+func (bs buckets_t) keys() []bucketKey_t {
+
+	keys := make([]bucketKey_t, 0, len(bs))
+	for k := range bs {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return fmt.Sprint(keys[i]) < fmt.Sprint(keys[j])
+	})
+	return keys
+}
@@ -0,0 +1,102 @@
+package transform
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+const TEST_TOLERANCE = 1e-6
+
+// true if a and b are within tolerance of each other
+func approx(a float64, b float64, tolerance float64) bool {
+	return math.Abs(a-b) <= tolerance
+}
+
+func TestCircularStats(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		values []float64
+		mean   float64
+		min    float64
+		max    float64
+	}{
+		{"either side of north", []float64{350, 10}, 0, 350, 10},
+		{"either side of south", []float64{170, 190}, 180, 170, 190},
+		{"all the same", []float64{42, 42, 42}, 42, 42, 42},
+		{"one reading", []float64{275}, 275, 275, 275},
+		{"lopsided", []float64{355, 5, 15}, 5, 355, 15},
+	}
+
+	for _, tt := range tests {
+		st := circularStats(tt.values)
+		if st.N != len(tt.values) || !approx(angleDifference(st.Mean, tt.mean), 0, TEST_TOLERANCE) ||
+			!approx(angleDifference(st.Min, tt.min), 0, TEST_TOLERANCE) || !approx(angleDifference(st.Max, tt.max), 0, TEST_TOLERANCE) {
+			t.Errorf("%s: got %+v mean %f, want mean %f min %f max %f", tt.name, st, st.Mean, tt.mean, tt.min, tt.max)
+		}
+	}
+
+	// the spread in degrees, 0 when the readings agree and 180 when they cancel out
+	if st := circularStats([]float64{42, 42}); !approx(st.StdDev, 0, TEST_TOLERANCE) {
+		t.Errorf("same readings: got stddev %f, want 0", st.StdDev)
+	}
+	if st := circularStats([]float64{0, 180}); st.StdDev != 180 {
+		t.Errorf("opposite readings: got stddev %f, want 180", st.StdDev)
+	}
+	narrow, wide := circularStats([]float64{355, 5}), circularStats([]float64{340, 20})
+	if !(narrow.StdDev > 0 && narrow.StdDev < wide.StdDev) {
+		t.Errorf("got stddev %f for 355, 5 and %f for 340, 20", narrow.StdDev, wide.StdDev)
+	}
+	if st := circularStats(nil); st.N != 0 {
+		t.Errorf("no readings: got %+v", st)
+	}
+}
+
+func TestAggregate(t *testing.T) {
+
+	// headings average round the circle, boatspeed doesnt
+	if st := Aggregate(FIELD_MAG_HEADING, []float64{350, 10}); !approx(angleDifference(st.Mean, 0), 0, TEST_TOLERANCE) {
+		t.Errorf("heading: got mean %f, want 0", st.Mean)
+	}
+	st := Aggregate(FIELD_BOATSPEED, []float64{2, 4, 6})
+	if !approx(st.Mean, 4, TEST_TOLERANCE) || st.Min != 2 || st.Max != 6 || !approx(st.StdDev, math.Sqrt(8.0/3), TEST_TOLERANCE) || st.N != 3 {
+		t.Errorf("boatspeed: got %+v mean %f", st, st.Mean)
+	}
+}
+
+func TestVectorStats(t *testing.T) {
+
+	// a current turning through 180 degrees as it slackens: averaged on their own the set would be 90 and the
+	// drift 1, as a vector the two ends mostly cancel out
+	b := newBucket(time.Time{}, "calculated")
+	for _, c := range [][2]float64{{0, 1}, {90, 0.2}, {180, 1.2}} {
+		b.add(FIELD_SET, c[0])
+		b.add(FIELD_DRIFT, c[1])
+	}
+	stats := b.vectorStats()
+	set, drift := stats[FIELD_SET], stats[FIELD_DRIFT]
+	if !approx(set.Mean, 180-math.Atan2(0.2, 0.2)*180/math.Pi, TEST_TOLERANCE) || !approx(drift.Mean, math.Hypot(0.2, 0.2)/3, TEST_TOLERANCE) {
+		t.Errorf("got set %f drift %f", set.Mean, drift.Mean)
+	}
+	if set.N != 3 || drift.N != 3 || drift.Min != 0.2 || drift.Max != 1.2 {
+		t.Errorf("got set %+v drift %+v", set, drift)
+	}
+	if !approx(angleDifference(set.Min, 0), 0, TEST_TOLERANCE) || !approx(angleDifference(set.Max, 180), 0, TEST_TOLERANCE) {
+		t.Errorf("got set min %f max %f, want 0 and 180", set.Min, set.Max)
+	}
+
+	// and in the document
+	doc := b.document("id", 60, nil)
+	for _, e := range doc {
+		if e.Key == FIELD_DRIFT && !approx(e.Value.(float64), drift.Mean, TEST_TOLERANCE) {
+			t.Errorf("document has drift %v, want %f", e.Value, drift.Mean)
+		}
+	}
+
+	// a set without a drift for every reading is aggregated on its own
+	b.add(FIELD_SET, 90)
+	if _, ok := b.vectorStats()[FIELD_SET]; ok {
+		t.Errorf("got vector stats for unpaired readings")
+	}
+}
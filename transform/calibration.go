@@ -0,0 +1,601 @@
+package transform
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+	"github.com/m-h-w/nmea-logger/wind"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Instrument calibration
+----------------------
+No instrument reads true out of the box. A calibration profile holds the corrections for one boat:
+
+	- boatspeed: a factor by boatspeed, one table per angle of heel as the paddle wheel reads differently
+	  on each tack and when heeled. Interpolated between the heel angles given.
+	- upwash: degrees added to the apparent wind angle (away from the bow on either side) by true wind speed,
+	  because the sails bend the wind round the masthead unit
+	- AWS: a factor by apparent wind speed
+	- deviation: degrees added to the compass heading, by heading
+	- masthead offset: degrees added to the apparent wind angle for a masthead unit that isnt lined up
+
+Tables are in knots, as that is what sailors think in. Every profile is versioned: saving a profile for a boat
+adds a new version rather than changing the old one, so what a session was calibrated with can always be
+found again. Profiles are kept in the catalog under "<boat>-v<version>".
+
+Calibration is applied during the transform (see ingest.go) to the latest profile for the session's boat, or
+CalibrationVersion if it is set. The reading fields hold the calibrated values, so everything downstream
+(true wind, low res views, the API) uses them, and the raw readings are kept in the metadata alongside the
+corrections that were made:
+
+	{ts, metadata: {source: "log", calibration: "Jubilee-v2", rawboatspeed: 3.1, correctedboatspeed: 3.25}, boatspeed: 3.25}
+
+RecalibrateSession applies a different profile to a session that has already been imported, working from the
+raw readings.
+*/
+
+const CALIBRATION_CATALOG = storage.CATALOG_PREFIX + "calibrations"
+
+// added to a session's name for the copy kept while it is being recalibrated
+const UNCALIBRATED_SUFFIX = "-uncalibrated"
+
+// the version of a boat's calibration profile applied during the transform, 0 for the latest. Set from the
+// command line, see tools/mongo-tools.go
+var CalibrationVersion = 0
+
+// A calibration table: Y at each X, interpolated in between and held at the first and last Y beyond the ends.
+type Table_t []TablePoint_t
+
+type TablePoint_t struct {
+	X float64 `bson:"x" json:"x"`
+	Y float64 `bson:"y" json:"y"`
+}
+
+// the boatspeed factor by boatspeed for one angle of heel. Heel is positive to starboard, as the attitude
+// sensor reads it, so each tack can be calibrated separately.
+type BoatSpeedTable_t struct {
+	Heel    float64 `bson:"heel" json:"heel"`
+	Factors Table_t `bson:"factors" json:"factors"`
+}
+
+type Calibration_t struct {
+	Id             string             `bson:"_id" json:"id"` // <boat>-v<version>
+	Boat           string             `bson:"boat" json:"boat"`
+	Version        int                `bson:"version" json:"version"`
+	Created        time.Time          `bson:"created" json:"created"`
+	Notes          string             `bson:"notes,omitempty" json:"notes,omitempty"`
+	BoatSpeed      []BoatSpeedTable_t `bson:"boatspeed,omitempty" json:"boatSpeed,omitempty"`
+	Upwash         Table_t            `bson:"upwash,omitempty" json:"upwash,omitempty"`       // degrees by TWS
+	AwsFactor      Table_t            `bson:"awsfactor,omitempty" json:"awsFactor,omitempty"` // by AWS
+	Deviation      Table_t            `bson:"deviation,omitempty" json:"deviation,omitempty"` // degrees by heading
+	MastheadOffset float64            `bson:"mastheadoffset" json:"mastheadOffset"`           // degrees
+}
+
+func calibrationId(boat string, version int) string {
+	return fmt.Sprintf("%s-v%d", boat, version)
+}
+
+// Saves a calibration profile as the next version for its boat and returns it as saved.
+func SaveCalibration(store storage.Store, cal Calibration_t) (Calibration_t, error) {
+
+	if cal.Boat == "" {
+		return cal, fmt.Errorf("a calibration profile needs a boat")
+	}
+	cal.sortTables()
+
+	latest, err := LoadCalibration(store, cal.Boat, 0)
+	switch err {
+	case nil:
+		cal.Version = latest.Version + 1
+	case storage.ErrNotFound:
+		cal.Version = 1
+	default:
+		return cal, err
+	}
+	cal.Id = calibrationId(cal.Boat, cal.Version)
+	cal.Created = time.Now().UTC()
+
+	return cal, store.Put(CALIBRATION_CATALOG, cal.Id, cal)
+}
+
+// Reads a version of a boat's calibration profile, or its latest if version is 0. Returns storage.ErrNotFound
+// if there isnt one.
+func LoadCalibration(store storage.Store, boat string, version int) (Calibration_t, error) {
+
+	var cal Calibration_t
+	if version != 0 {
+		err := store.Get(CALIBRATION_CATALOG, calibrationId(boat, version), &cal)
+		return cal, err
+	}
+
+	var all []Calibration_t
+	if err := store.GetAll(CALIBRATION_CATALOG, &all); err != nil {
+		return cal, err
+	}
+	found := false
+	for _, c := range all {
+		if c.Boat == boat && c.Version > cal.Version {
+			cal, found = c, true
+		}
+	}
+	if !found {
+		return cal, storage.ErrNotFound
+	}
+	return cal, nil
+}
+
+// Reads a calibration profile from a json file and saves it as the next version for its boat. The file can
+// also be an estimate written by EstimateCalibration, see estimate-calibration.go. boat overrides the one in
+// the file if it is given.
+func AddCalibrationFile(file string, boat string) (Calibration_t, error) {
+
+	var cal Calibration_t
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return cal, err
+	}
+	var est struct {
+		Profile *Calibration_t `json:"profile"`
+	}
+	if err := json.Unmarshal(data, &est); err != nil {
+		return cal, fmt.Errorf("reading %s: %s", file, err)
+	}
+	if est.Profile != nil {
+		cal = *est.Profile
+	} else if err := json.Unmarshal(data, &cal); err != nil {
+		return cal, fmt.Errorf("reading %s: %s", file, err)
+	}
+	if boat != "" {
+		cal.Boat = boat
+	}
+
+	store := storage.Open()
+	defer store.Close()
+	return SaveCalibration(store, cal)
+}
+
+// the profile to apply to a session sailed on boat, or nil if the boat hasnt got one
+func sessionCalibration(store storage.Store, boat string) *Calibration_t {
+
+	if boat == "" {
+		return nil
+	}
+	cal, err := LoadCalibration(store, boat, CalibrationVersion)
+	if err != nil {
+		if err != storage.ErrNotFound {
+			log.Printf("unable to read the calibration for %s: %s\n", boat, err)
+		} else if CalibrationVersion != 0 {
+			log.Printf("%s has no calibration version %d\n", boat, CalibrationVersion)
+		}
+		return nil
+	}
+	fmt.Printf("calibrating with %s\r\n", cal.Id)
+	return &cal
+}
+
+func (cal *Calibration_t) sortTables() {
+
+	for _, t := range append([]Table_t{cal.Upwash, cal.AwsFactor, cal.Deviation}, boatSpeedFactors(cal.BoatSpeed)...) {
+		sort.Slice(t, func(i, j int) bool { return t[i].X < t[j].X })
+	}
+	sort.Slice(cal.BoatSpeed, func(i, j int) bool { return cal.BoatSpeed[i].Heel < cal.BoatSpeed[j].Heel })
+}
+
+func boatSpeedFactors(tables []BoatSpeedTable_t) []Table_t {
+
+	var factors []Table_t
+	for _, t := range tables {
+		factors = append(factors, t.Factors)
+	}
+	return factors
+}
+
+// Y at x, or empty if the table is empty
+func (t Table_t) Lookup(x float64, empty float64) float64 {
+
+	switch {
+	case len(t) == 0:
+		return empty
+	case x <= t[0].X:
+		return t[0].Y
+	case x >= t[len(t)-1].X:
+		return t[len(t)-1].Y
+	}
+	i := sort.Search(len(t), func(i int) bool { return t[i].X >= x })
+	return interpolate(x, t[i-1], t[i])
+}
+
+// Y at angle x for a table of angles, which wraps round from the last point to the first through 360
+func (t Table_t) LookupAngle(x float64) float64 {
+
+	if len(t) == 0 {
+		return 0
+	}
+	x = normaliseDegrees(x)
+	if len(t) == 1 {
+		return t[0].Y
+	}
+	i := sort.Search(len(t), func(i int) bool { return t[i].X >= x })
+	if i == 0 || i == len(t) {
+		// between the last point and the first, going through 360
+		last, first := t[len(t)-1], t[0]
+		first.X += 360
+		if x < last.X {
+			x += 360
+		}
+		return interpolate(x, last, first)
+	}
+	return interpolate(x, t[i-1], t[i])
+}
+
+func interpolate(x float64, a TablePoint_t, b TablePoint_t) float64 {
+
+	if b.X == a.X {
+		return a.Y
+	}
+	return a.Y + (b.Y-a.Y)*(x-a.X)/(b.X-a.X)
+}
+
+// Applying a profile to readings. Speeds are in m/s and angles in degrees, as they are stored.
+
+func (cal *Calibration_t) boatSpeed(stw float64, heel float64) float64 {
+
+	tables := cal.BoatSpeed
+	if len(tables) == 0 {
+		return stw
+	}
+	knots := stw * MS2KNOTS
+
+	// interpolate between the factors for the heel angles either side
+	i := sort.Search(len(tables), func(i int) bool { return tables[i].Heel >= heel })
+	var factor float64
+	switch {
+	case i == 0:
+		factor = tables[0].Factors.Lookup(knots, 1)
+	case i == len(tables):
+		factor = tables[len(tables)-1].Factors.Lookup(knots, 1)
+	default:
+		a, b := tables[i-1], tables[i]
+		factor = interpolate(heel, TablePoint_t{a.Heel, a.Factors.Lookup(knots, 1)}, TablePoint_t{b.Heel, b.Factors.Lookup(knots, 1)})
+	}
+	return stw * factor
+}
+
+func (cal *Calibration_t) heading(h float64) float64 {
+	return normaliseDegrees(h + cal.Deviation.LookupAngle(h))
+}
+
+// Calibrates the apparent wind. The upwash depends on the true wind speed so that is worked out first from
+// the apparent wind with the other corrections made, and the boat's (calibrated) speed and heel.
+func (cal *Calibration_t) apparentWind(awa float64, aws float64, stw float64, heel float64) (float64, float64) {
+
+	awa = normaliseDegrees(awa + cal.MastheadOffset)
+	aws *= cal.AwsFactor.Lookup(aws*MS2KNOTS, 1)
+
+	if len(cal.Upwash) != 0 {
+		tws := wind.TrueWind(wind.Apparent_t{Awa: awa, Aws: aws, Stw: stw, Heel: heel}).Tws
+		upwash := cal.Upwash.Lookup(tws*MS2KNOTS, 0)
+		if awa < 180 { // away from the bow on whichever side the wind is
+			awa += upwash
+		} else {
+			awa -= upwash
+		}
+	}
+	return normaliseDegrees(awa), aws
+}
+
+// Calibrates the readings in a logger document in place, before it is transformed. The raw readings are kept
+// in input["raw"] by their logger field names for the transform functions to put in the metadata.
+func (cal *Calibration_t) calibrateInput(input map[string]interface{}, ins *instruments_t) {
+
+	fields, ok := input["fields"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	raw := map[string]float64{}
+
+	heel := 0.0
+	if ts, ok := input["timestamp"].(string); ok {
+		if t, err := time.Parse(time.RFC3339, convertToDateFormat(ts)); err == nil {
+			heel = ins.heelAt(t)
+		}
+	}
+
+	switch input["description"] {
+	case "Speed":
+		if stw, ok := fields["Speed Water Referenced"].(float64); ok {
+			raw["Speed Water Referenced"] = stw
+			fields["Speed Water Referenced"] = cal.boatSpeed(stw, heel)
+		}
+
+	case "Vessel Heading":
+		if h, ok := fields["Heading"].(float64); ok {
+			raw["Heading"] = h
+			fields["Heading"] = cal.heading(h)
+		}
+
+	case "Wind Data":
+		// only the apparent wind is calibrated, true wind from the instruments goes through as it is
+		reference, _ := fields["Reference"].(map[string]interface{})
+		awa, ok := fields["Wind Angle"].(float64)
+		aws, ok2 := fields["Wind Speed"].(float64)
+		if ok && ok2 && reference != nil && reference["name"] == "Apparent" {
+			raw["Wind Angle"], raw["Wind Speed"] = awa, aws
+			fields["Wind Angle"], fields["Wind Speed"] = cal.apparentWind(awa, aws, ins.boatspeed.value, heel)
+		}
+	}
+
+	if len(raw) != 0 {
+		input["raw"] = raw
+		input["calibration"] = cal.Id
+	}
+}
+
+// the heel at t for the calibration tables. An old heel reading is no better than none, so the boat is taken
+// to be upright unless there is a recent one, as for the true wind.
+func (ins *instruments_t) heelAt(t time.Time) float64 {
+
+	if !ins.heel.fresh(t) {
+		return 0
+	}
+	return ins.heel.value
+}
+
+// the raw reading for a logger field if the document has been calibrated
+func rawReading(input map[string]interface{}, field string) (float64, bool) {
+
+	raw, ok := input["raw"].(map[string]float64)
+	if !ok {
+		return 0, false
+	}
+	v, ok := raw[field]
+	return v, ok
+}
+
+func calibrationOf(input map[string]interface{}) string {
+
+	id, _ := input["calibration"].(string)
+	return id
+}
+
+// Recalibrating sessions that have already been imported
+
+// Applies a version of a calibration profile (0 for the latest) to a session that has already been imported.
+// The boat is taken from the session catalog if it isnt given. Like MigrateCollection the session is copied
+// aside and written back, with the readings calibrated again from their raw values and the true wind worked
+// out again. The low res views need building again afterwards.
+func RecalibrateSession(collection string, boat string, version int) error {
+
+	store := storage.Open()
+	defer store.Close()
+
+	session, err := LoadSession(store, collection)
+	if err != nil {
+		return err
+	}
+	if boat == "" {
+		boat = session.Boat
+	}
+	if boat == "" {
+		return fmt.Errorf("%s has no boat in the catalog, give one with -boat", collection)
+	}
+	cal, err := LoadCalibration(store, boat, version)
+	if err != nil {
+		return fmt.Errorf("no calibration for %s: %s", boat, err)
+	}
+
+	// keep the session as it is until it has been written back
+	backup := collection + UNCALIBRATED_SUFFIX
+	copied := copyCollection(store, collection, backup, false)
+	store.Flush()
+	if count, err := store.Count(backup); err != nil || count != copied {
+		return fmt.Errorf("copy of %s to %s is incomplete, stopping before anything is dropped", collection, backup)
+	}
+
+	if err := store.Drop(collection); err != nil {
+		return err
+	}
+	written := recalibrateCollection(store, backup, collection, &cal)
+	store.Flush()
+
+	if count, err := store.Count(collection); err != nil || count != written {
+		fmt.Printf("Document counts differ after recalibration, %s has been kept\n", backup)
+		return nil
+	}
+	if err := store.Drop(backup); err != nil {
+		return err
+	}
+
+	session.Calibration = cal.Id
+	if err := SaveSession(store, session); err != nil {
+		log.Printf("unable to update session %s in the catalog: %s\n", collection, err)
+	}
+	fmt.Printf("Recalibrated %s with %s, %d documents. Build the low res views again with -l -mode overwrite\n", collection, cal.Id, written)
+	return nil
+}
+
+// copies a session from one collection to another calibrating it with cal. Returns the number of documents
+// written.
+func recalibrateCollection(store storage.Store, from string, to string, cal *Calibration_t) int64 {
+
+	cursor, err := store.Range(from, "", time.Time{}, time.Time{})
+	check(err)
+	defer cursor.Close()
+	w := store.Writer(to)
+
+	var written int64
+	write := func(doc interface{}) {
+		bsonDoc, err := bson.Marshal(doc)
+		check(err)
+		w.Write(bsonDoc)
+		written++
+	}
+
+	var ins instruments_t
+	var current currentEstimator_t
+	handle := func(doc bson.Raw, ts time.Time) {
+
+		switch readingField(doc, []string{FIELD_BOATSPEED, FIELD_MAG_HEADING, FIELD_WIND_ANGLE, FIELD_TWS, FIELD_DRIFT, FIELD_ROLL, FIELD_COG, FIELD_SOG}) {
+
+		case FIELD_BOATSPEED:
+			var bs boatSpeed_t
+			check(bson.Unmarshal(doc, &bs))
+			stw := bs.IndicatedBoatSpeed
+			if bs.Metadata.RawBoatSpeed != nil {
+				stw = *bs.Metadata.RawBoatSpeed
+			}
+			bs.calibrate(stw, cal.boatSpeed(stw, ins.heelAt(ts)), cal.Id)
+			ins.boatspeed = reading_t{bs.IndicatedBoatSpeed, ts}
+			write(bs)
+
+		case FIELD_MAG_HEADING:
+			var h heading_t
+			check(bson.Unmarshal(doc, &h))
+			mag := h.MagHeading
+			if h.Metadata.RawHeading != nil {
+				mag = *h.Metadata.RawHeading
+			}
+			variation, hasVariation := variationOf(doc)
+			if !hasVariation {
+				h.Metadata.MagVar, h.Metadata.TrueHeading = nil, nil // the zeros of an old import
+			}
+			h.calibrate(mag, cal.heading(mag), cal.Id)
+			ins.heading = reading_t{h.MagHeading, ts}
+			if hasVariation {
+				ins.variation = reading_t{variation, ts}
+			}
+			write(h)
+
+		case FIELD_WIND_ANGLE:
+			var wd windData_t
+			check(bson.Unmarshal(doc, &wd))
+			if wd.Metadata.Reference != "Apparent" {
+				// only the apparent wind is calibrated, put back any other wind that was calibrated by mistake
+				if wd.Metadata.RawAngle != nil && wd.Metadata.RawSpeed != nil {
+					wd.Angle, wd.Speed = *wd.Metadata.RawAngle, *wd.Metadata.RawSpeed
+					wd.Metadata = windMetadata_t{DataSource: wd.Metadata.DataSource, Reference: wd.Metadata.Reference}
+				}
+				write(wd)
+				return
+			}
+			awa, aws := wd.Angle, wd.Speed
+			if wd.Metadata.RawAngle != nil && wd.Metadata.RawSpeed != nil {
+				awa, aws = *wd.Metadata.RawAngle, *wd.Metadata.RawSpeed
+			}
+			calAwa, calAws := cal.apparentWind(awa, aws, ins.boatspeed.value, ins.heelAt(ts))
+			wd.calibrate(awa, aws, calAwa, calAws, cal.Id)
+			write(wd)
+			ins.awa = reading_t{wd.Angle, ts}
+			if tw := trueWindAt(ts, wd.Angle, wd.Speed, &ins); tw != nil {
+				write(tw)
+			}
+
+		case FIELD_TWS:
+			return // worked out again from the calibrated wind
+
+		case FIELD_DRIFT:
+			return // and the current from the calibrated boatspeed and heading
+
+		default:
+			if v, ok := doc.Lookup(FIELD_ROLL).DoubleOK(); ok {
+				ins.heel = reading_t{v, ts}
+			}
+			if v, ok := doc.Lookup(FIELD_COG).DoubleOK(); ok {
+				ins.cog = reading_t{v, ts}
+			}
+			if v, ok := doc.Lookup(FIELD_SOG).DoubleOK(); ok {
+				ins.sog = reading_t{v, ts}
+			}
+			w.Write(doc)
+			written++
+			if ins.cog.ts.Equal(ts) || ins.sog.ts.Equal(ts) {
+				if c := current.update(ts, &ins); c != nil {
+					write(c)
+				}
+			}
+		}
+	}
+
+	// documents with the same timestamp can come back in any order, so the wind is done after the other
+	// readings at that time, as it was during the import
+	var group []bson.Raw
+	var groupTs time.Time
+	handleGroup := func() {
+		for _, isWind := range []bool{false, true} {
+			for _, doc := range group {
+				if _, err := doc.LookupErr(FIELD_WIND_ANGLE); (err == nil) == isWind {
+					handle(doc, groupTs)
+				}
+			}
+		}
+		group = nil
+	}
+
+	for cursor.Next() {
+
+		ts, ok := cursor.Current().Lookup(FIELD_TS).TimeOK()
+		if !ok {
+			continue
+		}
+		if !ts.Equal(groupTs) {
+			handleGroup()
+			groupTs = ts
+		}
+		// the mongo cursor reuses its buffer so take a copy
+		group = append(group, append(bson.Raw(nil), cursor.Current()...))
+	}
+	handleGroup()
+
+	check(cursor.Err())
+	return written
+}
+
+// Recording the calibration in the metadata of the documents
+
+func (bs *boatSpeed_t) calibrate(raw float64, calibrated float64, calibration string) {
+
+	bs.IndicatedBoatSpeed = calibrated
+	bs.Metadata.CorrectedBoatSpeed = calibrated
+	bs.Metadata.RawBoatSpeed = &raw
+	bs.Metadata.Calibration = calibration
+}
+
+func (h *heading_t) calibrate(raw float64, calibrated float64, calibration string) {
+
+	h.MagHeading = calibrated
+	h.Metadata.Deviation = angleDifference(calibrated, raw)
+	h.Metadata.RawHeading = &raw
+	h.Metadata.Calibration = calibration
+	if h.Metadata.MagVar != nil {
+		trueHeading := normaliseDegrees(calibrated + *h.Metadata.MagVar)
+		h.Metadata.TrueHeading = &trueHeading
+	}
+}
+
+// the variation in a heading document, if the compass sent one. Headings imported before the variation was left
+// out without one have it and the true heading as 0, which is taken as not having one.
+func variationOf(doc bson.Raw) (float64, bool) {
+
+	variation, ok := doc.Lookup(FIELD_METADATA, "magvar").DoubleOK()
+	trueHeading, ok2 := doc.Lookup(FIELD_METADATA, "trueheading").DoubleOK()
+	if !ok || !ok2 || (variation == 0 && trueHeading == 0) {
+		return 0, false
+	}
+	return variation, true
+}
+
+func (wd *windData_t) calibrate(rawAngle float64, rawSpeed float64, angle float64, speed float64, calibration string) {
+
+	wd.Angle, wd.Speed = angle, speed
+	wd.Metadata.AngleCorrection = angleDifference(angle, rawAngle)
+	wd.Metadata.SpeedCorrection = speed - rawSpeed
+	wd.Metadata.RawAngle, wd.Metadata.RawSpeed = &rawAngle, &rawSpeed
+	wd.Metadata.Calibration = calibration
+}
@@ -0,0 +1,397 @@
+package transform
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Session catalog
+---------------
+One document per session (a main collection written by TransformToMongoFormat) recording when and where it was
+sailed, where the data came from, who was on board and which collections have been derived from it. The tools
+keep it up to date on every import and every time a derived collection is built, and the API uses it to list and
+search sessions and to find a session's collections rather than guessing their names.
+*/
+
+const SESSION_CATALOG = storage.CATALOG_PREFIX + "sessions"
+
+type BoundingBox_t struct {
+	MinLat  float64 `bson:"minlat" json:"minLat"`
+	MaxLat  float64 `bson:"maxlat" json:"maxLat"`
+	MinLong float64 `bson:"minlong" json:"minLong"`
+	MaxLong float64 `bson:"maxlong" json:"maxLong"`
+}
+
+// the parts of a session entered by hand, from the tools command line
+type SessionDetails_t struct {
+	Boat  string   `bson:"boat,omitempty" json:"boat,omitempty"`
+	Crew  []string `bson:"crew,omitempty" json:"crew,omitempty"`
+	Helm  string   `bson:"helm,omitempty" json:"helm,omitempty"`
+	Event string   `bson:"event,omitempty" json:"event,omitempty"`
+	Race  string   `bson:"race,omitempty" json:"race,omitempty"`
+}
+
+type Session_t struct {
+	Name             string        `bson:"_id" json:"name"` // the main collection
+	Start            time.Time     `bson:"start" json:"start"`
+	End              time.Time     `bson:"end" json:"end"`
+	BoundingBox      BoundingBox_t `bson:"boundingbox" json:"boundingBox"`
+	SourceFile       string        `bson:"sourcefile,omitempty" json:"sourceFile,omitempty"`
+	SourceHash       string        `bson:"sourcehash,omitempty" json:"sourceHash,omitempty"`   // sha256 of the logger file
+	Calibration      string        `bson:"calibration,omitempty" json:"calibration,omitempty"` // profile the readings were calibrated with, see calibration.go
+	Polar            string        `bson:"polar,omitempty" json:"polar,omitempty"`             // the snapshots are compared with, see performance.go
+	SessionDetails_t `bson:",inline"`
+	Instruments      []string          `bson:"instruments" json:"instruments"` // the metadata sources seen, e.g. "B&G GPS", "Windex"
+	Collections      map[string]string `bson:"collections" json:"collections"` // derived collections by kind, e.g. "lowres-5s" -> "<session>-lowres-5s"
+	Updated          time.Time         `bson:"updated" json:"updated"`
+}
+
+// Reads a session from the catalog. Sessions that arent in the catalog yet come back empty apart from their name.
+func LoadSession(store storage.Store, name string) (Session_t, error) {
+
+	session := Session_t{Name: name, Collections: map[string]string{}}
+
+	err := store.Get(SESSION_CATALOG, name, &session)
+	if err == storage.ErrNotFound {
+		return session, nil
+	}
+	if session.Collections == nil {
+		session.Collections = map[string]string{}
+	}
+	return session, err
+}
+
+func SaveSession(store storage.Store, session Session_t) error {
+
+	session.Updated = time.Now().UTC()
+	return store.Put(SESSION_CATALOG, session.Name, session)
+}
+
+// Records a collection derived from a session, e.g. a low res view. It is catalogued under its suffix without
+// the leading "-", e.g. "lowres-5s" for <session>-lowres-5s.
+func AddDerivedCollection(store storage.Store, session string, collection string) {
+
+	entry, err := LoadSession(store, session)
+	if err != nil {
+		log.Printf("unable to read session %s from the catalog: %s\n", session, err)
+		return
+	}
+	entry.Collections[derivedKind(session, collection)] = collection
+	if err := SaveSession(store, entry); err != nil {
+		log.Printf("unable to update session %s in the catalog: %s\n", session, err)
+	}
+}
+
+func derivedKind(session string, collection string) string {
+	return strings.TrimPrefix(collection, session+"-")
+}
+
+// overwrites the hand entered details with any that have been set
+func (session *Session_t) applyDetails(details SessionDetails_t) {
+
+	if details.Boat != "" {
+		session.Boat = details.Boat
+	}
+	if len(details.Crew) != 0 {
+		session.Crew = details.Crew
+	}
+	if details.Helm != "" {
+		session.Helm = details.Helm
+	}
+	if details.Event != "" {
+		session.Event = details.Event
+	}
+	if details.Race != "" {
+		session.Race = details.Race
+	}
+}
+
+// Session statistics, gathered from the documents as they are written
+
+type sessionStats_t struct {
+	mu          sync.Mutex
+	start       time.Time
+	end         time.Time
+	hasPosition bool
+	bbox        BoundingBox_t
+	sources     map[string]bool
+	written     int64 // documents written
+}
+
+func newSessionStats() *sessionStats_t {
+	return &sessionStats_t{sources: map[string]bool{}}
+}
+
+func (st *sessionStats_t) add(doc bson.Raw) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.written++
+	if ts, ok := doc.Lookup(FIELD_TS).TimeOK(); ok {
+		if st.start.IsZero() || ts.Before(st.start) {
+			st.start = ts
+		}
+		if ts.After(st.end) {
+			st.end = ts
+		}
+	}
+
+	if source, ok := doc.Lookup(FIELD_METADATA, FIELD_SOURCE).StringValueOK(); ok {
+		st.sources[source] = true
+	}
+
+	lat, latOk := doc.Lookup(FIELD_LAT).DoubleOK()
+	long, longOk := doc.Lookup(FIELD_LONG).DoubleOK()
+	if latOk && longOk {
+		if !st.hasPosition {
+			st.bbox = BoundingBox_t{MinLat: lat, MaxLat: lat, MinLong: long, MaxLong: long}
+			st.hasPosition = true
+		}
+		st.bbox.MinLat = minFloat(st.bbox.MinLat, lat)
+		st.bbox.MaxLat = maxFloat(st.bbox.MaxLat, lat)
+		st.bbox.MinLong = minFloat(st.bbox.MinLong, long)
+		st.bbox.MaxLong = maxFloat(st.bbox.MaxLong, long)
+	}
+}
+
+// extends the session's time range, bounding box and instruments with the statistics. Extending rather than
+// replacing means appending more data to a session only ever widens its entry.
+func (st *sessionStats_t) applyTo(session *Session_t) {
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if !st.start.IsZero() && (session.Start.IsZero() || st.start.Before(session.Start)) {
+		session.Start = st.start
+	}
+	if st.end.After(session.End) {
+		session.End = st.end
+	}
+
+	if st.hasPosition {
+		if session.BoundingBox == (BoundingBox_t{}) {
+			session.BoundingBox = st.bbox
+		} else {
+			session.BoundingBox.MinLat = minFloat(session.BoundingBox.MinLat, st.bbox.MinLat)
+			session.BoundingBox.MaxLat = maxFloat(session.BoundingBox.MaxLat, st.bbox.MaxLat)
+			session.BoundingBox.MinLong = minFloat(session.BoundingBox.MinLong, st.bbox.MinLong)
+			session.BoundingBox.MaxLong = maxFloat(session.BoundingBox.MaxLong, st.bbox.MaxLong)
+		}
+	}
+
+	instruments := map[string]bool{}
+	for _, i := range session.Instruments {
+		instruments[i] = true
+	}
+	for source := range st.sources {
+		instruments[source] = true
+	}
+	session.Instruments = session.Instruments[:0]
+	for i := range instruments {
+		session.Instruments = append(session.Instruments, i)
+	}
+	sort.Strings(session.Instruments)
+}
+
+// passes documents through to a writer, gathering the session statistics on the way
+type statsWriter_t struct {
+	storage.Writer
+	stats *sessionStats_t
+}
+
+func (w statsWriter_t) Write(doc []byte) {
+	w.stats.add(doc)
+	w.Writer.Write(doc)
+}
+
+// Updates the catalog entry after logger data has been imported into a session. source is where the data came
+// from, usually a logger file, and hash its sha256 if it is a complete file. An empty source leaves both as
+// they were, for an import that is still going. calibration is the profile applied, if any.
+func recordImport(store storage.Store, collection string, source string, hash string, calibration string, details SessionDetails_t, stats *sessionStats_t, derived []string) {
+
+	session, err := LoadSession(store, collection)
+	if err != nil {
+		log.Printf("unable to read session %s from the catalog: %s\n", collection, err)
+		return
+	}
+
+	stats.applyTo(&session)
+	session.applyDetails(details)
+	if source != "" {
+		session.SourceFile = source
+		session.SourceHash = hash
+	}
+	if calibration != "" {
+		session.Calibration = calibration
+	}
+	for _, col := range derived {
+		session.Collections[derivedKind(collection, col)] = col
+	}
+
+	if err := SaveSession(store, session); err != nil {
+		log.Printf("unable to update session %s in the catalog: %s\n", collection, err)
+	}
+}
+
+// returns the sha256 of a file as hex, or "" if it cant be read
+func fileHash(name string) string {
+
+	f, err := os.Open(name)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Rebuilds the catalog entry for a session from the data already in the store, for sessions imported before
+// the catalog existed. Hand entered details are kept unless new ones are given. An empty session name
+// rebuilds every session.
+func CatalogSession(name string, details SessionDetails_t) {
+
+	store := storage.Open()
+	defer store.Close()
+
+	names := []string{name}
+	if name == "" {
+		var err error
+		names, err = store.ListSessions()
+		check(err)
+	}
+
+	colls, err := store.ListCollections()
+	check(err)
+
+	for _, name := range names {
+
+		session, err := LoadSession(store, name)
+		check(err)
+
+		// start again from the data rather than extending what is there
+		session.Start, session.End, session.BoundingBox, session.Instruments = time.Time{}, time.Time{}, BoundingBox_t{}, nil
+
+		// the engine and battery data are in derived collections so read those as well as the main one
+		read := []string{name}
+		for _, col := range colls {
+			if storage.IsDerived(name, col) {
+				session.Collections[derivedKind(name, col)] = col
+				read = append(read, col)
+			}
+		}
+
+		stats := newSessionStats()
+		for _, col := range read {
+			cursor, err := store.Range(col, "", time.Time{}, time.Time{})
+			check(err)
+			for cursor.Next() {
+				stats.add(cursor.Current())
+			}
+			check(cursor.Err())
+			cursor.Close()
+		}
+
+		stats.applyTo(&session)
+		session.applyDetails(details)
+
+		check(SaveSession(store, session))
+		fmt.Printf("catalogued %s: %v to %v, instruments %v\n", name, session.Start, session.End, session.Instruments)
+	}
+}
+
+// Searching the catalog
+
+type SessionFilter_t struct {
+	Text  string      // matched case insensitively against the name, boat, event, race, helm and crew
+	Boat  string      // exact match, case insensitive
+	Event string      // exact match, case insensitive
+	Crew  string      // one of the crew, case insensitive
+	From  time.Time   // sessions that end after From
+	To    time.Time   // sessions that start before To
+	Near  *[2]float64 // lat, long that must be inside the session's bounding box
+}
+
+func SearchSessions(sessions []Session_t, filter SessionFilter_t) []Session_t {
+
+	found := []Session_t{}
+	for _, s := range sessions {
+
+		if filter.Text != "" {
+			text := strings.ToLower(strings.Join(append([]string{s.Name, s.Boat, s.Event, s.Race, s.Helm}, s.Crew...), " "))
+			if !strings.Contains(text, strings.ToLower(filter.Text)) {
+				continue
+			}
+		}
+		if filter.Boat != "" && !strings.EqualFold(filter.Boat, s.Boat) {
+			continue
+		}
+		if filter.Event != "" && !strings.EqualFold(filter.Event, s.Event) {
+			continue
+		}
+		if filter.Crew != "" {
+			onBoard := false
+			for _, c := range s.Crew {
+				onBoard = onBoard || strings.EqualFold(filter.Crew, c)
+			}
+			if !onBoard {
+				continue
+			}
+		}
+		if !filter.From.IsZero() && s.End.Before(filter.From) {
+			continue
+		}
+		if !filter.To.IsZero() && s.Start.After(filter.To) {
+			continue
+		}
+		if filter.Near != nil {
+			lat, long := filter.Near[0], filter.Near[1]
+			b := s.BoundingBox
+			if lat < b.MinLat || lat > b.MaxLat || long < b.MinLong || long > b.MaxLong {
+				continue
+			}
+		}
+		found = append(found, s)
+	}
+	return found
+}
+
+// appends s to list if it isnt already there
+func appendUnique(list []string, s string) []string {
+	for _, l := range list {
+		if l == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
+
+func minFloat(a float64, b float64) float64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a float64, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
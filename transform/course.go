@@ -0,0 +1,464 @@
+package transform
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Race courses and legs
+---------------------
+A course is the marks sailed round in order, with a start and finish line if they are known. It is read from a
+json file:
+
+	{"start":  {"pin": {"lat": 50.76, "long": -1.30}, "boat": {"lat": 50.761, "long": -1.297}},
+	 "marks":  [{"name": "Windward", "lat": 50.78, "long": -1.29}, {"name": "Leeward", "lat": 50.76, "long": -1.30}],
+	 "finish": {"pin": {...}, "boat": {...}}}
+
+or from a GPX route (or its waypoints if it has no route). A GPX file has no lines, so its first point is the
+start and its last the finish. Without a start line the first mark is where the race starts, and without a
+finish line the last mark is where it finishes.
+
+The course is kept in the catalog by session and the session's track is split into legs, one from each mark to
+the next, which are kept with it:
+
+	- a mark is rounded at the boat's closest approach the first time it comes within ROUNDING_RADIUS of it,
+	  or its closest approach at all if it never does
+	- the start is the last time the boat crossed the start line to the course side before it got to the first
+	  mark, so returning after being over early is allowed for
+	- the finish is the first time the boat crossed the finish line after rounding the last mark
+
+Each leg has its start and end times, the distance sailed, the VMC (how fast the boat closed on the mark it was
+sailing to), the average TWS and TWA and the average tidal current, see current.go. The low res views use the
+legs for the VMC in the snapshots if no mark is given, see performance.go, so the course should be added before
+they are built.
+*/
+
+const COURSE_CATALOG = storage.CATALOG_PREFIX + "courses"
+
+const ROUNDING_RADIUS = 100.0 // metres
+
+type Line_t struct {
+	Pin  Mark_t `bson:"pin" json:"pin"`
+	Boat Mark_t `bson:"boat" json:"boat"` // the committee boat end
+}
+
+type Leg_t struct {
+	Number        int       `bson:"number" json:"number"`
+	From          string    `bson:"from" json:"from"`
+	To            string    `bson:"to" json:"to"`
+	Mark          Mark_t    `bson:"mark" json:"mark"` // sailed to, the middle of the line for the finish
+	Start         time.Time `bson:"start" json:"start"`
+	End           time.Time `bson:"end" json:"end"`
+	Duration      float64   `bson:"duration" json:"duration"` // seconds
+	StartPosition Mark_t    `bson:"startposition" json:"startPosition"`
+	EndPosition   Mark_t    `bson:"endposition" json:"endPosition"`
+	Distance      float64   `bson:"distance" json:"distance"` // metres sailed
+	Rhumb         float64   `bson:"rhumb" json:"rhumb"`       // metres from the start of the leg to the mark
+	Closest       float64   `bson:"closest" json:"closest"`   // metres, how close the boat came to the mark
+	Vmc           float64   `bson:"vmc" json:"vmc"`           // m/s
+	Tws           float64   `bson:"tws" json:"tws"`           // m/s, 0 if there was no true wind
+	Twa           float64   `bson:"twa" json:"twa"`           // degrees off the bow, 0 to 180
+	Set           float64   `bson:"set" json:"set"`           // of the average current, degrees true, see current.go
+	Drift         float64   `bson:"drift" json:"drift"`       // m/s, 0 if there was no current
+}
+
+type Course_t struct {
+	Session    string    `bson:"_id" json:"session"`
+	Start      *Line_t   `bson:"start,omitempty" json:"start,omitempty"`
+	Marks      []Mark_t  `bson:"marks" json:"marks"`
+	Finish     *Line_t   `bson:"finish,omitempty" json:"finish,omitempty"`
+	SourceFile string    `bson:"sourcefile,omitempty" json:"sourceFile,omitempty"`
+	Legs       []Leg_t   `bson:"legs" json:"legs"`
+	Updated    time.Time `bson:"updated" json:"updated"`
+}
+
+// Reads a course from a json or GPX file, splits the session's track into legs with it and saves it in the catalog
+func AddCourseFile(file string, session string) (Course_t, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Course_t{}, err
+	}
+
+	var course Course_t
+	if strings.EqualFold(filepath.Ext(file), ".gpx") {
+		course, err = parseGpx(data)
+	} else {
+		err = json.Unmarshal(data, &course)
+	}
+	if err != nil {
+		return course, fmt.Errorf("reading %s: %s", file, err)
+	}
+	course.Session, course.SourceFile = session, file
+
+	store := storage.Open()
+	defer store.Close()
+
+	if course.Legs, err = findLegs(store, course); err != nil {
+		return course, err
+	}
+	course.Updated = time.Now().UTC()
+	return course, store.Put(COURSE_CATALOG, session, course)
+}
+
+// Reads a session's course from the catalog, storage.ErrNotFound if it hasnt got one
+func LoadCourse(store storage.Store, session string) (Course_t, error) {
+
+	var course Course_t
+	err := store.Get(COURSE_CATALOG, session, &course)
+	return course, err
+}
+
+// the mark the boat was sailing to at t, or nil if it wasnt racing
+func (course *Course_t) MarkAt(t time.Time) *Mark_t {
+
+	for i, leg := range course.Legs {
+		if !t.Before(leg.Start) && t.Before(leg.End) {
+			return &course.Legs[i].Mark
+		}
+	}
+	return nil
+}
+
+// the marks of a GPX route, or its waypoints if it hasnt got a route
+func parseGpx(data []byte) (Course_t, error) {
+
+	type point_t struct {
+		Lat  float64 `xml:"lat,attr"`
+		Long float64 `xml:"lon,attr"`
+		Name string  `xml:"name"`
+	}
+	var gpx struct {
+		Route     []point_t `xml:"rte>rtept"`
+		Waypoints []point_t `xml:"wpt"`
+	}
+	if err := xml.Unmarshal(data, &gpx); err != nil {
+		return Course_t{}, err
+	}
+
+	points := gpx.Route
+	if len(points) == 0 {
+		points = gpx.Waypoints
+	}
+	var course Course_t
+	for _, p := range points {
+		course.Marks = append(course.Marks, Mark_t{Name: p.Name, Lat: p.Lat, Long: p.Long})
+	}
+	return course, nil
+}
+
+// a mark or line the boat sails to
+type target_t struct {
+	name string
+	mark *Mark_t
+	line *Line_t
+}
+
+func (t target_t) position() Mark_t {
+
+	if t.mark != nil {
+		return *t.mark
+	}
+	return Mark_t{Name: t.name, Lat: (t.line.Pin.Lat + t.line.Boat.Lat) / 2, Long: (t.line.Pin.Long + t.line.Boat.Long) / 2}
+}
+
+// the start, the marks and the finish in order
+func (course *Course_t) targets() []target_t {
+
+	var targets []target_t
+	if course.Start != nil {
+		targets = append(targets, target_t{name: "start", line: course.Start})
+	}
+	for i := range course.Marks {
+		name := course.Marks[i].Name
+		if name == "" {
+			name = fmt.Sprintf("mark %d", i+1)
+		}
+		targets = append(targets, target_t{name: name, mark: &course.Marks[i]})
+	}
+	if course.Finish != nil {
+		targets = append(targets, target_t{name: "finish", line: course.Finish})
+	}
+	return targets
+}
+
+// the session's track in metres, see toMetres, with the positions of the targets in the same projection
+type courseTrack_t struct {
+	ts      []time.Time
+	points  [][2]float64 // lat, long
+	xy      [][2]float64
+	targets [][2][2]float64 // each target's mark, twice, or the ends of its line
+}
+
+// Splits the session's track into a leg between each of the course's targets. Legs stop at the last target
+// the boat got to.
+func findLegs(store storage.Store, course Course_t) ([]Leg_t, error) {
+
+	targets := course.targets()
+	if len(targets) < 2 {
+		return nil, fmt.Errorf("a course needs at least two marks, or a start or finish line")
+	}
+
+	track, err := positionsBetween(store, course.Session, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	var ct courseTrack_t
+	var points [][2]float64
+	for _, t := range targets {
+		if t.mark != nil {
+			points = append(points, [2]float64{t.mark.Lat, t.mark.Long}, [2]float64{t.mark.Lat, t.mark.Long})
+		} else {
+			points = append(points, [2]float64{t.line.Pin.Lat, t.line.Pin.Long}, [2]float64{t.line.Boat.Lat, t.line.Boat.Long})
+		}
+	}
+	for _, p := range track {
+		ct.ts = append(ct.ts, p.Ts)
+		ct.points = append(ct.points, [2]float64{p.Lat, p.Long})
+	}
+	if len(ct.points) < 2 {
+		return nil, fmt.Errorf("session %s has no track", course.Session)
+	}
+	xy := toMetres(append(points, ct.points...))
+	for i := range targets {
+		ct.targets = append(ct.targets, [2][2]float64{xy[2*i], xy[2*i+1]})
+	}
+	ct.xy = xy[len(points):]
+
+	// when the boat got to each target, as an index into the track and how far on to the next position
+	type event_t struct {
+		i       int
+		f       float64
+		closest float64
+	}
+	var events []event_t
+
+	// when the boat got to target k, from position i on
+	reach := func(k int, i int) (event_t, bool) {
+		var e event_t
+		var ok bool
+		if targets[k].line != nil {
+			e.i, e.f, ok = ct.crossing(i, len(ct.xy)-1, ct.targets[k])
+		} else {
+			e.i, e.closest, ok = ct.rounding(i, ct.targets[k][0])
+		}
+		return e, ok
+	}
+
+	from := 0
+	for k, t := range targets {
+		var e event_t
+		var ok bool
+		if k == 0 && t.line != nil {
+			// the start is found back from when the boat got to the next target
+			next := len(ct.xy) - 1
+			if e, found := reach(1, 0); found {
+				next = e.i
+			}
+			towards := [2]float64{(ct.targets[1][0][0] + ct.targets[1][1][0]) / 2, (ct.targets[1][0][1] + ct.targets[1][1][1]) / 2}
+			e.i, e.f, ok = ct.lastCrossing(0, next, ct.targets[0], towards)
+		} else {
+			e, ok = reach(k, from)
+		}
+		if !ok {
+			break
+		}
+		events = append(events, e)
+		from = e.i
+	}
+
+	// the wind, for the average on each leg
+	tws, err := readingsBetween(store, course.Session, FIELD_TWS, time.Time{}, time.Time{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	twa, err := readingsBetween(store, course.Session, FIELD_TWA, time.Time{}, time.Time{}, nil)
+	if err != nil {
+		return nil, err
+	}
+	currents, err := currentBetween(store, course.Session, time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+
+	var legs []Leg_t
+	for k := 1; k < len(events); k++ {
+		a, b := events[k-1], events[k]
+		leg := Leg_t{
+			Number:        k,
+			From:          targets[k-1].name,
+			To:            targets[k].name,
+			Mark:          targets[k].position(),
+			Start:         ct.time(a.i, a.f),
+			End:           ct.time(b.i, b.f),
+			StartPosition: ct.position(a.i, a.f),
+			EndPosition:   ct.position(b.i, b.f),
+			Closest:       b.closest,
+		}
+		leg.Duration = leg.End.Sub(leg.Start).Seconds()
+
+		for i := a.i; i < b.i; i++ {
+			leg.Distance += math.Hypot(ct.xy[i+1][0]-ct.xy[i][0], ct.xy[i+1][1]-ct.xy[i][1])
+		}
+		leg.Rhumb = distance(leg.StartPosition, leg.Mark)
+		if leg.Duration > 0 {
+			leg.Vmc = (leg.Rhumb - distance(leg.EndPosition, leg.Mark)) / leg.Duration
+		}
+
+		leg.Tws = meanBetween(tws, leg.Start, leg.End, false)
+		leg.Twa = meanBetween(twa, leg.Start, leg.End, true)
+		leg.Set, leg.Drift, _ = meanCurrent(currents, leg.Start, leg.End)
+		legs = append(legs, leg)
+	}
+	return legs, nil
+}
+
+// the first time from i on that the boat came within ROUNDING_RADIUS of mark, at its closest approach then. If
+// it never did, its closest approach from i on. Returns the index and how close it got.
+func (ct *courseTrack_t) rounding(from int, mark [2]float64) (int, float64, bool) {
+
+	best, closest := -1, math.Inf(1)
+	for i := from; i < len(ct.xy); i++ {
+		d := math.Hypot(ct.xy[i][0]-mark[0], ct.xy[i][1]-mark[1])
+		if d < closest {
+			best, closest = i, d
+		}
+		if closest <= ROUNDING_RADIUS && d > ROUNDING_RADIUS {
+			break // the boat has gone past the mark
+		}
+	}
+	return best, closest, best >= 0
+}
+
+// the first time between from and to that the track crosses a line, going either way
+func (ct *courseTrack_t) crossing(from int, to int, line [2][2]float64) (int, float64, bool) {
+
+	for i := from; i < to; i++ {
+		if f, _, ok := segmentCrossing(ct.xy[i], ct.xy[i+1], line); ok {
+			return i, f, true
+		}
+	}
+	return 0, 0, false
+}
+
+// the last time between from and to that the track crosses a line to the side towards is on
+func (ct *courseTrack_t) lastCrossing(from int, to int, line [2][2]float64, towards [2]float64) (int, float64, bool) {
+
+	side := sideOf(line, towards)
+	for i := to - 1; i >= from; i-- {
+		if f, s, ok := segmentCrossing(ct.xy[i], ct.xy[i+1], line); ok && s == side {
+			return i, f, true
+		}
+	}
+	return 0, 0, false
+}
+
+// the time f of the way from position i to the next
+func (ct *courseTrack_t) time(i int, f float64) time.Time {
+
+	if i+1 >= len(ct.ts) {
+		return ct.ts[i]
+	}
+	return ct.ts[i].Add(time.Duration(f * float64(ct.ts[i+1].Sub(ct.ts[i]))))
+}
+
+func (ct *courseTrack_t) position(i int, f float64) Mark_t {
+
+	a, b := ct.points[i], ct.points[i]
+	if i+1 < len(ct.points) {
+		b = ct.points[i+1]
+	}
+	return Mark_t{Lat: a[0] + (b[0]-a[0])*f, Long: a[1] + (b[1]-a[1])*f}
+}
+
+// whether the segment p-q crosses the line, how far along p-q it does and which side of the line q is on
+func segmentCrossing(p [2]float64, q [2]float64, line [2][2]float64) (float64, float64, bool) {
+
+	sp, sq := sideOf(line, p), sideOf(line, q)
+	if sp == 0 || sq == 0 || sp == sq {
+		return 0, 0, false
+	}
+	// and the crossing must be between the ends of the line
+	a, b := line[0], line[1]
+	dp := (b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])
+	dq := (b[0]-a[0])*(q[1]-a[1]) - (b[1]-a[1])*(q[0]-a[0])
+	f := dp / (dp - dq)
+	x, y := p[0]+(q[0]-p[0])*f, p[1]+(q[1]-p[1])*f
+	along := ((x-a[0])*(b[0]-a[0]) + (y-a[1])*(b[1]-a[1])) / ((b[0]-a[0])*(b[0]-a[0]) + (b[1]-a[1])*(b[1]-a[1]))
+	if along < 0 || along > 1 {
+		return 0, 0, false
+	}
+	return f, sq, true
+}
+
+// which side of the line p is, 1 or -1, or 0 if it is on it
+func sideOf(line [2][2]float64, p [2]float64) float64 {
+
+	a, b := line[0], line[1]
+	cross := (b[0]-a[0])*(p[1]-a[1]) - (b[1]-a[1])*(p[0]-a[0])
+	switch {
+	case cross > 0:
+		return 1
+	case cross < 0:
+		return -1
+	}
+	return 0
+}
+
+// metres between two positions
+func distance(a Mark_t, b Mark_t) float64 {
+
+	xy := toMetres([][2]float64{{a.Lat, a.Long}, {b.Lat, b.Long}})
+	return math.Hypot(xy[1][0], xy[1][1])
+}
+
+// the readings of a field in a collection between two times, zero for either end. keep picks the documents to
+// use, nil for all of them.
+func readingsBetween(store storage.Store, collection string, field string, start time.Time, end time.Time, keep func(doc bson.Raw) bool) ([]reading_t, error) {
+
+	cursor, err := store.Range(collection, field, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var readings []reading_t
+	for cursor.Next() {
+		doc := cursor.Current()
+		v, ok := doc.Lookup(field).DoubleOK()
+		ts, ok2 := doc.Lookup(FIELD_TS).TimeOK()
+		if ok && ok2 && (keep == nil || keep(doc)) {
+			readings = append(readings, reading_t{v, ts})
+		}
+	}
+	return readings, cursor.Err()
+}
+
+// the mean of the readings from start to end, of how far they are off the bow if they are wind angles. 0 if
+// there are none.
+func meanBetween(readings []reading_t, start time.Time, end time.Time, angle bool) float64 {
+
+	var values []float64
+	for _, r := range readings {
+		if r.ts.Before(start) || !r.ts.Before(end) {
+			continue
+		}
+		if angle {
+			values = append(values, math.Abs(angleDifference(r.value, 0)))
+		} else {
+			values = append(values, r.value)
+		}
+	}
+	return linearStats(values).Mean
+}
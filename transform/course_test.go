@@ -0,0 +1,83 @@
+package transform
+
+import "testing"
+
+// 100m of line running east, x east and y north in metres
+var testLine = [2][2]float64{{0, 0}, {100, 0}}
+
+func TestSegmentCrossing(t *testing.T) {
+
+	tests := []struct {
+		name string
+		p, q [2]float64
+		f    float64
+		side float64
+		ok   bool
+	}{
+		{"northwards", [2]float64{50, -10}, [2]float64{50, 30}, 0.25, 1, true},
+		{"southwards", [2]float64{20, 10}, [2]float64{40, -10}, 0.5, -1, true},
+		{"past the end of the line", [2]float64{150, -10}, [2]float64{150, 10}, 0, 0, false},
+		{"before the start of the line", [2]float64{-1, -10}, [2]float64{-1, 10}, 0, 0, false},
+		{"same side", [2]float64{50, 10}, [2]float64{60, 20}, 0, 0, false},
+		{"onto the line", [2]float64{50, -10}, [2]float64{50, 0}, 0, 0, false},
+		{"along the line", [2]float64{10, 0}, [2]float64{90, 0}, 0, 0, false},
+	}
+	for _, tt := range tests {
+		f, side, ok := segmentCrossing(tt.p, tt.q, testLine)
+		if ok != tt.ok || !approx(f, tt.f, TEST_TOLERANCE) || side != tt.side {
+			t.Errorf("%s: got %f %g %t, want %f %g %t", tt.name, f, side, ok, tt.f, tt.side, tt.ok)
+		}
+	}
+}
+
+func TestLastCrossing(t *testing.T) {
+
+	// over the line early, back to the pre-start side and then away across it
+	ct := courseTrack_t{xy: [][2]float64{{50, -20}, {50, 20}, {50, -20}, {50, 20}, {50, 40}}}
+	course, prestart := [2]float64{50, 500}, [2]float64{50, -500}
+
+	if i, f, ok := ct.lastCrossing(0, 4, testLine, course); !ok || i != 2 || !approx(f, 0.5, TEST_TOLERANCE) {
+		t.Errorf("to the course side: got %d %f %t, want the second crossing", i, f, ok)
+	}
+	if i, _, ok := ct.lastCrossing(0, 4, testLine, prestart); !ok || i != 1 {
+		t.Errorf("back to the pre-start side: got %d %t, want 1", i, ok)
+	}
+	if i, _, ok := ct.lastCrossing(0, 2, testLine, course); !ok || i != 0 {
+		t.Errorf("before returning: got %d %t, want 0", i, ok)
+	}
+	if _, _, ok := ct.lastCrossing(3, 4, testLine, course); ok {
+		t.Errorf("after the last crossing: got a crossing")
+	}
+	if i, _, ok := ct.crossing(1, 4, testLine); !ok || i != 1 {
+		t.Errorf("first crossing from 1: got %d %t, want 1", i, ok)
+	}
+}
+
+func TestRounding(t *testing.T) {
+
+	// sailing east past a mark at the origin, 30m north of it, then back west 20m south of it
+	var ct courseTrack_t
+	for x := -300.0; x <= 300; x += 50 {
+		ct.xy = append(ct.xy, [2]float64{x, 30})
+	}
+	for x := 300.0; x >= -300; x -= 50 {
+		ct.xy = append(ct.xy, [2]float64{x, -20})
+	}
+	mark := [2]float64{0, 0}
+
+	if i, closest, ok := ct.rounding(0, mark); !ok || i != 6 || !approx(closest, 30, TEST_TOLERANCE) {
+		t.Errorf("first pass: got %d %f %t, want 6 30", i, closest, ok)
+	}
+	if i, closest, ok := ct.rounding(9, mark); !ok || i != 19 || !approx(closest, 20, TEST_TOLERANCE) {
+		t.Errorf("second pass: got %d %f %t, want 19 20", i, closest, ok)
+	}
+
+	// never within ROUNDING_RADIUS, so the closest it got
+	far := [2]float64{0, 200}
+	if i, closest, ok := ct.rounding(0, far); !ok || i != 6 || !approx(closest, 170, TEST_TOLERANCE) {
+		t.Errorf("never close: got %d %f %t, want 6 170", i, closest, ok)
+	}
+	if _, _, ok := ct.rounding(len(ct.xy), mark); ok {
+		t.Errorf("off the end of the track: got a rounding")
+	}
+}
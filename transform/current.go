@@ -0,0 +1,156 @@
+package transform
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+	"github.com/m-h-w/nmea-logger/wind"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Tidal current
+-------------
+The current is the difference between where the boat is going over the ground (SOG along COG) and through the
+water (boatspeed along the heading, turned by leeway), see wind.Current. Each time a COG and SOG reading comes
+in it is worked out from the latest boatspeed, heading, variation and, for the leeway, heel and apparent wind
+angle, and smoothed with an exponential average over CURRENT_SMOOTHING. A current document is written next to
+the readings every CURRENT_INTERVAL:
+
+	{ts, metadata: {source: "calculated", leeway: -3.2}, set, drift}
+
+set being the direction the current flows to, degrees true, and drift its speed in m/s. There is no current
+without a true heading (the compass has to give the variation, as COG is always true) or without boatspeed,
+and readings older than TRUE_WIND_MAX_AGE are not used. Without heel the leeway is taken as 0.
+
+The current goes into the low res views and snapshots with everything else, the set and drift averaged together
+as a vector (see VectorFields), so the map can draw it along the track (/boat/current), and each race leg has
+the average current over it, see course.go. It is noisy in manoeuvres, when the heading and COG dont turn
+together, which the smoothing mostly takes care of.
+*/
+
+const CURRENT_SMOOTHING = 2 * time.Minute // time constant of the exponential average
+const CURRENT_INTERVAL = time.Second      // between current documents
+
+type currentMetadata_t struct {
+	DataSource string  `bson:"source"`
+	Leeway     float64 `bson:"leeway"` // degrees, estimated from heel and boatspeed
+}
+
+type current_t struct {
+	Ts       time.Time         `bson:"ts"`
+	Metadata currentMetadata_t `bson:"metadata"`
+	Set      float64           `bson:"set"`
+	Drift    float64           `bson:"drift"`
+}
+
+// the smoothed current, kept up to date as the COG and SOG readings go past
+type currentEstimator_t struct {
+	north   float64 // m/s, weighted sums
+	east    float64
+	weight  float64   // of the sums, below 1 until CURRENT_SMOOTHING or so has gone by
+	last    time.Time // of the last reading folded in
+	written time.Time // of the last current document
+}
+
+// writes the current for a COG and SOG reading, every CURRENT_INTERVAL, if there are readings to work it out from
+func transformCurrent(input map[string]interface{}, ins *instruments_t, c *currentEstimator_t, w storage.Writer) {
+
+	t, err := time.Parse(time.RFC3339, convertToDateFormat(input["timestamp"].(string)))
+	check(err)
+
+	current := c.update(t, ins)
+	if current == nil {
+		return
+	}
+
+	if debug {
+		fmt.Printf("current: set %f drift %f\n", current.Set, current.Drift)
+	}
+
+	bsonCurrent, err := bson.Marshal(current)
+	check(err)
+	w.Write(bsonCurrent)
+}
+
+// folds in the current at t, returning a current document if it is time for one
+func (c *currentEstimator_t) update(t time.Time, ins *instruments_t) *current_t {
+
+	if !ins.boatspeed.fresh(t) || !ins.heading.fresh(t) || !ins.variation.fresh(t) || !ins.sog.fresh(t) || !ins.cog.fresh(t) {
+		return nil
+	}
+
+	var leeway float64
+	if ins.heel.fresh(t) && ins.awa.fresh(t) {
+		leeway = wind.EstimateLeeway(ins.awa.value, ins.heel.value, ins.boatspeed.value*MS2KNOTS, WindCorrection.Leeway)
+	}
+	course := ins.heading.value + ins.variation.value + leeway
+	set, drift := wind.Current(ins.boatspeed.value, course, ins.sog.value, ins.cog.value)
+	north, east := drift*math.Cos(set*math.Pi/180), drift*math.Sin(set*math.Pi/180)
+
+	// averaged as a vector, so a weak current swinging round doesnt average to nonsense. The sums are divided
+	// by their weight so the first few readings arent pulled towards 0.
+	dt := t.Sub(c.last)
+	if c.last.IsZero() || dt > CURRENT_SMOOTHING {
+		c.north, c.east, c.weight = 0, 0, 0 // start again after a gap
+		dt = CURRENT_INTERVAL               // any weight will do for the first reading
+	}
+	if dt > 0 {
+		decay := math.Exp(-dt.Seconds() / CURRENT_SMOOTHING.Seconds())
+		c.north = decay*c.north + (1-decay)*north
+		c.east = decay*c.east + (1-decay)*east
+		c.weight = decay*c.weight + (1 - decay)
+		c.last = t
+	}
+
+	if !c.written.IsZero() && t.Sub(c.written) < CURRENT_INTERVAL {
+		return nil
+	}
+	c.written = t
+
+	current := current_t{Ts: t, Metadata: currentMetadata_t{DataSource: TRUE_WIND_SOURCE, Leeway: leeway}}
+	current.Drift = math.Hypot(c.north, c.east) / c.weight
+	current.Set = normaliseDegrees(math.Atan2(c.east, c.north) * 180 / math.Pi)
+	return &current
+}
+
+// the current readings in a collection between two times, zero for either end
+func currentBetween(store storage.Store, collection string, start time.Time, end time.Time) ([]current_t, error) {
+
+	cursor, err := store.Range(collection, FIELD_DRIFT, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var currents []current_t
+	for cursor.Next() {
+		var c current_t
+		if err := cursor.Decode(&c); err == nil {
+			currents = append(currents, c)
+		}
+	}
+	return currents, cursor.Err()
+}
+
+// the vector mean of the current from start to end, as set and drift. false if there are no readings.
+func meanCurrent(currents []current_t, start time.Time, end time.Time) (float64, float64, bool) {
+
+	var north, east float64
+	n := 0
+	for _, c := range currents {
+		if c.Ts.Before(start) || !c.Ts.Before(end) {
+			continue
+		}
+		north += c.Drift * math.Cos(c.Set*math.Pi/180)
+		east += c.Drift * math.Sin(c.Set*math.Pi/180)
+		n++
+	}
+	if n == 0 {
+		return 0, 0, false
+	}
+	north, east = north/float64(n), east/float64(n)
+	return normaliseDegrees(math.Atan2(east, north) * 180 / math.Pi), math.Hypot(north, east), true
+}
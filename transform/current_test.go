@@ -0,0 +1,123 @@
+package transform
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// readings at t of a boat heading north at 5 m/s through the water with variation 0, going over the ground as
+// if the current is drift m/s flowing to set
+func testInstruments(t time.Time, set float64, drift float64) *instruments_t {
+
+	north := 5 + drift*math.Cos(set*math.Pi/180)
+	east := drift * math.Sin(set*math.Pi/180)
+	return &instruments_t{
+		boatspeed: reading_t{5, t},
+		heading:   reading_t{0, t},
+		variation: reading_t{0, t},
+		sog:       reading_t{math.Hypot(north, east), t},
+		cog:       reading_t{normaliseDegrees(math.Atan2(east, north) * 180 / math.Pi), t},
+	}
+}
+
+func TestCurrentEstimator(t *testing.T) {
+
+	var c currentEstimator_t
+	t0 := time.Date(2021, 7, 12, 10, 0, 0, 0, time.UTC)
+
+	// the first reading is taken as it is rather than pulled towards 0
+	current := c.update(t0, testInstruments(t0, 90, 1))
+	if current == nil || !approx(current.Set, 90, 0.01) || !approx(current.Drift, 1, 0.001) || !current.Ts.Equal(t0) {
+		t.Fatalf("first reading: got %+v, want set 90 drift 1", current)
+	}
+	if current := c.update(t0.Add(CURRENT_INTERVAL/2), testInstruments(t0.Add(CURRENT_INTERVAL/2), 90, 1)); current != nil {
+		t.Errorf("got a current document %v after the last", CURRENT_INTERVAL/2)
+	}
+
+	// steady for a while, then the current turning to flow the other way only shows after CURRENT_SMOOTHING or so
+	ts := t0
+	for ts.Sub(t0) < 5*time.Minute {
+		ts = ts.Add(CURRENT_INTERVAL)
+		current = c.update(ts, testInstruments(ts, 90, 1))
+	}
+	if current == nil || !approx(current.Set, 90, 0.01) || !approx(current.Drift, 1, 0.001) {
+		t.Errorf("steady: got %+v, want set 90 drift 1", current)
+	}
+	turned := ts
+	for i := 0; i < 10; i++ {
+		ts = ts.Add(CURRENT_INTERVAL)
+		current = c.update(ts, testInstruments(ts, 270, 1))
+	}
+	if current == nil || !approx(current.Set, 90, 0.01) || current.Drift > 1 || current.Drift < 0.8 {
+		t.Errorf("10s after turning: got %+v, want still flowing to 90 a little weaker", current)
+	}
+	for ts.Sub(turned) < 10*CURRENT_SMOOTHING {
+		ts = ts.Add(CURRENT_INTERVAL)
+		current = c.update(ts, testInstruments(ts, 270, 1))
+	}
+	if current == nil || !approx(current.Set, 270, 0.01) || !approx(current.Drift, 1, 0.001) {
+		t.Errorf("long after turning: got %+v, want set 270 drift 1", current)
+	}
+
+	// after a gap the smoothing starts again
+	ts = ts.Add(2 * CURRENT_SMOOTHING)
+	if current := c.update(ts, testInstruments(ts, 0, 0.5)); current == nil || !approx(current.Set, 0, 0.01) || !approx(current.Drift, 0.5, 0.001) {
+		t.Errorf("after a gap: got %+v, want set 0 drift 0.5", current)
+	}
+
+	// nothing without fresh readings
+	ins := testInstruments(ts, 0, 0.5)
+	ins.boatspeed.ts = ts.Add(-2 * TRUE_WIND_MAX_AGE)
+	if current := c.update(ts.Add(time.Minute), ins); current != nil {
+		t.Errorf("stale readings: got %+v", current)
+	}
+	if current := new(currentEstimator_t).update(ts, &instruments_t{}); current != nil {
+		t.Errorf("no readings: got %+v", current)
+	}
+}
+
+func TestCurrentLeeway(t *testing.T) {
+
+	// heeled on starboard tack the boat slips to port, so a track straight through the water reads as a current
+	// to starboard unless the leeway is taken off
+	t0 := time.Date(2021, 7, 12, 10, 0, 0, 0, time.UTC)
+	ins := testInstruments(t0, 0, 0)
+	ins.heel, ins.awa = reading_t{15, t0}, reading_t{30, t0}
+
+	current := new(currentEstimator_t).update(t0, ins)
+	if current == nil || current.Metadata.Leeway >= 0 {
+		t.Fatalf("got %+v, want leeway to port", current)
+	}
+	// going straight over the ground while pointing leeway off it the current is square to the bisector
+	leeway := current.Metadata.Leeway * math.Pi / 180
+	if !approx(current.Set, 90+current.Metadata.Leeway/2, 0.01) || !approx(current.Drift, -10*math.Sin(leeway/2), 0.001) {
+		t.Errorf("got set %f drift %f for leeway %f, want the current across the boat to starboard", current.Set, current.Drift, current.Metadata.Leeway)
+	}
+}
+
+func TestMeanCurrent(t *testing.T) {
+
+	t0 := time.Date(2021, 7, 12, 10, 0, 0, 0, time.UTC)
+	currents := []current_t{
+		{Ts: t0, Set: 0, Drift: 1},
+		{Ts: t0.Add(time.Minute), Set: 90, Drift: 1},
+		{Ts: t0.Add(2 * time.Minute), Set: 180, Drift: 3},
+	}
+
+	// as a vector, so north and east half each
+	set, drift, ok := meanCurrent(currents, t0, t0.Add(2*time.Minute))
+	if !ok || !approx(set, 45, TEST_TOLERANCE) || !approx(drift, math.Sqrt2/2, TEST_TOLERANCE) {
+		t.Errorf("got set %f drift %f %t, want 45 %f", set, drift, ok, math.Sqrt2/2)
+	}
+
+	// the end is left out, the start isnt
+	set, drift, ok = meanCurrent(currents, t0.Add(time.Minute), t0.Add(3*time.Minute))
+	if !ok || !approx(set, 180-math.Atan2(1, 3)*180/math.Pi, TEST_TOLERANCE) || !approx(drift, math.Hypot(1, 3)/2, TEST_TOLERANCE) {
+		t.Errorf("got set %f drift %f %t", set, drift, ok)
+	}
+
+	if _, _, ok := meanCurrent(currents, t0.Add(time.Hour), t0.Add(2*time.Hour)); ok {
+		t.Errorf("got a current with no readings")
+	}
+}
@@ -0,0 +1,241 @@
+package transform
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Engine and electrical data. These are only logged on deliveries when the engine is used and are written
+to their own collections (the sailing collection name plus one of the suffixes below) so that the sailing
+data queries dont have to wade through them.
+*/
+
+const ENGINE_RAPID_SUFFIX = "-engine-rapid"     // "Engine Parameters, Rapid Update" - RPM, ~10Hz
+const ENGINE_DYNAMIC_SUFFIX = "-engine-dynamic" // "Engine Parameters, Dynamic" - fuel rate, temps, hours, ~2Hz
+const BATTERY_SUFFIX = "-battery"               // "Battery Status" - voltage and current
+const DC_STATUS_SUFFIX = "-dc-status"           // "DC Detailed Status" - state of charge etc
+
+// Engine Parameters, Rapid Update
+
+type EngineMetadata_t struct {
+	DataSource string `bson:"source"`
+	Instance   string `bson:"instance"` // e.g. "Single Engine or Dual Engine Port"
+}
+
+type EngineRapidData_t struct {
+	Id            string           `bson:"_id,omitempty"`
+	Ts            time.Time        `bson:"ts"`
+	Metadata      EngineMetadata_t `bson:"metadata"`
+	Rpm           float64          `bson:"rpm"`
+	BoostPressure float64          `bson:"boostpressure,omitempty"`
+	TiltTrim      float64          `bson:"tilttrim,omitempty"`
+}
+
+func transformEngineRapid(input map[string]interface{}, w storage.Writer) {
+
+	var engine EngineRapidData_t
+
+	t, err := time.Parse(time.RFC3339, convertToDateFormat(input["timestamp"].(string)))
+	check(err)
+	engine.Ts = t
+
+	fields := input["fields"].(map[string]interface{})
+	engine.Metadata.DataSource = "engine ecu"
+	engine.Metadata.Instance = instanceName(fields["Instance"])
+
+	// the ecu doesnt send a speed when the engine is off, in which case there is nothing to store
+	rpm, ok := optionalFloat(fields, "Speed")
+	if !ok {
+		return
+	}
+	engine.Rpm = rpm
+	engine.BoostPressure, _ = optionalFloat(fields, "Boost Pressure")
+	engine.TiltTrim, _ = optionalFloat(fields, "Tilt/Trim")
+
+	bsonEngine, err := bson.Marshal(engine)
+	check(err)
+	w.Write(bsonEngine)
+}
+
+// Engine Parameters, Dynamic
+
+type EngineDynamicData_t struct {
+	Id                  string           `bson:"_id,omitempty"`
+	Ts                  time.Time        `bson:"ts"`
+	Metadata            EngineMetadata_t `bson:"metadata"`
+	FuelRate            float64          `bson:"fuelrate"`    // litres per hour
+	EngineHours         float64          `bson:"enginehours"` // total engine hours in seconds as reported by the ecu
+	OilPressure         float64          `bson:"oilpressure,omitempty"`
+	OilTemperature      float64          `bson:"oiltemp,omitempty"`
+	CoolantTemperature  float64          `bson:"coolanttemp,omitempty"`
+	AlternatorPotential float64          `bson:"alternatorvolts,omitempty"`
+	EngineLoad          float64          `bson:"engineload,omitempty"` // percent
+}
+
+func transformEngineDynamic(input map[string]interface{}, w storage.Writer) {
+
+	var engine EngineDynamicData_t
+
+	t, err := time.Parse(time.RFC3339, convertToDateFormat(input["timestamp"].(string)))
+	check(err)
+	engine.Ts = t
+
+	fields := input["fields"].(map[string]interface{})
+	engine.Metadata.DataSource = "engine ecu"
+	engine.Metadata.Instance = instanceName(fields["Instance"])
+
+	engine.FuelRate, _ = optionalFloat(fields, "Fuel Rate")
+	engine.EngineHours = engineHours(fields["Total Engine hours"])
+	engine.OilPressure, _ = optionalFloat(fields, "Oil pressure")
+	engine.OilTemperature, _ = optionalFloat(fields, "Oil temperature")
+	engine.CoolantTemperature, _ = optionalFloat(fields, "Temperature")
+	engine.AlternatorPotential, _ = optionalFloat(fields, "Alternator Potential")
+	engine.EngineLoad, _ = optionalFloat(fields, "Engine Load")
+
+	bsonEngine, err := bson.Marshal(engine)
+	check(err)
+	w.Write(bsonEngine)
+}
+
+// Battery Status
+
+type BatteryMetadata_t struct {
+	DataSource string `bson:"source"`
+	Instance   string `bson:"instance"` // battery bank number
+}
+
+type BatteryData_t struct {
+	Id          string            `bson:"_id,omitempty"`
+	Ts          time.Time         `bson:"ts"`
+	Metadata    BatteryMetadata_t `bson:"metadata"`
+	Voltage     float64           `bson:"voltage"`
+	Current     float64           `bson:"current"` // amps, negative when discharging
+	Temperature float64           `bson:"batterytemp,omitempty"`
+}
+
+func transformBatteryStatus(input map[string]interface{}, w storage.Writer) {
+
+	var battery BatteryData_t
+
+	t, err := time.Parse(time.RFC3339, convertToDateFormat(input["timestamp"].(string)))
+	check(err)
+	battery.Ts = t
+
+	fields := input["fields"].(map[string]interface{})
+	battery.Metadata.DataSource = "battery monitor"
+	battery.Metadata.Instance = instanceName(fields["Instance"])
+
+	voltage, ok := optionalFloat(fields, "Voltage")
+	if !ok {
+		return // a status without a voltage isnt much use
+	}
+	battery.Voltage = voltage
+	battery.Current, _ = optionalFloat(fields, "Current")
+	battery.Temperature, _ = optionalFloat(fields, "Temperature")
+
+	bsonBattery, err := bson.Marshal(battery)
+	check(err)
+	w.Write(bsonBattery)
+}
+
+// DC Detailed Status
+
+type DcStatusMetadata_t struct {
+	DataSource string `bson:"source"`
+	Instance   string `bson:"instance"`
+	DcType     string `bson:"dctype"` // Battery, Alternator, Converter, Solar Cell etc
+}
+
+type DcStatusData_t struct {
+	Id            string             `bson:"_id,omitempty"`
+	Ts            time.Time          `bson:"ts"`
+	Metadata      DcStatusMetadata_t `bson:"metadata"`
+	StateOfCharge float64            `bson:"soc"`                     // percent
+	StateOfHealth float64            `bson:"soh,omitempty"`           // percent
+	TimeRemaining float64            `bson:"timeremaining,omitempty"` // seconds
+	RippleVoltage float64            `bson:"ripplevoltage,omitempty"`
+}
+
+func transformDcDetailedStatus(input map[string]interface{}, w storage.Writer) {
+
+	var dc DcStatusData_t
+
+	t, err := time.Parse(time.RFC3339, convertToDateFormat(input["timestamp"].(string)))
+	check(err)
+	dc.Ts = t
+
+	fields := input["fields"].(map[string]interface{})
+	dc.Metadata.DataSource = "battery monitor"
+	dc.Metadata.Instance = instanceName(fields["Instance"])
+	dc.Metadata.DcType = instanceName(fields["DC Type"])
+
+	dc.StateOfCharge, _ = optionalFloat(fields, "State of Charge")
+	dc.StateOfHealth, _ = optionalFloat(fields, "State of Health")
+	dc.TimeRemaining = engineHours(fields["Time Remaining"]) // same hh:mm:ss or seconds format as engine hours
+	dc.RippleVoltage, _ = optionalFloat(fields, "Ripple Voltage")
+
+	bsonDc, err := bson.Marshal(dc)
+	check(err)
+	w.Write(bsonDc)
+}
+
+// helpers for the engine and electrical PGNs, which are far less consistent about which fields
+// are present than the sailing instruments.
+
+// returns the named field as a float and whether it was present.
+func optionalFloat(fields map[string]interface{}, name string) (float64, bool) {
+	val, ok := fields[name].(float64)
+	return val, ok
+}
+
+// enumerated fields come out of the analyzer as either a plain string, a number or (in newer versions)
+// a map with a "name" entry - the same as the wind "Reference" field.
+func instanceName(v interface{}) string {
+
+	switch val := v.(type) {
+	case string:
+		return val
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case map[string]interface{}:
+		if name, ok := val["name"].(string); ok {
+			return name
+		}
+		if value, ok := val["value"].(float64); ok {
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		}
+	}
+	return ""
+}
+
+// durations are either a number of seconds or a "hhhh:mm:ss" string depending on the analyzer version.
+// Returns the duration in seconds, or 0 if it cant be read.
+func engineHours(v interface{}) float64 {
+
+	switch val := v.(type) {
+	case float64:
+		return val
+	case string:
+		parts := strings.Split(val, ":")
+		if len(parts) != 3 {
+			if debug {
+				fmt.Printf("unrecognised duration format %s\n", val)
+			}
+			return 0
+		}
+		h, errH := strconv.ParseFloat(parts[0], 64)
+		m, errM := strconv.ParseFloat(parts[1], 64)
+		s, errS := strconv.ParseFloat(parts[2], 64)
+		if errH != nil || errM != nil || errS != nil {
+			return 0
+		}
+		return h*3600 + m*60 + s
+	}
+	return 0
+}
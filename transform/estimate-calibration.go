@@ -0,0 +1,463 @@
+package transform
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+	"github.com/m-h-w/nmea-logger/wind"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Estimating calibration from sailing data
+----------------------------------------
+Works out a calibration profile (see calibration.go) from sessions that have already been imported, for review
+before it is added with -addcal. Everything is estimated from the raw readings, so the profile replaces any
+calibration the sessions were imported with rather than adding to it.
+
+The sessions are cut into CAL_WINDOW long windows and only the windows where the boat was sailing steadily
+(heading and boatspeed not changing much) are used:
+
+	- boatspeed: speed over the ground along the heading / STW, from pairs of windows sailed on reciprocal
+	  headings (within RECIPROCAL_ANGLE) close together in the same session. The track is taken as the heading
+	  plus the difference between them for the whole session, which is deviation and variation. A current in
+	  line with the boat speeds one window up as much as it slows the other down, so adding the two together
+	  takes it out, and taking the speed along the heading leaves out the current across it. Binned by
+	  boatspeed and by which way the boat is heeled, so both windows have to be heeled the same way and be
+	  within SPEED_BIN of each other.
+	- deviation: COG - heading - leeway, binned by heading. Any current across the track ends up in this too,
+	  which is why sailing a few different headings in a few different places gives the best estimate.
+	- upwash: TWD should be the same on both tacks. If the wind angle reads too wide the TWD swings one way on
+	  starboard and the other way on port, so comparing the windows either side of each tack gives the error
+	  in TWA, which is turned into a correction to the apparent wind angle. Binned by TWS. A masthead unit that
+	  is turned on the mast moves the TWD the same way on both tacks so cant be seen like this, the offset is
+	  left at 0.
+
+Each table entry comes with how many windows it came from, their spread and the standard error of the
+estimate, so a table built from a handful of windows can be spotted and left out.
+*/
+
+const CAL_WINDOW = 30 * time.Second
+
+const RECIPROCAL_ANGLE = 10.0                // degrees, how far off the reciprocal of each other two headings can be
+const RECIPROCAL_PAIR_GAP = 20 * time.Minute // the current changes slowly, so the windows can be this far apart
+
+const STEADY_HEADING = 5.0 // degrees, the most the heading can wander in a window that is used
+const STEADY_SPEED = 0.15  // m/s, the most the boatspeed can wander in a window that is used
+const MIN_SPEED = 1.0      // m/s, below which the boat is drifting rather than sailing
+const MIN_READINGS = 10    // of each reading needed for a window to be used
+const MIN_BIN_SAMPLES = 3  // windows needed for a table entry
+const TACK_PAIR_GAP = 5 * time.Minute
+const UPWIND_ANGLE = 70.0 // degrees either side of the bow, the most TWA that counts as upwind for the tack pairs
+
+const SPEED_BIN = 2.0    // knots
+const HEADING_BIN = 30.0 // degrees
+const TWS_BIN = 4.0      // knots
+
+// how good a table entry is
+type Confidence_t struct {
+	X      float64 `json:"x"`
+	Heel   float64 `json:"heel,omitempty"` // for boatspeed, the mean heel of the windows
+	Value  float64 `json:"value"`
+	N      int     `json:"n"`      // windows the value came from
+	StdDev float64 `json:"stdDev"` // of the windows
+	StdErr float64 `json:"stdErr"` // of the value
+}
+
+type CalibrationEstimate_t struct {
+	Profile   Calibration_t  `json:"profile"`
+	Sessions  []string       `json:"sessions"`
+	Windows   int            `json:"windows"` // steady windows found
+	BoatSpeed []Confidence_t `json:"boatSpeed"`
+	Deviation []Confidence_t `json:"deviation"`
+	Upwash    []Confidence_t `json:"upwash"`
+	Notes     []string       `json:"notes,omitempty"` // anything that should be known when reviewing the estimate
+}
+
+// the readings averaged over a window
+type calWindow_t struct {
+	session   string
+	start     time.Time
+	stw       float64 // m/s
+	heading   float64 // magnetic
+	variation float64
+	heel      float64
+	sog       float64
+	cog       float64
+	awa       float64
+	aws       float64
+	hasGround bool // sog and cog
+	hasWind   bool
+}
+
+// Estimates a calibration profile for boat from the sessions.
+func EstimateCalibration(sessions []string, boat string) (CalibrationEstimate_t, error) {
+
+	est := CalibrationEstimate_t{Sessions: sessions, Profile: Calibration_t{Boat: boat}}
+
+	store := storage.Open()
+	defer store.Close()
+
+	var windows []calWindow_t
+	hasVariation := false
+	for _, session := range sessions {
+		w, variation, err := steadyWindows(store, session)
+		if err != nil {
+			return est, err
+		}
+		windows = append(windows, w...)
+		hasVariation = hasVariation || variation
+	}
+	est.Windows = len(windows)
+	if len(windows) == 0 {
+		return est, fmt.Errorf("no steady sailing found in %v", sessions)
+	}
+	if !hasVariation {
+		est.Notes = append(est.Notes, "the compass gave no variation so the deviation includes it")
+	}
+
+	// each estimate uses the ones before it, so the tables are put in order for looking up as they are made
+	est.estimateBoatSpeed(windows)
+	est.Profile.sortTables()
+	est.estimateDeviation(windows)
+	est.Profile.sortTables()
+	est.estimateUpwash(windows)
+
+	est.Profile.Notes = fmt.Sprintf("estimated from %v, %d steady windows", sessions, len(windows))
+	est.Profile.sortTables()
+	return est, nil
+}
+
+// Cuts a session into windows and returns the steady ones, and whether the compass gave the variation.
+func steadyWindows(store storage.Store, session string) ([]calWindow_t, bool, error) {
+
+	cursor, err := store.Range(session, "", time.Time{}, time.Time{})
+	if err != nil {
+		return nil, false, err
+	}
+	defer cursor.Close()
+
+	var windows []calWindow_t
+	hasVariation := false
+	var b *bucket_t
+
+	for cursor.Next() {
+		doc := cursor.Current()
+		ts, ok := doc.Lookup(FIELD_TS).TimeOK()
+		if !ok {
+			continue
+		}
+		if start := ts.Truncate(CAL_WINDOW); b == nil || !b.start.Equal(start) {
+			if w, ok := steadyWindow(b); ok {
+				windows = append(windows, w)
+			}
+			b = newBucket(start, "")
+		}
+
+		// the raw readings, as the estimate replaces any calibration already applied
+		if v, ok := rawOrReading(doc, FIELD_BOATSPEED, "rawboatspeed"); ok {
+			b.add(FIELD_BOATSPEED, v)
+		}
+		if v, ok := rawOrReading(doc, FIELD_MAG_HEADING, "rawheading"); ok {
+			b.add(FIELD_MAG_HEADING, v)
+			if variation, ok := variationOf(doc); ok {
+				b.add("magvar", variation)
+				hasVariation = true
+			}
+		}
+		if ref, _ := doc.Lookup(FIELD_METADATA, "reference").StringValueOK(); ref == "Apparent" {
+			awa, ok := rawOrReading(doc, FIELD_WIND_ANGLE, "rawangle")
+			aws, ok2 := rawOrReading(doc, FIELD_WIND_SPEED, "rawspeed")
+			if ok && ok2 {
+				b.add(FIELD_WIND_ANGLE, awa)
+				b.add(FIELD_WIND_SPEED, aws)
+			}
+		}
+		for _, field := range []string{FIELD_ROLL, FIELD_SOG, FIELD_COG} {
+			if v, ok := doc.Lookup(field).DoubleOK(); ok {
+				b.add(field, v)
+			}
+		}
+	}
+	if w, ok := steadyWindow(b); ok {
+		windows = append(windows, w)
+	}
+	for i := range windows {
+		windows[i].session = session
+	}
+	return windows, hasVariation, cursor.Err()
+}
+
+// the raw reading in the metadata if the document has been calibrated, otherwise the reading
+func rawOrReading(doc bson.Raw, field string, rawField string) (float64, bool) {
+
+	v, ok := doc.Lookup(field).DoubleOK()
+	if !ok {
+		return 0, false
+	}
+	if raw, ok := doc.Lookup(FIELD_METADATA, rawField).DoubleOK(); ok {
+		return raw, true
+	}
+	return v, true
+}
+
+// averages a window, returning false if the boat wasnt sailing steadily through it
+func steadyWindow(b *bucket_t) (calWindow_t, bool) {
+
+	if b == nil {
+		return calWindow_t{}, false
+	}
+	stw := Aggregate(FIELD_BOATSPEED, b.values[FIELD_BOATSPEED])
+	heading := Aggregate(FIELD_MAG_HEADING, b.values[FIELD_MAG_HEADING])
+	if stw.N < MIN_READINGS || heading.N < MIN_READINGS ||
+		stw.Mean < MIN_SPEED || stw.StdDev > STEADY_SPEED || heading.StdDev > STEADY_HEADING {
+		return calWindow_t{}, false
+	}
+
+	w := calWindow_t{start: b.start, stw: stw.Mean, heading: heading.Mean}
+	w.variation = Aggregate("magvar", b.values["magvar"]).Mean
+	w.heel = Aggregate(FIELD_ROLL, b.values[FIELD_ROLL]).Mean
+
+	sog, cog := Aggregate(FIELD_SOG, b.values[FIELD_SOG]), Aggregate(FIELD_COG, b.values[FIELD_COG])
+	if sog.N >= MIN_READINGS && cog.N >= MIN_READINGS && sog.Mean >= MIN_SPEED {
+		w.sog, w.cog, w.hasGround = sog.Mean, cog.Mean, true
+	}
+	awa, aws := Aggregate(FIELD_WIND_ANGLE, b.values[FIELD_WIND_ANGLE]), Aggregate(FIELD_WIND_SPEED, b.values[FIELD_WIND_SPEED])
+	if awa.N >= MIN_READINGS && aws.N >= MIN_READINGS {
+		w.awa, w.aws, w.hasWind = awa.Mean, aws.Mean, true
+	}
+	return w, true
+}
+
+// ground speed / STW from windows on reciprocal headings, by boatspeed and which way the boat is heeled
+func (est *CalibrationEstimate_t) estimateBoatSpeed(windows []calWindow_t) {
+
+	// the difference between track and heading over the whole session is deviation and variation, not current
+	var offsets []float64
+	for _, w := range windows {
+		if w.hasGround {
+			offsets = append(offsets, angleDifference(w.cog, w.heading))
+		}
+	}
+	if len(offsets) == 0 {
+		est.Notes = append(est.Notes, "no SOG and COG so no boatspeed or deviation estimate")
+		return
+	}
+	offset := median(offsets)
+
+	type key_t struct {
+		side int // -1 heeled to port, 1 to starboard
+		bin  float64
+	}
+	side := func(w calWindow_t) int {
+		if w.heel < 0 {
+			return -1
+		}
+		return 1
+	}
+
+	// the speed over the ground along the heading, leeway is small enough to leave out
+	along := func(w calWindow_t) float64 {
+		return w.sog * math.Cos(angleDifference(w.cog, w.heading+offset)*math.Pi/180)
+	}
+
+	// each window is paired with the next one on the reciprocal heading. The sessions follow on from each other
+	// in the list, as for the upwash.
+	factors := map[key_t][]float64{}
+	heels := map[int][]float64{}
+	for i, a := range windows {
+		if !a.hasGround {
+			continue
+		}
+		for _, b := range windows[i+1:] {
+			gap := b.start.Sub(a.start)
+			if b.session != a.session || gap <= 0 || gap > RECIPROCAL_PAIR_GAP {
+				break
+			}
+			if !b.hasGround || side(b) != side(a) || math.Abs(b.stw-a.stw)*MS2KNOTS > SPEED_BIN ||
+				math.Abs(angleDifference(b.heading, a.heading+180)) > RECIPROCAL_ANGLE {
+				continue
+			}
+			k := key_t{side(a), binCentre((a.stw+b.stw)/2*MS2KNOTS, SPEED_BIN)}
+			factors[k] = append(factors[k], (along(a)+along(b))/(a.stw+b.stw))
+			heels[k.side] = append(heels[k.side], (a.heel+b.heel)/2)
+			break
+		}
+	}
+	if len(factors) == 0 {
+		est.Notes = append(est.Notes, "no windows on reciprocal headings to take the current out with, so no boatspeed estimate")
+	}
+
+	for _, side := range []int{-1, 1} {
+		if len(heels[side]) == 0 {
+			continue
+		}
+		heel := linearStats(heels[side]).Mean
+		table := BoatSpeedTable_t{Heel: heel}
+		for k, f := range factors {
+			if k.side != side {
+				continue
+			}
+			c := confidence(k.bin, f, false)
+			c.Heel = heel
+			est.BoatSpeed = append(est.BoatSpeed, c)
+			if c.N >= MIN_BIN_SAMPLES {
+				table.Factors = append(table.Factors, TablePoint_t{k.bin, c.Value})
+			}
+		}
+		if len(table.Factors) != 0 {
+			est.Profile.BoatSpeed = append(est.Profile.BoatSpeed, table)
+		}
+	}
+	if len(est.Profile.BoatSpeed) == 1 {
+		est.Notes = append(est.Notes, "boatspeed was only estimated with the boat heeled one way")
+	}
+	sortConfidence(est.BoatSpeed)
+}
+
+// COG - heading - leeway, by heading
+func (est *CalibrationEstimate_t) estimateDeviation(windows []calWindow_t) {
+
+	deviations := map[float64][]float64{}
+	for _, w := range windows {
+		if !w.hasGround {
+			continue
+		}
+		leeway := 0.0
+		if w.hasWind {
+			leeway = wind.EstimateLeeway(w.awa, w.heel, est.Profile.boatSpeed(w.stw, w.heel)*MS2KNOTS, WindCorrection.Leeway)
+		}
+		bin := normaliseDegrees(binCentre(w.heading, HEADING_BIN))
+		deviations[bin] = append(deviations[bin], angleDifference(w.cog, w.heading+w.variation+leeway))
+	}
+
+	for bin, d := range deviations {
+		c := confidence(bin, d, true)
+		est.Deviation = append(est.Deviation, c)
+		if c.N >= MIN_BIN_SAMPLES {
+			est.Profile.Deviation = append(est.Profile.Deviation, TablePoint_t{bin, c.Value})
+		}
+	}
+	sortConfidence(est.Deviation)
+}
+
+// compares TWD either side of each tack, by TWS
+func (est *CalibrationEstimate_t) estimateUpwash(windows []calWindow_t) {
+
+	// the true wind for each window, with the boatspeed and deviation just estimated
+	type tw_t struct {
+		session string
+		start   time.Time
+		in      wind.Apparent_t
+		tw      wind.True_t
+	}
+	var upwind []tw_t
+	for _, w := range windows {
+		if !w.hasWind {
+			continue
+		}
+		in := wind.Apparent_t{
+			Awa:     w.awa,
+			Aws:     w.aws,
+			Stw:     est.Profile.boatSpeed(w.stw, w.heel),
+			Heading: est.Profile.heading(w.heading) + w.variation,
+			Heel:    w.heel,
+		}
+		in.Leeway = wind.EstimateLeeway(in.Awa, w.heel, in.Stw*MS2KNOTS, WindCorrection.Leeway)
+		tw := wind.TrueWind(in)
+		if math.Abs(angleDifference(tw.Twa, 0)) <= UPWIND_ANGLE {
+			upwind = append(upwind, tw_t{w.session, w.start, in, tw})
+		}
+	}
+
+	// windows next to each other in the same session on opposite tacks, not too far apart. The sessions follow
+	// on from each other in the list, so the gap between the last window of one and the first of the next can
+	// be anything, including negative.
+	corrections := map[float64][]float64{}
+	for i := 1; i < len(upwind); i++ {
+		a, b := upwind[i-1], upwind[i]
+		gap := b.start.Sub(a.start)
+		if a.session != b.session || gap <= 0 || gap > TACK_PAIR_GAP || (a.tw.Twa < 180) == (b.tw.Twa < 180) {
+			continue
+		}
+		stbd, port := a, b
+		if a.tw.Twa >= 180 {
+			stbd, port = b, a
+		}
+
+		// if the angle reads too wide, starboard TWD is clockwise of port by twice the error
+		twaError := angleDifference(stbd.tw.Twd, port.tw.Twd) / 2
+
+		// turn the TWA error into an AWA correction with how much TWA moves with AWA
+		sensitivity := twaSensitivity(stbd.in)
+		if sensitivity < 0.1 {
+			continue
+		}
+		tws := (stbd.tw.Tws + port.tw.Tws) / 2 * MS2KNOTS
+		bin := binCentre(tws, TWS_BIN)
+		corrections[bin] = append(corrections[bin], -twaError/sensitivity)
+	}
+
+	for bin, e := range corrections {
+		c := confidence(bin, e, false)
+		est.Upwash = append(est.Upwash, c)
+		if c.N >= MIN_BIN_SAMPLES {
+			est.Profile.Upwash = append(est.Profile.Upwash, TablePoint_t{bin, c.Value})
+		}
+	}
+	if len(corrections) == 0 {
+		est.Notes = append(est.Notes, "no tacks found to compare TWD on either side of, so no upwash estimate")
+	}
+	sortConfidence(est.Upwash)
+}
+
+// how many degrees TWA moves for a degree of AWA
+func twaSensitivity(in wind.Apparent_t) float64 {
+
+	plus, minus := in, in
+	plus.Awa += 0.5
+	minus.Awa -= 0.5
+	return math.Abs(angleDifference(wind.TrueWind(plus).Twa, wind.TrueWind(minus).Twa))
+}
+
+func confidence(x float64, values []float64, circular bool) Confidence_t {
+
+	st := linearStats(values)
+	if circular {
+		st = circularStats(values)
+		st.Mean = angleDifference(st.Mean, 0) // deviations either side of 0 rather than 0 to 360
+	}
+	c := Confidence_t{X: x, Value: st.Mean, N: st.N, StdDev: st.StdDev}
+	if st.N > 1 {
+		c.StdErr = st.StdDev / math.Sqrt(float64(st.N-1))
+	}
+	return c
+}
+
+func sortConfidence(c []Confidence_t) {
+	sort.Slice(c, func(i, j int) bool {
+		if c[i].Heel != c[j].Heel {
+			return c[i].Heel < c[j].Heel
+		}
+		return c[i].X < c[j].X
+	})
+}
+
+// the middle of the bin v falls in
+func binCentre(v float64, size float64) float64 {
+	return math.Floor(v/size)*size + size/2
+}
+
+func median(values []float64) float64 {
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
@@ -0,0 +1,43 @@
+package transform
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// a boat sailing up and down a tidal stream: the current helps on one heading and hinders on the other, but the
+// boatspeed factor comes out the same
+func TestEstimateBoatSpeed(t *testing.T) {
+
+	const factor, stw, current = 1.05, 3.0, 0.5
+
+	var windows []calWindow_t
+	for i := 0; i < 8; i++ {
+		w := calWindow_t{session: "test", start: testGun.Add(time.Duration(i) * time.Minute), stw: stw, heel: 10, hasGround: true}
+		w.heading, w.cog, w.sog = 0, 0, factor*stw+current
+		if i%2 == 1 {
+			w.heading, w.cog, w.sog = 180, 180, factor*stw-current
+		}
+		windows = append(windows, w)
+	}
+
+	var est CalibrationEstimate_t
+	est.estimateBoatSpeed(windows)
+	if len(est.Profile.BoatSpeed) != 1 || len(est.Profile.BoatSpeed[0].Factors) != 1 {
+		t.Fatalf("got %+v, want one table with one factor", est.Profile.BoatSpeed)
+	}
+	if got := est.Profile.BoatSpeed[0].Factors[0]; math.Abs(got.Y-factor) > TEST_TOLERANCE || got.X != binCentre(stw*MS2KNOTS, SPEED_BIN) {
+		t.Errorf("got %+v, want %f at %f knots", got, factor, binCentre(stw*MS2KNOTS, SPEED_BIN))
+	}
+
+	// all on one heading there is nothing to take the current out with
+	est = CalibrationEstimate_t{}
+	for i := range windows {
+		windows[i].heading, windows[i].cog = 0, 0
+	}
+	est.estimateBoatSpeed(windows)
+	if len(est.Profile.BoatSpeed) != 0 {
+		t.Errorf("got %+v from one heading, want nothing", est.Profile.BoatSpeed)
+	}
+}
@@ -0,0 +1,294 @@
+package transform
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+)
+
+/*
+Following the live logger
+-------------------------
+The logger on the pi (pi/logger.go) writes the analyzer output to a file named after the date, e.g.
+/home/pi/logger/2021-07-09, with -1, -2 etc. added when the logger is restarted on the same day. FollowLogger
+tails the file the logger is writing to, moves on to the next one when the logger starts a new file, and
+ingests the data into the store as it arrives rather than waiting for a -t -file run back on shore.
+
+Where it has got to is checkpointed in the store (file and byte offset of the last line written) every
+PROGRESS_INTERVAL, once everything before it has been flushed to the store. When FollowLogger is restarted
+it carries on from the checkpoint. Anything between the checkpoint and where it stopped is read again, which
+is harmless as documents already written are skipped (see mongodb/reliable-insert.go).
+
+The pi has no real time clock so its file times and names can't be relied on to be in order. A new file is
+spotted by it not having been there before rather than by its time or its name.
+*/
+
+const CHECKPOINT_CATALOG = storage.CATALOG_PREFIX + "checkpoints"
+
+const TAIL_POLL = time.Second // how often to look for more data when there isnt any
+
+// file names used by the logger: yyyy-mm-dd with an optional -n
+var loggerFileName = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}(-\d+)?$`)
+
+type Checkpoint_t struct {
+	Collection string    `bson:"_id" json:"collection"`
+	File       string    `bson:"file" json:"file"`
+	Offset     int64     `bson:"offset" json:"offset"`
+	Updated    time.Time `bson:"updated" json:"updated"`
+}
+
+// Tails the logger files in dir into collection until stop is closed, carrying on from the last checkpoint
+// if there is one.
+func FollowLogger(dir string, collection string, details SessionDetails_t, stop <-chan struct{}) error {
+
+	store := storage.Open()
+	defer store.Close()
+
+	start := Position_t{}
+	var cp Checkpoint_t
+	err := store.Get(CHECKPOINT_CATALOG, collection, &cp)
+	switch {
+	case err == nil:
+		if _, statErr := os.Stat(cp.File); statErr == nil {
+			start = Position_t{File: cp.File, Offset: cp.Offset}
+			fmt.Printf("carrying on from %s at %d\r\n", cp.File, cp.Offset)
+		} else {
+			log.Printf("checkpoint file %s has gone, starting again: %s\n", cp.File, statErr)
+		}
+	case err != storage.ErrNotFound:
+		return err
+	}
+
+	t, err := newTailer(dir, start)
+	if err != nil {
+		return err
+	}
+
+	lines := make(chan LogLine_t, PIPELINE_CHUNK)
+	go t.run(lines, stop)
+
+	transformChannel(store, lines, collection, details)
+	return nil
+}
+
+// Flushes everything handled so far to the store, updates the catalog and, if the lines say where they came
+// from, records the position of the last one so it can be carried on from. Called every PROGRESS_INTERVAL by
+// the pipeline.
+func (in *ingest_t) checkpoint() {
+
+	if in.pos == in.checkpointed {
+		return // nothing new
+	}
+
+	in.finish("", "") // the source is the logger files, which are still being written
+
+	if in.pos.File != "" {
+		cp := Checkpoint_t{Collection: in.collection, File: in.pos.File, Offset: in.pos.Offset, Updated: time.Now().UTC()}
+		if err := in.store.Put(CHECKPOINT_CATALOG, in.collection, cp); err != nil {
+			log.Printf("unable to save checkpoint for %s: %s\n", in.collection, err)
+			return
+		}
+	}
+	in.checkpointed = in.pos
+}
+
+// Tailing the logger files
+
+type tailer_t struct {
+	dir     string
+	path    string // file being read
+	file    *os.File
+	reader  *bufio.Reader
+	offset  int64           // of the end of the last whole line read
+	partial string          // the start of a line the logger hasnt finished writing
+	known   map[string]bool // logger files that were there when we last looked
+}
+
+// Opens the file to start from. With no file given that is the one the logger last wrote to.
+func newTailer(dir string, start Position_t) (*tailer_t, error) {
+
+	t := &tailer_t{dir: dir, known: map[string]bool{}}
+
+	files, err := t.loggerFiles()
+	if err != nil {
+		return nil, err
+	}
+	var first, newest os.FileInfo
+	for _, f := range files {
+		if newest == nil || f.ModTime().After(newest.ModTime()) {
+			newest = f
+		}
+		if start.File != "" && f.Name() == filepath.Base(start.File) {
+			first = f
+		}
+	}
+	if first == nil {
+		if newest == nil {
+			return nil, fmt.Errorf("no logger files in %s", dir)
+		}
+		first, start.Offset = newest, 0
+	}
+	start.File = filepath.Join(dir, first.Name())
+
+	// the files written since the one we're starting from are still to be read, so arent known yet.
+	// The file times might be wrong but it is the best there is to go on.
+	for _, f := range files {
+		if !f.ModTime().After(first.ModTime()) {
+			t.known[f.Name()] = true
+		}
+	}
+
+	if err := t.open(start.File, start.Offset); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tailer_t) open(path string, offset int64) error {
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	if t.file != nil {
+		t.file.Close()
+	}
+	t.path, t.file, t.reader, t.offset, t.partial = path, f, bufio.NewReader(f), offset, ""
+	fmt.Printf("following %s from %d\r\n", path, offset)
+	return nil
+}
+
+// Sends lines to out as the logger writes them until stop is closed, then closes out.
+func (t *tailer_t) run(out chan<- LogLine_t, stop <-chan struct{}) {
+
+	defer close(out)
+	defer t.file.Close()
+
+	for {
+		if !t.readLines(out, stop) {
+			return
+		}
+
+		// at the end of the file: see if the logger has started a new one, or this one has been replaced
+		switched, err := t.checkFiles(out, stop)
+		if err != nil {
+			log.Printf("error following %s: %s\n", t.path, err)
+		}
+		if switched {
+			continue
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(TAIL_POLL):
+		}
+	}
+}
+
+// Sends each whole line there is to read. Returns false if stop was closed.
+func (t *tailer_t) readLines(out chan<- LogLine_t, stop <-chan struct{}) bool {
+
+	for {
+		s, err := t.reader.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("error reading %s: %s\n", t.path, err)
+			}
+			t.partial += s // wait for the logger to finish the line
+			return true
+		}
+
+		line := t.partial + s
+		t.partial = ""
+		t.offset += int64(len(line))
+
+		select {
+		case out <- LogLine_t{Text: strings.TrimRight(line, "\r\n"), Position_t: Position_t{File: t.path, Offset: t.offset}}:
+		case <-stop:
+			return false
+		}
+	}
+}
+
+// Looks for the logger having moved on to a new file, or the current one having been truncated or
+// replaced. Returns true if it has started reading another file.
+func (t *tailer_t) checkFiles(out chan<- LogLine_t, stop <-chan struct{}) (bool, error) {
+
+	current, err := t.file.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	// truncated, start again at the beginning
+	if current.Size() < t.offset+int64(len(t.partial)) {
+		log.Printf("%s has been truncated, reading it again\n", t.path)
+		return true, t.open(t.path, 0)
+	}
+
+	// replaced by a new file with the same name
+	if named, err := os.Stat(t.path); err == nil && !os.SameFile(current, named) {
+		return true, t.open(t.path, 0)
+	}
+
+	files, err := t.loggerFiles()
+	if err != nil {
+		return false, err
+	}
+	var next os.FileInfo
+	for _, f := range files {
+		if !t.known[f.Name()] && (next == nil || f.ModTime().Before(next.ModTime())) {
+			next = f
+		}
+	}
+	if next == nil {
+		return false, nil
+	}
+
+	// the logger has moved on so the last of this file has been written. Read it before moving on and send
+	// any last line the logger didnt finish.
+	if !t.readLines(out, stop) {
+		return false, nil
+	}
+	if t.partial != "" {
+		t.offset += int64(len(t.partial))
+		select {
+		case out <- LogLine_t{Text: t.partial, Position_t: Position_t{File: t.path, Offset: t.offset}}:
+		case <-stop:
+			return false, nil
+		}
+	}
+
+	t.known[next.Name()] = true
+	return true, t.open(filepath.Join(t.dir, next.Name()), 0)
+}
+
+func (t *tailer_t) loggerFiles() ([]os.FileInfo, error) {
+
+	entries, err := ioutil.ReadDir(t.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []os.FileInfo
+	for _, e := range entries {
+		if e.Mode().IsRegular() && loggerFileName.MatchString(e.Name()) {
+			files = append(files, e)
+		}
+	}
+	return files, nil
+}
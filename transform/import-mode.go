@@ -0,0 +1,145 @@
+package transform
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+)
+
+/*
+Import modes
+------------
+What to do when the collection being written to already exists:
+
+fail      - stop without writing anything. This is the default and what the tools have always done.
+overwrite - drop the collection, and for an import the collections derived from it, then write it again.
+append    - write into the existing collection. Documents already there are skipped because their _id is a
+            hash of their contents (see mongodb/reliable-insert.go), so importing the same file twice is harmless.
+resume    - carry on from the last timestamp written, for an import that stopped half way through e.g.
+            because the network dropped. It starts a little before the last timestamp, see RESUME_OVERLAP.
+*/
+
+type ImportMode_t string
+
+const (
+	MODE_FAIL      ImportMode_t = "fail"
+	MODE_OVERWRITE ImportMode_t = "overwrite"
+	MODE_APPEND    ImportMode_t = "append"
+	MODE_RESUME    ImportMode_t = "resume"
+)
+
+// Batches are inserted concurrently and retried with backoff, so when an import stops the last timestamp in
+// the collection may be from a batch that overtook earlier ones still being retried. Resuming a few minutes
+// early covers those. The overlap costs nothing but time as the documents already written are skipped.
+const RESUME_OVERLAP = 5 * time.Minute
+
+func ParseImportMode(mode string) (ImportMode_t, error) {
+
+	switch m := ImportMode_t(mode); m {
+	case MODE_FAIL, MODE_OVERWRITE, MODE_APPEND, MODE_RESUME:
+		return m, nil
+	}
+	return MODE_FAIL, fmt.Errorf("unknown mode %q, expected fail, overwrite, append or resume", mode)
+}
+
+// the suffixes of the collections an import writes to alongside the main one
+var importSuffixes = []string{ENGINE_RAPID_SUFFIX, ENGINE_DYNAMIC_SUFFIX, BATTERY_SUFFIX, DC_STATUS_SUFFIX}
+
+// Gets an import's collections ready for the mode. Returns the time to resume from, which is zero unless
+// the mode is resume and there is something to resume.
+func prepareImport(store storage.Store, collection string, mode ImportMode_t) (time.Time, error) {
+
+	cols := []string{collection}
+	for _, suffix := range importSuffixes {
+		cols = append(cols, collection+suffix)
+	}
+
+	switch mode {
+	case MODE_FAIL:
+		if storage.Exists(store, collection) {
+			return time.Time{}, fmt.Errorf("collection %s exists already", collection)
+		}
+
+	case MODE_OVERWRITE:
+		// the low res views etc. were built from the old data so go as well
+		session, err := LoadSession(store, collection)
+		if err != nil {
+			return time.Time{}, err
+		}
+		for _, col := range session.Collections {
+			cols = append(cols, col)
+		}
+		for _, col := range cols {
+			if err := store.Drop(col); err != nil {
+				return time.Time{}, err
+			}
+		}
+
+		// keep the hand entered details but start the rest of the catalog entry again
+		session.Start, session.End, session.BoundingBox, session.Instruments = time.Time{}, time.Time{}, BoundingBox_t{}, nil
+		session.Collections = map[string]string{}
+		return time.Time{}, SaveSession(store, session)
+
+	case MODE_RESUME:
+		var last time.Time
+		for _, col := range cols {
+			ts, err := lastTimestamp(store, col)
+			if err != nil {
+				return time.Time{}, err
+			}
+			if ts.After(last) {
+				last = ts
+			}
+		}
+		if !last.IsZero() {
+			return last.Add(-RESUME_OVERLAP), nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// Gets a derived collection such as a low res view ready for the mode. Returns the time to resume from, as
+// prepareImport.
+func prepareDerived(store storage.Store, collection string, mode ImportMode_t) (time.Time, error) {
+
+	switch mode {
+	case MODE_FAIL:
+		if storage.Exists(store, collection) {
+			return time.Time{}, fmt.Errorf("collection %s exists already", collection)
+		}
+
+	case MODE_OVERWRITE:
+		return time.Time{}, store.Drop(collection)
+
+	case MODE_RESUME:
+		// derived collections are built in one pass from data that is already in the store, so there is
+		// nothing to overlap. The documents at the last timestamp can be from a bucket that was only part
+		// built, and rebuilding it would be skipped as a duplicate as its _id comes from its start, so
+		// they go and are built again whole.
+		last, err := lastTimestamp(store, collection)
+		if err != nil || last.IsZero() {
+			return last, err
+		}
+		return last, deleteAt(store, collection, last)
+	}
+	return time.Time{}, nil
+}
+
+// deletes the documents in a collection with the timestamp ts
+func deleteAt(store storage.Store, collection string, ts time.Time) error {
+	return store.DeleteRange(collection, ts, ts)
+}
+
+// the timestamp of the newest document in a collection, or zero if it is empty or doesnt exist
+func lastTimestamp(store storage.Store, collection string) (time.Time, error) {
+
+	var last []struct {
+		Ts time.Time `bson:"ts"`
+	}
+	_, err := store.Query(storage.RangeQuery_t{Collection: collection, Descending: true, Limit: 1}, &last)
+	if err != nil || len(last) == 0 {
+		return time.Time{}, err
+	}
+	return last[0].Ts, nil
+}
@@ -0,0 +1,197 @@
+package transform
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+)
+
+/*
+Ingest
+------
+Turns decoded logger documents into documents in the store for one session. The documents can come from a
+whole logger file (TransformToMongoFormat), any io.Reader (TransformStream) or a channel of lines such as
+the live logger output (TransformChannel, FollowLogger in follow.go). They all end up here so they all
+write the same thing.
+*/
+
+type ingest_t struct {
+	store      storage.Store
+	collection string
+	details    SessionDetails_t
+	resumeFrom time.Time // documents before this are skipped, see import-mode.go
+
+	// the sailing instruments all go to the one collection. The engine and electrical collections are only
+	// created if that data turns up. Everything written is used to build the catalog entry.
+	w       storage.Writer
+	stats   *sessionStats_t
+	derived []string // the engine and electrical collections used, for the catalog
+
+	instruments instruments_t      // latest readings for working out the true wind, see truewind.go
+	current     currentEstimator_t // the smoothed tidal current, see current.go
+	calibration *Calibration_t     // applied to the readings, nil if the boat hasnt got a profile. See calibration.go
+
+	pos          Position_t // of the last line handled
+	checkpointed Position_t // of the last checkpoint, see follow.go
+	i            int        // debug iteration counter
+}
+
+func newIngest(store storage.Store, collection string, details SessionDetails_t, resumeFrom time.Time) *ingest_t {
+
+	stats := newSessionStats()
+	return &ingest_t{
+		store:       store,
+		collection:  collection,
+		details:     details,
+		resumeFrom:  resumeFrom,
+		w:           statsWriter_t{store.Writer(collection), stats},
+		stats:       stats,
+		calibration: sessionCalibration(store, details.Boat),
+	}
+}
+
+func (in *ingest_t) derivedWriter(suffix string) storage.Writer {
+
+	col := in.collection + suffix
+	in.derived = appendUnique(in.derived, col)
+	return statsWriter_t{in.store.Writer(col), in.stats}
+}
+
+// transforms one logger document and writes it to the store
+func (in *ingest_t) handle(result map[string]interface{}, pos Position_t) {
+
+	in.pos = pos
+
+	if debug {
+		fmt.Printf("Interation: %d\n", in.i)
+		in.i++
+	}
+
+	// keep track of the readings the true wind needs, including the ones before where an import resumes,
+	// calibrated first so the true wind is worked out from calibrated readings
+	if in.calibration != nil {
+		in.calibration.calibrateInput(result, &in.instruments)
+	}
+	in.instruments.update(result)
+
+	// skip what was written before the import stopped
+	if !in.resumeFrom.IsZero() {
+		if ts, ok := result["timestamp"].(string); ok {
+			t, err := time.Parse(time.RFC3339, convertToDateFormat(ts))
+			if err == nil && t.Before(in.resumeFrom) {
+				return
+			}
+		}
+	}
+
+	if debug {
+		fmt.Printf("document: %s\r\n", result["description"])
+	}
+
+	w := in.w
+	switch result["description"] {
+
+	case "Speed":
+		transformSpeed(result, w)
+
+	case "Vessel Heading":
+		transformHeading(result, w)
+
+	case "COG & SOG, Rapid Update":
+		transformCogAndSog(result, w)
+		transformCurrent(result, &in.instruments, &in.current, w)
+
+	case "Wind Data":
+		transformWindData(result, w)
+		transformTrueWind(result, &in.instruments, w)
+
+	case "Position, Rapid Update":
+		transformPositionData(result, w)
+
+	case "Attitude":
+		transformAttitudeData(result, w)
+
+	// engine and electrical data is only logged on deliveries. These are written to their
+	// own collections, see engine.go
+	case "Engine Parameters, Rapid Update":
+		transformEngineRapid(result, in.derivedWriter(ENGINE_RAPID_SUFFIX))
+
+	case "Engine Parameters, Dynamic":
+		transformEngineDynamic(result, in.derivedWriter(ENGINE_DYNAMIC_SUFFIX))
+
+	case "Battery Status":
+		transformBatteryStatus(result, in.derivedWriter(BATTERY_SUFFIX))
+
+	case "DC Detailed Status":
+		transformDcDetailedStatus(result, in.derivedWriter(DC_STATUS_SUFFIX))
+
+	default:
+		return // skip this row as we dont want it stored in the DB
+	}
+}
+
+// writes out everything handled so far and brings the catalog entry up to date
+func (in *ingest_t) finish(source string, hash string) {
+
+	in.store.Flush()
+	calibration := ""
+	if in.calibration != nil {
+		calibration = in.calibration.Id
+	}
+	recordImport(in.store, in.collection, source, hash, calibration, in.details, in.stats, in.derived)
+}
+
+// Transforms the logger output read from r into collection until r runs out. source is recorded in the
+// session catalog as where the data came from.
+func TransformStream(r io.Reader, source string, collection string, details SessionDetails_t, mode ImportMode_t) error {
+
+	store := storage.Open()
+	defer store.Close()
+
+	resumeFrom, err := prepareImport(store, collection, mode)
+	if err != nil {
+		return err
+	}
+	return transformStream(store, r, source, "", collection, details, resumeFrom)
+}
+
+func transformStream(store storage.Store, r io.Reader, source string, hash string, collection string, details SessionDetails_t, resumeFrom time.Time) error {
+
+	if !resumeFrom.IsZero() {
+		fmt.Printf("resuming %s from %v\r\n", collection, resumeFrom)
+	}
+
+	in := newIngest(store, collection, details, resumeFrom)
+
+	// decode the input in parallel and transform the documents in order, see pipeline.go
+	pipeline, err := runReaderPipeline(r, Workers, in.handle)
+	if err != nil {
+		return err
+	}
+
+	in.finish(source, hash)
+	fmt.Printf("transformed %s, %d documents written using %d workers\r\n", pipeline, in.stats.written, Workers)
+	return nil
+}
+
+// Transforms logger output lines from a channel into collection until the channel is closed. Lines that
+// say where they came from are checkpointed as they are written, see follow.go.
+func TransformChannel(lines <-chan LogLine_t, collection string, details SessionDetails_t) {
+
+	store := storage.Open()
+	defer store.Close()
+
+	transformChannel(store, lines, collection, details)
+}
+
+func transformChannel(store storage.Store, lines <-chan LogLine_t, collection string, details SessionDetails_t) {
+
+	in := newIngest(store, collection, details, time.Time{})
+
+	pipeline := runPipeline(lines, Workers, in.handle, in.checkpoint)
+
+	in.checkpoint()
+	fmt.Printf("transformed %s, %d documents written using %d workers\r\n", pipeline, in.stats.written, Workers)
+}
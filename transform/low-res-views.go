@@ -1,111 +1,432 @@
 package transform
 
 import (
-	"context"
 	"fmt"
 	"log"
-	"os"
+	"sort"
+	"strings"
 	"time"
 
-	"github.com/m-h-w/nmea-logger/mongodb"
+	"github.com/m-h-w/nmea-logger/storage"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
 /*
 This module generates lower resolution views of the data to support the UI scaling in and out
+
+The views make a pyramid of resolutions, e.g. 1s, 5s, 30s, 2m and 10m, all built in one pass over the session's
+main collection. Each level has two collections:
+
+	<session>-lowres-<level>            every measurement aggregated per bucket, see aggregate.go
+	<session>-lowres-<level>-snapshots  all the channels together per bucket
+
+Both are recorded in the session catalog under "lowres-<level>" and "lowres-<level>-snapshots", which is how the
+API finds the levels a session has, see SessionLevels. Sessions built before the pyramid have one-second,
+six-second and sixty-second views, which are found the same way.
 */
 
-func BuildLowResTable(searchField string, resolution int64, readCol string, writeCol string) {
+// the levels built if none are asked for
+const DEFAULT_PYRAMID = "1s,5s,30s,2m,10m"
 
-	var resetTime bool = true
-	var result PositionData_t // need to swith on searchField and set the result to the appropriate type
-	var timeToWrite time.Time // initialises to 1st Jan 1971 (zero value)
-	var i int                 // debug variable
+const LOW_RES_PREFIX = "lowres-" // catalog kind of a pyramid level, followed by its name
 
-	if debug {
-		fmt.Printf("BuildLowResTable. Reset time = %v\n", resetTime)
+// added to a low res view's collection name for its snapshots, e.g. <session>-lowres-5s-snapshots
+const SNAPSHOT_SUFFIX = "-snapshots"
+
+const SNAPSHOT_SOURCE = "snapshot" // metadata.source of the snapshot documents
+
+// the measurements that go into the low res views, by their reading field. See schema.go
+var LowResFields = []string{FIELD_LAT, FIELD_WIND_ANGLE, FIELD_TWS, FIELD_BOATSPEED, FIELD_MAG_HEADING, FIELD_ROLL, FIELD_COG, FIELD_SOG, FIELD_DRIFT}
+
+// the readings that go into a snapshot
+var SnapshotChannels = []string{
+	FIELD_LAT, FIELD_LONG, FIELD_COG, FIELD_SOG, FIELD_MAG_HEADING, FIELD_BOATSPEED,
+	FIELD_WIND_ANGLE, FIELD_WIND_SPEED, FIELD_TWS, FIELD_TWA, FIELD_TWD, FIELD_ROLL, FIELD_PITCH,
+	FIELD_SET, FIELD_DRIFT,
+}
+
+// the fields of a snapshot in the order they are written: the channels then the performance, see performance.go
+var snapshotFields = append(append([]string{}, SnapshotChannels...), PerformanceFields...)
+
+// views built before the pyramid, by catalog kind
+var legacyLevels = map[string]time.Duration{
+	"one-second":   time.Second,
+	"six-second":   6 * time.Second,
+	"sixty-second": time.Minute,
+}
+
+// A level of a session's pyramid
+type Level_t struct {
+	Name       string        `json:"name"` // e.g. "5s"
+	Resolution time.Duration `json:"resolution"`
+	Collection string        `json:"collection"` // the aggregated measurements
+	Snapshots  string        `json:"snapshots"`  // empty if the level has none
+}
+
+// the name of a level in collection names, e.g. "5s", "2m" or "1h"
+func LevelName(res time.Duration) string {
+
+	switch {
+	case res%time.Hour == 0:
+		return fmt.Sprintf("%dh", res/time.Hour)
+	case res%time.Minute == 0:
+		return fmt.Sprintf("%dm", res/time.Minute)
+	}
+	return fmt.Sprintf("%ds", res/time.Second)
+}
+
+// Reads a comma separated list of levels, e.g. "1s,5s,30s,2m,10m". Levels must be whole seconds. They are
+// returned finest first.
+func ParseLevels(levels string) ([]time.Duration, error) {
+
+	var parsed []time.Duration
+	for _, l := range strings.Split(levels, ",") {
+		if l = strings.TrimSpace(l); l == "" {
+			continue
+		}
+		res, err := time.ParseDuration(l)
+		if err != nil {
+			return nil, err
+		}
+		if res < time.Second || res%time.Second != 0 {
+			return nil, fmt.Errorf("level %s is not a whole number of seconds", l)
+		}
+		parsed = insertDuration(parsed, res)
+	}
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("no levels in %q", levels)
+	}
+	return parsed, nil
+}
+
+// inserts res into the sorted list if it isnt already there
+func insertDuration(list []time.Duration, res time.Duration) []time.Duration {
+
+	for i, l := range list {
+		if l == res {
+			return list
+		}
+		if l > res {
+			return append(list[:i], append([]time.Duration{res}, list[i:]...)...)
+		}
 	}
+	return append(list, res)
+}
 
-	cursor := mongodb.ReadAll(searchField, readCol)
+// The levels of the pyramid that have been built for a session, finest first
+func SessionLevels(session Session_t) []Level_t {
 
-	for cursor.Next(context.TODO()) {
+	var levels []Level_t
+	for kind, col := range session.Collections {
 
-		if err := cursor.Decode(&result); err != nil {
-			log.Fatal(err)
+		var level Level_t
+		if res, ok := legacyLevels[kind]; ok {
+			level = Level_t{Name: kind, Resolution: res}
+		} else if strings.HasPrefix(kind, LOW_RES_PREFIX) && !strings.HasSuffix(kind, SNAPSHOT_SUFFIX) {
+			name := strings.TrimPrefix(kind, LOW_RES_PREFIX)
+			res, err := time.ParseDuration(name)
+			if err != nil {
+				continue
+			}
+			level = Level_t{Name: name, Resolution: res}
+		} else {
+			continue
 		}
+		level.Collection = col
+		level.Snapshots = session.Collections[kind+SNAPSHOT_SUFFIX]
 
-		if result.Ts.After(timeToWrite) { // its > res seconds after the last BD write
-			resetTime = true
-			fmt.Printf("test\n")
+		// keep them sorted, finest first
+		i := 0
+		for i < len(levels) && levels[i].Resolution <= level.Resolution {
+			i++
 		}
+		levels = append(levels[:i], append([]Level_t{level}, levels[i:]...)...)
+	}
+	return levels
+}
+
+// Builders for the levels, fed the documents from the main collection one at a time in time order
 
-		if resetTime {
-			// add the resolution to the current timesatamp
-			// to genetate the timestamp for the next write
+type levelBuilder interface {
+	add(doc bson.Raw, ts time.Time)
+	finish()
+}
+
+// Aggregates the readings of every measurement in fields into one document per resolution, per source, see
+// aggregate.go. The documents keep their measurement's reading fields so the view can be queried the same way
+// as the main collection, e.g. by FIELD_LAT for the position data.
+//
+// The position track is simplified to within tolerance metres before it is written, see simplify.go, so that
+// long straight legs dont fill the map with points. Each GPS source has its own track, as the jitter between
+// two antennas would otherwise look like shape. A tolerance of 0 keeps every position.
+type viewBuilder_t struct {
+	res       time.Duration
+	fields    []string
+	from      time.Time // documents before this are skipped, when resuming
+	tolerance float64
+	w         storage.Writer
+	buckets   buckets_t
+	tracks    map[string]*track_t // by source
+	i         int                 // debug variable
+}
+
+func newViewBuilder(store storage.Store, res time.Duration, fields []string, writeCol string, from time.Time, tolerance float64) *viewBuilder_t {
+	return &viewBuilder_t{res: res, fields: fields, from: from, tolerance: tolerance, w: store.Writer(writeCol), buckets: buckets_t{}, tracks: map[string]*track_t{}}
+}
+
+// position documents from one source, held back to be simplified
+type track_t struct {
+	docs   []bson.D
+	points [][2]float64 // their lat, long
+}
 
-			timeToWrite = result.Ts.Add(time.Second * time.Duration(resolution))
-			resetTime = false
+func (v *viewBuilder_t) add(doc bson.Raw, ts time.Time) {
 
-			if debug {
-				fmt.Printf("%d. Timestamp: %v lat: %f Lon: %f\n", i, result.Ts, result.Lat, result.Long)
-				i++
+	if ts.Before(v.from) {
+		return
+	}
+	field := readingField(doc, v.fields)
+	if field == "" {
+		return // not a measurement that goes in the view
+	}
+	reference, _ := doc.Lookup(FIELD_METADATA, "reference").StringValueOK()
+	key := bucketKey_t{field: field, source: doc.Lookup(FIELD_METADATA, FIELD_SOURCE).StringValue(), reference: reference}
+
+	b := v.buckets[key]
+	if start := ts.Truncate(v.res); b == nil || !b.start.Equal(start) {
+		if b != nil {
+			v.write(key, b)
+		}
+		b = newBucket(start, key.source)
+		b.reference = key.reference
+		v.buckets[key] = b
+	}
+	b.addDocument(doc)
+}
+
+func (v *viewBuilder_t) finish() {
+
+	for _, key := range v.buckets.keys() {
+		v.write(key, v.buckets[key])
+	}
+	v.buckets = buckets_t{}
+
+	// the tracks are all there now so can be simplified
+	sources := make([]string, 0, len(v.tracks))
+	for source := range v.tracks {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		track := v.tracks[source]
+		importance := trackImportance(track.points)
+		for i, doc := range track.docs {
+			if importance[i] > v.tolerance {
+				v.writeDocument(doc, FIELD_LAT)
 			}
+		}
+	}
+	v.tracks = map[string]*track_t{}
+}
+
+// writes out a full bucket, or holds it back if it is part of the track
+func (v *viewBuilder_t) write(key bucketKey_t, b *bucket_t) {
 
-			// write  to the data store ToDo: Figure out how to manage the connections to two tables
-			bsonResult, err := bson.Marshal(result)
-			check(err)
-			mongodb.WriteToMongo(bsonResult, writeCol)
+	id := fmt.Sprintf("%s-%s-%d", key.field, key.source, b.start.UnixNano())
+	if key.reference != "" {
+		id = fmt.Sprintf("%s-%s-%s-%d", key.field, key.source, key.reference, b.start.UnixNano())
+	}
+	doc := b.document(id, int64(v.res/time.Second), nil)
+	if doc == nil {
+		return
+	}
 
+	if key.field == FIELD_LAT && v.tolerance > 0 {
+		track := v.tracks[key.source]
+		if track == nil {
+			track = &track_t{}
+			v.tracks[key.source] = track
 		}
+		track.docs = append(track.docs, doc)
+		track.points = append(track.points, [2]float64{Aggregate(FIELD_LAT, b.values[FIELD_LAT]).Mean, Aggregate(FIELD_LONG, b.values[FIELD_LONG]).Mean})
+		return
+	}
+	v.writeDocument(doc, key.field)
+}
+
+func (v *viewBuilder_t) writeDocument(doc bson.D, field string) {
 
+	bsonDoc, err := bson.Marshal(doc)
+	check(err)
+	v.w.Write(bsonDoc)
+
+	if debug {
+		fmt.Printf("%d. %s Timestamp: %v %s\n", v.i, LevelName(v.res), doc[1].Value, field)
+		v.i++
 	}
+}
 
-	if err := cursor.Err(); err != nil {
-		log.Fatal(err)
+// returns the first of fields in doc, or "" if none of them are
+func readingField(doc bson.Raw, fields []string) string {
+
+	for _, f := range fields {
+		if _, err := doc.LookupErr(f); err == nil {
+			return f
+		}
+	}
+	return ""
+}
+
+// Builds snapshots: one per resolution holding every channel that was read in that time, aggregated as in the
+// low res views, so a chart of anything can be drawn from one query. Channels that werent read in a bucket
+// are left out of its snapshot. Each snapshot also gets the performance against polar, see performance.go.
+type snapshotBuilder_t struct {
+	res    time.Duration
+	from   time.Time
+	polar  *Polar_t  // nil if there isnt one
+	course *Course_t // the VMC is towards the mark of the leg the boat was on if there is no PerformanceMark
+	w      storage.Writer
+	bucket *bucket_t
+}
+
+func newSnapshotBuilder(store storage.Store, res time.Duration, writeCol string, from time.Time, polar *Polar_t, course *Course_t) *snapshotBuilder_t {
+	return &snapshotBuilder_t{res: res, from: from, polar: polar, course: course, w: store.Writer(writeCol)}
+}
+
+func (s *snapshotBuilder_t) add(doc bson.Raw, ts time.Time) {
+
+	if ts.Before(s.from) {
+		return
+	}
+	if start := ts.Truncate(s.res); s.bucket == nil || !s.bucket.start.Equal(start) {
+		s.finish()
+		s.bucket = newBucket(start, SNAPSHOT_SOURCE)
+	}
+
+	for _, ch := range SnapshotChannels {
+		if ch == FIELD_TWD && !trueDirection(doc) {
+			continue // magnetic if the compass gave no variation, which cant be mixed with the true TWD
+		}
+		if v, ok := doc.Lookup(ch).DoubleOK(); ok {
+			s.bucket.add(ch, v)
+		}
 	}
 }
 
-func generatePositionView(res int64, readCol string, writeCol string) {
+func (s *snapshotBuilder_t) finish() {
 
-	BuildLowResTable("lat", res, readCol, writeCol) // grab the position data from the main collection
+	if s.bucket == nil {
+		return
+	}
+
+	// the _id comes from the bucket rather than the contents so that rebuilding a bucket cant leave two
+	// snapshots for the same time. When resuming the bucket being resumed from is deleted first, see
+	// prepareDerived, so it is written again whole.
+	id := fmt.Sprintf("%s-%d", SNAPSHOT_SOURCE, s.bucket.start.UnixNano())
+	mark := PerformanceMark
+	if mark == nil && s.course != nil {
+		mark = s.course.MarkAt(s.bucket.start)
+	}
+	addPerformance(s.bucket, s.polar, mark)
+	snapshot := s.bucket.document(id, int64(s.res/time.Second), snapshotFields)
+	s.bucket = nil
+	if snapshot == nil {
+		return
+	}
 
+	bsonSnapshot, err := bson.Marshal(snapshot)
+	check(err)
+	s.w.Write(bsonSnapshot)
 }
 
-// creates low res tables for 1 second, 6 second and 60 second data
-func GenerateLowResView(res int64, readCol string) {
+// Feeds every document in readCol from from onwards to the builders, in one pass. A zero from reads it all.
+func buildLevels(store storage.Store, readCol string, from time.Time, builders []levelBuilder) {
+
+	cursor, err := store.Range(readCol, "", from, time.Time{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer cursor.Close()
 
-	var writeCol string // the collection to write the low res table to
-	// as opposed to the readCol, the table we are reading from
+	for cursor.Next() {
+		doc := cursor.Current()
+		ts, ok := doc.Lookup(FIELD_TS).TimeOK()
+		if !ok {
+			continue
+		}
+		for _, b := range builders {
+			b.add(doc, ts)
+		}
+	}
 
-	// the suffixes addded here are tested in getPosition.go
-	// in the api server package.
+	if err := cursor.Err(); err != nil {
+		log.Fatal(err)
+	}
 
-	switch res {
-	case 1:
-		writeCol = readCol + "-one-second"
-	case 6:
-		writeCol = readCol + "-six-second"
-	case 60:
-		writeCol = readCol + "-sixty-second"
-	default:
-		fmt.Printf("Resolution of %d Seconds not supported", res)
-		os.Exit(1)
+	for _, b := range builders {
+		b.finish()
 	}
+}
 
-	// check to see if collection exists and stop if it has.
-	// Need to drop the collection from Atlas UI before writing again if
-	// that is the intention.
-	colls := mongodb.ListCollections()
+// creates the low res views and snapshot tables for each level of a pyramid, with the position track
+// simplified to within tolerance metres. mode says what to do if the tables exist, see import-mode.go
+func GenerateLowResView(levels []time.Duration, readCol string, tolerance float64, mode ImportMode_t) error {
 
-	for _, col := range colls {
-		if col == writeCol {
-			fmt.Printf("Collection %s exists already \r\n", writeCol)
-			os.Exit(1)
+	store := storage.Open()
+	defer store.Close()
+
+	session, err := LoadSession(store, readCol)
+	if err != nil {
+		return err
+	}
+	polar := sessionPolar(store, session.Boat)
+	if polar != nil {
+		fmt.Printf("comparing with polar %s\r\n", polar.Name)
+		session.Polar = polar.Name
+		if err := SaveSession(store, session); err != nil {
+			return err
 		}
 	}
+	var course *Course_t
+	if c, err := LoadCourse(store, readCol); err == nil && PerformanceMark == nil {
+		fmt.Printf("vmc to the marks of %d legs\r\n", len(c.Legs))
+		course = &c
+	}
+
+	var builders []levelBuilder
+	var cols []string
+	from := time.Now() // the earliest any level needs reading from
+	for _, res := range levels {
 
-	mongodb.InitMongoConnection()
-	generatePositionView(res, readCol, writeCol)
-	mongodb.CloseMongoConnection(writeCol)
+		// the collections to write the low res tables to, as opposed to the readCol, the table we are
+		// reading from. The API finds them from the session catalog.
+		viewCol := readCol + "-" + LOW_RES_PREFIX + LevelName(res)
+		snapshotCol := viewCol + SNAPSHOT_SUFFIX
 
+		viewFrom, err := prepareDerived(store, viewCol, mode)
+		if err != nil {
+			return err
+		}
+		snapshotFrom, err := prepareDerived(store, snapshotCol, mode)
+		if err != nil {
+			return err
+		}
+		for _, f := range []time.Time{viewFrom, snapshotFrom} {
+			if f.Before(from) {
+				from = f
+			}
+		}
+
+		builders = append(builders,
+			newViewBuilder(store, res, LowResFields, viewCol, viewFrom, tolerance),
+			newSnapshotBuilder(store, res, snapshotCol, snapshotFrom, polar, course))
+		cols = append(cols, viewCol, snapshotCol)
+	}
+
+	buildLevels(store, readCol, from, builders)
+
+	for _, col := range cols {
+		AddDerivedCollection(store, readCol, col) // so the API can find it from the session catalog
+	}
+	return nil
 }
@@ -0,0 +1,53 @@
+package transform
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// true wind referenced to true and to magnetic north comes from the same source but mustnt be averaged together.
+// The documents are bucketed under FIELD_TWS, see LowResFields.
+func TestViewBuilderReference(t *testing.T) {
+
+	store := testStore(t)
+	defer store.Close()
+
+	v := newViewBuilder(store, time.Minute, LowResFields, "view", time.Time{}, 0)
+	for i := 0; i < 10; i++ {
+		ts := testGun.Add(time.Duration(i) * time.Second)
+		for _, wind := range []struct {
+			reference string
+			twd       float64
+		}{{"true", 10}, {"magnetic", 100}} {
+			data, err := bson.Marshal(bson.D{{Key: FIELD_TS, Value: ts},
+				{Key: FIELD_METADATA, Value: bson.D{{Key: FIELD_SOURCE, Value: TRUE_WIND_SOURCE}, {Key: "reference", Value: wind.reference}}},
+				{Key: FIELD_TWS, Value: 5.0}, {Key: FIELD_TWD, Value: wind.twd}})
+			check(err)
+			v.add(bson.Raw(data), ts)
+		}
+	}
+	v.finish()
+	store.Flush()
+
+	cursor, err := store.Range("view", FIELD_TWD, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]float64{"true": 10, "magnetic": 100}
+	n := 0
+	for cursor.Next() {
+		doc := cursor.Current()
+		reference, _ := doc.Lookup(FIELD_METADATA, "reference").StringValueOK()
+		if twd := doc.Lookup(FIELD_TWD).Double(); math.Abs(twd-want[reference]) > TEST_TOLERANCE {
+			t.Errorf("%s twd is %f, want %f", reference, twd, want[reference])
+		}
+		n++
+	}
+	cursor.Close()
+	if n != 2 {
+		t.Errorf("got %d twd documents, want one for each reference", n)
+	}
+}
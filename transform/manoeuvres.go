@@ -0,0 +1,222 @@
+package transform
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/manoeuvre"
+	"github.com/m-h-w/nmea-logger/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Manoeuvres
+----------
+The tacks, gybes, bear-aways and round-ups in a session with how well each was sailed, found and measured by
+the manoeuvre package from the session's readings. The targets they are measured against come from the polar
+the session's snapshots were compared with (see performance.go), or the boat's latest polar.
+
+BuildManoeuvres stores them in <session>-manoeuvres, one document per manoeuvre:
+
+	{ts: <entry>, metadata: {source: "manoeuvre", session, helm, polar}, type: "tack", entry, exit, turn,
+	 twabefore, twaafter, metrics: {entryspeed, minspeed, recovery, distancelost, ...}}
+
+which is what the API serves if it is there. Otherwise SessionManoeuvres works them out as they are asked for.
+The helm is the one recorded for the session (-helm), so manoeuvres can be compared between helmsmen.
+*/
+
+const MANOEUVRES_SUFFIX = "-manoeuvres"
+const MANOEUVRE_SOURCE = "manoeuvre"
+
+type manoeuvreMetadata_t struct {
+	DataSource string `bson:"source" json:"source"`
+	Session    string `bson:"session" json:"session"`
+	Helm       string `bson:"helm,omitempty" json:"helm,omitempty"`
+	Polar      string `bson:"polar,omitempty" json:"polar,omitempty"` // the targets came from, empty if there wasnt one
+}
+
+type ManoeuvreRecord_t struct {
+	Id                    string              `bson:"_id" json:"-"`
+	Ts                    time.Time           `bson:"ts" json:"-"` // the entry
+	Metadata              manoeuvreMetadata_t `bson:"metadata" json:"metadata"`
+	manoeuvre.Manoeuvre_t `bson:",inline"`
+	Metrics               manoeuvre.Metrics_t `bson:"metrics" json:"metrics"`
+}
+
+// Finds and measures the manoeuvres in a session between start and stop, either of which can be zero for the
+// start or end of the session.
+func AnalyseManoeuvres(store storage.Store, session string, start time.Time, stop time.Time) ([]ManoeuvreRecord_t, error) {
+
+	entry, err := LoadSession(store, session)
+	if err != nil {
+		return nil, err
+	}
+
+	in, err := manoeuvreInput(store, session, start, stop)
+	if err != nil {
+		return nil, err
+	}
+
+	// the polar the snapshots were compared with, so the two agree
+	var polar *Polar_t
+	if entry.Polar != "" {
+		if p, err := LoadPolar(store, entry.Polar); err == nil {
+			polar = &p
+		}
+	}
+	if polar == nil {
+		polar = sessionPolar(store, entry.Boat)
+	}
+	var target manoeuvre.Target_t
+	metadata := manoeuvreMetadata_t{DataSource: MANOEUVRE_SOURCE, Session: session, Helm: entry.Helm}
+	if polar != nil {
+		metadata.Polar = polar.Name
+		target = func(tws float64, twa float64) (float64, float64, bool) {
+			t, ok := polar.Target(tws*MS2KNOTS, math.Abs(angleDifference(twa, 0)) < 90)
+			return t.Speed / MS2KNOTS, t.Vmg / MS2KNOTS, ok
+		}
+	}
+
+	found := manoeuvre.Detect(in)
+	metrics := manoeuvre.Measure(in, found, target)
+
+	records := make([]ManoeuvreRecord_t, len(found))
+	for i, m := range found {
+		records[i] = ManoeuvreRecord_t{
+			Id:          fmt.Sprintf("%s-%d", m.Type, m.Entry.UnixNano()),
+			Ts:          m.Entry,
+			Metadata:    metadata,
+			Manoeuvre_t: m,
+			Metrics:     metrics[i],
+		}
+	}
+	return records, nil
+}
+
+// Returns the collection the session's manoeuvres are stored in, if they have been built
+func (session Session_t) ManoeuvresCollection() (string, bool) {
+
+	col, ok := session.Collections[strings.TrimPrefix(MANOEUVRES_SUFFIX, "-")]
+	return col, ok
+}
+
+// The manoeuvres in a session between start and stop, from <session>-manoeuvres if it has been built,
+// otherwise worked out from the readings.
+func SessionManoeuvres(store storage.Store, session string, start time.Time, stop time.Time) ([]ManoeuvreRecord_t, error) {
+
+	entry, err := LoadSession(store, session)
+	if err != nil {
+		return nil, err
+	}
+	col, ok := entry.ManoeuvresCollection()
+	if !ok {
+		return AnalyseManoeuvres(store, session, start, stop)
+	}
+
+	cursor, err := store.Range(col, "", start, stop)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	records := []ManoeuvreRecord_t{}
+	for cursor.Next() {
+		var r ManoeuvreRecord_t
+		if err := cursor.Decode(&r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	return records, cursor.Err()
+}
+
+// Finds and measures the manoeuvres in a session and stores them in <session>-manoeuvres. mode says what to do
+// if it exists, see import-mode.go
+func BuildManoeuvres(session string, mode ImportMode_t) error {
+
+	store := storage.Open()
+	defer store.Close()
+
+	col := session + MANOEUVRES_SUFFIX
+	from, err := prepareDerived(store, col, mode)
+	if err != nil {
+		return err
+	}
+
+	records, err := AnalyseManoeuvres(store, session, time.Time{}, time.Time{})
+	if err != nil {
+		return err
+	}
+
+	w := store.Writer(col)
+	for _, r := range records {
+		if r.Ts.Before(from) {
+			continue // written already, when resuming
+		}
+		bsonRecord, err := bson.Marshal(r)
+		check(err)
+		w.Write(bsonRecord)
+
+		if debug {
+			fmt.Printf("%s at %v, %.1f to %.1f m/s\n", r.Type, r.Entry, r.Metrics.EntrySpeed, r.Metrics.MinSpeed)
+		}
+	}
+	fmt.Printf("%d manoeuvres in %s\r\n", len(records), session)
+
+	AddDerivedCollection(store, session, col) // so the API can find it from the session catalog
+	return nil
+}
+
+// the readings manoeuvre detection needs from a session between two times. The apparent wind angle stands in
+// for the true one in sessions imported before there was true wind.
+func manoeuvreInput(store storage.Store, session string, start time.Time, stop time.Time) (manoeuvre.Input_t, error) {
+
+	var in manoeuvre.Input_t
+
+	read := func(field string, keep func(doc bson.Raw) bool) ([]manoeuvre.Reading_t, error) {
+		cursor, err := store.Range(session, field, start, stop)
+		if err != nil {
+			return nil, err
+		}
+		defer cursor.Close()
+
+		var readings []manoeuvre.Reading_t
+		for cursor.Next() {
+			doc := cursor.Current()
+			v, ok := doc.Lookup(field).DoubleOK()
+			ts, ok2 := doc.Lookup(FIELD_TS).TimeOK()
+			if ok && ok2 && (keep == nil || keep(doc)) {
+				readings = append(readings, manoeuvre.Reading_t{Ts: ts, Value: v})
+			}
+		}
+		return readings, cursor.Err()
+	}
+
+	fields := []struct {
+		field    string
+		readings *[]manoeuvre.Reading_t
+	}{
+		{FIELD_MAG_HEADING, &in.Heading},
+		{FIELD_COG, &in.Cog},
+		{FIELD_BOATSPEED, &in.Boatspeed},
+		{FIELD_TWS, &in.Tws},
+		{FIELD_ROLL, &in.Heel},
+		{FIELD_TWA, &in.Twa},
+	}
+	var err error
+	for _, f := range fields {
+		if *f.readings, err = read(f.field, nil); err != nil {
+			return in, err
+		}
+	}
+
+	if len(in.Twa) == 0 {
+		in.Twa, err = read(FIELD_WIND_ANGLE, func(doc bson.Raw) bool {
+			reference, _ := doc.Lookup(FIELD_METADATA, "reference").StringValueOK()
+			return reference == "Apparent"
+		})
+	}
+	return in, err
+}
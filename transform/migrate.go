@@ -0,0 +1,110 @@
+package transform
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+Rewrites a collection written before the field naming scheme in schema.go to the current names.
+
+Time-series collections only allow the meta field to be changed once a document is written, and they
+cant be renamed, so the collection is rewritten rather than updated in place:
+
+	1. every document is copied unchanged to <collection>-legacy
+	2. the original collection is dropped
+	3. the documents are copied back from <collection>-legacy with the field names rewritten. This
+	   recreates <collection> as a time-series collection.
+	4. if the document counts match <collection>-legacy is dropped, otherwise it is left for inspection.
+
+Running it on a collection that already uses the current names does no harm.
+*/
+
+const LEGACY_SUFFIX = "-legacy"
+
+func MigrateCollection(collection string) {
+
+	legacyCol := collection + LEGACY_SUFFIX
+
+	store := storage.Open()
+	defer store.Close()
+
+	// 1. back up the collection as it is
+	copied := copyCollection(store, collection, legacyCol, false)
+	store.Flush()
+
+	if count, err := store.Count(legacyCol); err != nil || count != copied {
+		log.Fatalf("backup of %s to %s is incomplete, stopping before anything is dropped", collection, legacyCol)
+	}
+	fmt.Printf("Copied %d documents to %s\n", copied, legacyCol)
+
+	// 2. and 3. recreate the collection with the new field names
+	check(store.Drop(collection))
+	migrated := copyCollection(store, legacyCol, collection, true)
+	store.Flush()
+
+	// 4. only drop the backup if everything made it back
+	if count, err := store.Count(collection); err != nil || count != migrated || migrated != copied {
+		fmt.Printf("Document counts differ after migration, %s has been kept\n", legacyCol)
+		return
+	}
+	check(store.Drop(legacyCol))
+	fmt.Printf("Migrated %d documents in %s\n", migrated, collection)
+}
+
+// copies every document from one collection to another, optionally renaming legacy fields on the way.
+// Returns the number of documents copied.
+func copyCollection(store storage.Store, from string, to string, rename bool) int64 {
+
+	var count int64
+
+	cursor, err := store.Range(from, "", time.Time{}, time.Time{})
+	check(err)
+	defer cursor.Close()
+	w := store.Writer(to)
+
+	for cursor.Next() {
+
+		var doc bson.D
+		if err := cursor.Decode(&doc); err != nil {
+			log.Fatal(err)
+		}
+
+		if rename {
+			doc = renameLegacyFields(doc, legacyFieldNames)
+		}
+
+		bsonDoc, err := bson.Marshal(doc)
+		check(err)
+		w.Write(bsonDoc)
+		count++
+	}
+
+	if err := cursor.Err(); err != nil {
+		log.Fatal(err)
+	}
+	return count
+}
+
+// renames the fields of a document using names, recursing into the metadata with the metadata names.
+func renameLegacyFields(doc bson.D, names map[string]string) bson.D {
+
+	for i, elem := range doc {
+
+		if elem.Key == FIELD_METADATA {
+			if metadata, ok := elem.Value.(bson.D); ok {
+				doc[i].Value = renameLegacyFields(metadata, legacyMetadataNames)
+			}
+			continue
+		}
+
+		if newName, ok := names[elem.Key]; ok {
+			doc[i].Key = newName
+		}
+	}
+	return doc
+}
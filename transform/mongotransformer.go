@@ -1,13 +1,11 @@
 package transform
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
 	"os"
 	"time"
 
-	"github.com/m-h-w/nmea-logger/mongodb"
+	"github.com/m-h-w/nmea-logger/storage"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
@@ -19,6 +17,8 @@ var debug bool = true
 // The document metadata contains the only fields that can be changed once the document is written
 // more info: https://docs.mongodb.com/manual/core/timeseries/timeseries-limitations/
 
+// All the field names follow the scheme described in schema.go
+
 //-----------------------------------------------------------------------------------------------//
 
 // Position Data
@@ -35,7 +35,7 @@ type PositionData_t struct {
 	Long     float64            `bson:"long"`
 }
 
-func transformPositionData(input map[string]interface{}, collection string) {
+func transformPositionData(input map[string]interface{}, w storage.Writer) {
 
 	var position PositionData_t
 
@@ -55,24 +55,24 @@ func transformPositionData(input map[string]interface{}, collection string) {
 	//write to data store
 	bsonPosition, err := bson.Marshal(position)
 	check(err)
-	mongodb.WriteToMongo(bsonPosition, collection)
+	w.Write(bsonPosition)
 
 }
 
 // Attitude Data
 
 type attitudeMetadata_t struct {
-	DataSource string `json:"source"`
+	DataSource string `bson:"source"`
 }
 
 type attitudeData_t struct {
-	Ts       time.Time          `json:"ts"`
-	Metadata attitudeMetadata_t `json:"metadata"`
-	Pitch    float64            `json:"pitch"`
-	Roll     float64            `json:"roll"`
+	Ts       time.Time          `bson:"ts"`
+	Metadata attitudeMetadata_t `bson:"metadata"`
+	Pitch    float64            `bson:"pitch"`
+	Roll     float64            `bson:"roll"`
 }
 
-func transformAttitudeData(input map[string]interface{}, collection string) {
+func transformAttitudeData(input map[string]interface{}, w storage.Writer) {
 
 	var attitude attitudeData_t
 
@@ -92,27 +92,31 @@ func transformAttitudeData(input map[string]interface{}, collection string) {
 	//write to data store
 	bsonAttitude, err := bson.Marshal(attitude)
 	check(err)
-	mongodb.WriteToMongo(bsonAttitude, collection)
+	w.Write(bsonAttitude)
 
 }
 
 // Wind Data
 
+// the corrections are what calibration added to the raw readings, see calibration.go
 type windMetadata_t struct {
-	DataSource      string  `json:"source"`
-	Reference       string  `json:"reference"`
-	AngleCorrection float64 `json:"angleCorrection"`
-	SpeedCorrectiom float64 `json:"speedCorrection"`
+	DataSource      string   `bson:"source"`
+	Reference       string   `bson:"reference"`
+	AngleCorrection float64  `bson:"anglecorrection"`
+	SpeedCorrection float64  `bson:"speedcorrection"`
+	Calibration     string   `bson:"calibration,omitempty"`
+	RawAngle        *float64 `bson:"rawangle,omitempty"`
+	RawSpeed        *float64 `bson:"rawspeed,omitempty"`
 }
 
 type windData_t struct {
-	Ts       time.Time      `json:"ts"`
-	Metadata windMetadata_t `json:"metadata"`
-	Angle    float64        `json:"windangle"`
-	Speed    float64        `json:"windspeed"`
+	Ts       time.Time      `bson:"ts"`
+	Metadata windMetadata_t `bson:"metadata"`
+	Angle    float64        `bson:"windangle"`
+	Speed    float64        `bson:"windspeed"`
 }
 
-func transformWindData(input map[string]interface{}, collection string) {
+func transformWindData(input map[string]interface{}, w storage.Writer) {
 
 	var wind windData_t
 
@@ -140,37 +144,43 @@ func transformWindData(input map[string]interface{}, collection string) {
 	wind.Angle = fields["Wind Angle"].(float64)
 	wind.Speed = fields["Wind Speed"].(float64)
 
+	rawAngle, ok := rawReading(input, "Wind Angle")
+	rawSpeed, ok2 := rawReading(input, "Wind Speed")
+	if ok && ok2 {
+		wind.calibrate(rawAngle, rawSpeed, wind.Angle, wind.Speed, calibrationOf(input))
+	}
+
 	//write to data store
 	bsonWind, err := bson.Marshal(wind)
 	check(err)
-	mongodb.WriteToMongo(bsonWind, collection)
+	w.Write(bsonWind)
 
 }
 
 // GPS Speed and Course
 
 type sogMetadata_t struct {
-	DataSource string `json:"source"`
+	DataSource string `bson:"source"`
 }
 
 type sog_t struct {
-	Ts       time.Time     `json:"ts"`
-	Metadata sogMetadata_t `json:"metadata"`
-	Sog      float64       `json:"sog"`
+	Ts       time.Time     `bson:"ts"`
+	Metadata sogMetadata_t `bson:"metadata"`
+	Sog      float64       `bson:"sog"`
 }
 
 type cogMetadata_t struct {
-	DataSource string `json:"source"`
-	Ref        string `json:"ref"` //magnetic or true - default seems to be true
+	DataSource string `bson:"source"`
+	Ref        string `bson:"ref"` //magnetic or true - default seems to be true
 }
 
 type cog_t struct {
-	Ts       time.Time     `json:"ts"`
-	Metadata cogMetadata_t `json:"metadata"`
-	Cog      float64       `json:"cog"`
+	Ts       time.Time     `bson:"ts"`
+	Metadata cogMetadata_t `bson:"metadata"`
+	Cog      float64       `bson:"cog"`
 }
 
-func transformCogAndSog(input map[string]interface{}, collection string) {
+func transformCogAndSog(input map[string]interface{}, w storage.Writer) {
 
 	var cog cog_t
 	var sog sog_t
@@ -212,28 +222,32 @@ func transformCogAndSog(input map[string]interface{}, collection string) {
 	// write cog and sog to the data store
 	bsonSog, err := bson.Marshal(sog)
 	check(err)
-	mongodb.WriteToMongo(bsonSog, collection)
+	w.Write(bsonSog)
 
 	bsonCog, err := bson.Marshal(cog)
 	check(err)
-	mongodb.WriteToMongo(bsonCog, collection)
+	w.Write(bsonCog)
 
 }
 
-// Compass Heading
+// Compass Heading. The variation and true heading are only there when the compass sent the variation. Sessions
+// imported before that have them both as 0 instead, see variationOf.
 type headingMetadata_t struct {
-	DataSource  string  `json:"source"`
-	MagVar      float64 `json:"magvar"`
-	TrueHeading float64 `json:"trueheading"`
+	DataSource  string   `bson:"source"`
+	MagVar      *float64 `bson:"magvar,omitempty"`
+	TrueHeading *float64 `bson:"trueheading,omitempty"`
+	Calibration string   `bson:"calibration,omitempty"`
+	RawHeading  *float64 `bson:"rawheading,omitempty"`
+	Deviation   float64  `bson:"deviation,omitempty"` // added to the raw heading
 }
 
 type heading_t struct {
-	Ts         time.Time         `json:"ts"`
-	Metadata   headingMetadata_t `json:"metadata"`
-	MagHeading float64           `json:"magheading"`
+	Ts         time.Time         `bson:"ts"`
+	Metadata   headingMetadata_t `bson:"metadata"`
+	MagHeading float64           `bson:"magheading"`
 }
 
-func transformHeading(input map[string]interface{}, collection string) {
+func transformHeading(input map[string]interface{}, w storage.Writer) {
 
 	var heading heading_t
 
@@ -248,31 +262,37 @@ func transformHeading(input map[string]interface{}, collection string) {
 	heading.MagHeading = fields["Heading"].(float64)
 
 	// variation field doesnt always exis
-	if val, ok := fields["Variation"]; ok {
-		heading.Metadata.MagVar = val.(float64)
-		heading.Metadata.TrueHeading = heading.MagHeading + heading.Metadata.MagVar
+	if val, ok := fields["Variation"].(float64); ok {
+		trueHeading := normaliseDegrees(heading.MagHeading + val)
+		heading.Metadata.MagVar, heading.Metadata.TrueHeading = &val, &trueHeading
+	}
+
+	if raw, ok := rawReading(input, "Heading"); ok {
+		heading.calibrate(raw, heading.MagHeading, calibrationOf(input))
 	}
 
 	//Marshall the bheading data in bson
 	bsonHeading, err := bson.Marshal(heading)
 	check(err)
 	// write to the data store
-	mongodb.WriteToMongo(bsonHeading, collection)
+	w.Write(bsonHeading)
 }
 
 // Boat Speed
 type boatSpeedMetadata_t struct {
-	DataSource         string  `json:"source"`
-	CorrectedBoatSpeed float64 `json:"correctedboatspeed"`
+	DataSource         string   `bson:"source"`
+	CorrectedBoatSpeed float64  `bson:"correctedboatspeed"` // the same as the reading once it is calibrated, see calibration.go
+	Calibration        string   `bson:"calibration,omitempty"`
+	RawBoatSpeed       *float64 `bson:"rawboatspeed,omitempty"`
 }
 
 type boatSpeed_t struct {
-	Ts                 time.Time           `json:"ts"`        // timestamp
-	Metadata           boatSpeedMetadata_t `json:"metadata"`  // Information about the reading and any corrections
-	IndicatedBoatSpeed float64             `json:"boatspeed"` // indicated boatspeed from the log
+	Ts                 time.Time           `bson:"ts"`        // timestamp
+	Metadata           boatSpeedMetadata_t `bson:"metadata"`  // Information about the reading and any corrections
+	IndicatedBoatSpeed float64             `bson:"boatspeed"` // indicated boatspeed from the log
 }
 
-func transformSpeed(input map[string]interface{}, collection string) {
+func transformSpeed(input map[string]interface{}, w storage.Writer) {
 
 	var boatSpeed boatSpeed_t
 
@@ -286,11 +306,15 @@ func transformSpeed(input map[string]interface{}, collection string) {
 	fields := input["fields"].(map[string]interface{})
 	boatSpeed.IndicatedBoatSpeed = fields["Speed Water Referenced"].(float64)
 
+	if raw, ok := rawReading(input, "Speed Water Referenced"); ok {
+		boatSpeed.calibrate(raw, boatSpeed.IndicatedBoatSpeed, calibrationOf(input))
+	}
+
 	//Marshall the boatSpeed data in json
 	bsonBoatSpeed, err := bson.Marshal(boatSpeed)
 	check(err)
 	// write to the data store
-	mongodb.WriteToMongo(bsonBoatSpeed, collection)
+	w.Write(bsonBoatSpeed)
 }
 
 func check(e error) {
@@ -309,9 +333,9 @@ func convertToDateFormat(date string) string {
 	return string(byteArray)
 }
 
-func TransformToMongoFormat(ipfile string, collection string) {
-
-	var i int // debug iteration counter
+// Transforms a logger file into collection and records the import in the session catalog, along with
+// the hand entered details of the session. mode says what to do if the collection exists, see import-mode.go
+func TransformToMongoFormat(ipfile string, collection string, details SessionDetails_t, mode ImportMode_t) error {
 
 	// Try to open the named input file
 	ifile, err := os.Open(ipfile)
@@ -320,67 +344,18 @@ func TransformToMongoFormat(ipfile string, collection string) {
 	// Close file on exit of this function
 	defer ifile.Close()
 
-	// open the DB Connection
-	mongodb.InitMongoConnection()
+	// open the data store - Mongo Atlas or local files depending on STORAGE_BACKEND
+	store := storage.Open()
 	// close connection on exit
-	defer mongodb.CloseMongoConnection(collection)
-
-	//  Scan the input file.
-	scanner := bufio.NewScanner(ifile)
-
-	for scanner.Scan() {
-		if debug {
-			fmt.Printf("Interation: %d\n", i)
-			i++
-		}
-
-		//create a map of strings to empty interfaces to unmarshall json B&G logger data into
-		var result map[string]interface{}
-
-		//unmarshall the B&G data. Based on https://www.sohamkamani.com/golang/parsing-json/
-		err := json.Unmarshal([]byte(scanner.Text()), &result) //NB result passed by refence
+	defer store.Close()
 
-		if err != nil {
-			fmt.Fprintln(os.Stderr, "error unmarshalling logger data", err)
-			continue // error in the input data format so skip this iteration and move on.
-		}
-
-		// all the functions called from this switch statement are concurrent goroutines.
-		// NB result is passed by value, not by reference, and so will be thread safe.
-		if debug {
-			fmt.Printf("document: %s\r\n", result["description"])
-		}
-
-		switch result["description"] {
-
-		case "Speed":
-			transformSpeed(result, collection)
-
-		case "Vessel Heading":
-			transformHeading(result, collection)
-
-		case "COG & SOG, Rapid Update":
-			transformCogAndSog(result, collection)
-
-		case "Wind Data":
-			transformWindData(result, collection)
-
-		case "Position, Rapid Update":
-			transformPositionData(result, collection)
-
-		case "Attitude":
-			transformAttitudeData(result, collection)
-
-		default:
-			continue // skip this row as we dont want it stored in the DB
-
-		}
-
-	} //iterate until EOF or error
-
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "reading input file:", err)
-		os.Exit(1)
+	resumeFrom, err := prepareImport(store, collection, mode)
+	if err != nil {
+		return err
 	}
 
+	if err := transformStream(store, ifile, ipfile, fileHash(ipfile), collection, details, resumeFrom); err != nil {
+		return fmt.Errorf("reading input file: %s", err)
+	}
+	return nil
 }
@@ -0,0 +1,172 @@
+package transform
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/m-h-w/nmea-logger/storage"
+)
+
+/*
+Performance against a polar
+---------------------------
+When the low res views are built each snapshot is compared with a polar (see polars.go) and these are added to it:
+
+	polarspeed   the polar boatspeed at the snapshot's TWS and TWA, m/s
+	polarperf    boatspeed as a percentage of polarspeed
+	targetspeed  the boatspeed for the best VMG at the TWS, upwind if the TWA is under 90 otherwise downwind, m/s
+	targettwa    the TWA the best VMG is sailed at
+	vmg          boatspeed made good up or down wind, m/s
+	vmc          SOG made good towards the mark, m/s, if there is one: -mark or the mark of the leg, see course.go
+
+They are worked out from the snapshot's averages so have stats with one reading. The polar is TargetPolar if it
+is set, otherwise the boat's most recently made or read in polar, and is recorded in the session catalog. Without
+a polar only the vmg (and vmc) are added. Sessions are annotated again by rebuilding their views with -mode
+overwrite.
+*/
+
+// the polar the snapshots are compared with, by name. Set from the command line, see tools/mongo-tools.go
+var TargetPolar = ""
+
+// the mark VMC is worked out towards. Set from the command line, nil for no VMC
+var PerformanceMark *Mark_t
+
+type Mark_t struct {
+	Name string  `bson:"name,omitempty" json:"name,omitempty"`
+	Lat  float64 `bson:"lat" json:"lat"`
+	Long float64 `bson:"long" json:"long"`
+}
+
+// the fields added to the snapshots, in the order they are written
+var PerformanceFields = []string{FIELD_POLAR_SPEED, FIELD_POLAR_PERF, FIELD_TARGET_SPEED, FIELD_TARGET_TWA, FIELD_VMG, FIELD_VMC}
+
+// Parses a mark given as "lat,long" in decimal degrees
+func ParseMark(mark string) (*Mark_t, error) {
+
+	parts := strings.Split(mark, ",")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("mark %q should be lat,long", mark)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return nil, fmt.Errorf("bad latitude in %q", mark)
+	}
+	long, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || long < -180 || long > 180 {
+		return nil, fmt.Errorf("bad longitude in %q", mark)
+	}
+	return &Mark_t{Lat: lat, Long: long}, nil
+}
+
+// the polar to compare a session sailed on boat with, or nil if there isnt one
+func sessionPolar(store storage.Store, boat string) *Polar_t {
+
+	if TargetPolar != "" {
+		polar, err := LoadPolar(store, TargetPolar)
+		if err != nil {
+			log.Printf("unable to read polar %s: %s\n", TargetPolar, err)
+			return nil
+		}
+		return &polar
+	}
+	if boat == "" {
+		return nil
+	}
+
+	var all []Polar_t
+	if err := store.GetAll(POLAR_CATALOG, &all); err != nil {
+		log.Printf("unable to read the polars: %s\n", err)
+		return nil
+	}
+	var latest *Polar_t
+	for i, p := range all {
+		if p.Boat == boat && (latest == nil || p.Created.After(latest.Created)) {
+			latest = &all[i]
+		}
+	}
+	return latest
+}
+
+// The best VMG upwind or downwind at tws knots, interpolated between the wind speeds either side. false if the
+// polar doesnt go that far.
+func (polar *Polar_t) Target(tws float64, upwind bool) (Optimum_t, bool) {
+
+	optima := polar.Downwind
+	if upwind {
+		optima = polar.Upwind
+	}
+	var found []Optimum_t
+	var speeds []float64
+	for _, o := range optima {
+		if o.Vmg > 0 {
+			found = append(found, o)
+			speeds = append(speeds, o.Tws)
+		}
+	}
+
+	i, j, f := bracket(speeds, tws, POLAR_TWS_BIN/2)
+	if i < 0 {
+		return Optimum_t{}, false
+	}
+	a, b := found[i], found[j]
+	return Optimum_t{
+		Tws:   tws,
+		Twa:   a.Twa + (b.Twa-a.Twa)*f,
+		Speed: a.Speed + (b.Speed-a.Speed)*f,
+		Vmg:   a.Vmg + (b.Vmg-a.Vmg)*f,
+	}, true
+}
+
+// adds the performance fields to a snapshot's bucket from the averages of what is in it
+func addPerformance(b *bucket_t, polar *Polar_t, mark *Mark_t) {
+
+	mean := func(field string) (float64, bool) {
+		values := b.values[field]
+		return Aggregate(field, values).Mean, len(values) != 0
+	}
+
+	stw, hasStw := mean(FIELD_BOATSPEED)
+	twa, hasTwa := mean(FIELD_TWA)
+	tws, hasTws := mean(FIELD_TWS)
+	twa = math.Abs(angleDifference(twa, 0))
+
+	if hasStw && hasTwa {
+		b.add(FIELD_VMG, math.Abs(stw*math.Cos(twa*math.Pi/180)))
+	}
+
+	if polar != nil && hasTws && hasTwa {
+		if speed := polar.SpeedAt(tws*MS2KNOTS, twa); speed > 0 {
+			b.add(FIELD_POLAR_SPEED, speed/MS2KNOTS)
+			if hasStw {
+				b.add(FIELD_POLAR_PERF, 100*stw*MS2KNOTS/speed)
+			}
+		}
+		if target, ok := polar.Target(tws*MS2KNOTS, twa < 90); ok {
+			b.add(FIELD_TARGET_SPEED, target.Speed/MS2KNOTS)
+			b.add(FIELD_TARGET_TWA, target.Twa)
+		}
+	}
+
+	if mark != nil {
+		sog, hasSog := mean(FIELD_SOG)
+		cog, hasCog := mean(FIELD_COG)
+		lat, hasLat := mean(FIELD_LAT)
+		long, hasLong := mean(FIELD_LONG)
+		if hasSog && hasCog && hasLat && hasLong {
+			b.add(FIELD_VMC, sog*math.Cos(angleDifference(cog, bearing(lat, long, mark.Lat, mark.Long))*math.Pi/180))
+		}
+	}
+}
+
+// the initial great circle bearing from one position to another, degrees true
+func bearing(lat1 float64, long1 float64, lat2 float64, long2 float64) float64 {
+
+	a, b := lat1*math.Pi/180, lat2*math.Pi/180
+	dLong := (long2 - long1) * math.Pi / 180
+	y := math.Sin(dLong) * math.Cos(b)
+	x := math.Cos(a)*math.Sin(b) - math.Sin(a)*math.Cos(b)*math.Cos(dLong)
+	return normaliseDegrees(math.Atan2(y, x) * 180 / math.Pi)
+}
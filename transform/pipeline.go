@@ -0,0 +1,207 @@
+package transform
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+Transform pipeline
+------------------
+Importing a day of logger data one line at a time spends most of its time decoding json, so the import is
+split into stages that run at the same time:
+
+	reader -> json decode (Workers goroutines) -> transform, in file order -> batched writers
+
+The lines come from a file, an io.Reader or a channel, e.g. the live logger output, see follow.go. The
+reader hands out the lines in chunks so the decoders arent fighting over the channel for every line.
+Decoded chunks can finish out of order, so the transform stage puts them back in file order before handing
+the documents on, one at a time. That keeps the output exactly what it was when the import ran on a single
+goroutine. The writers batch and insert concurrently already, see mongodb/batch-writer.go.
+*/
+
+// number of goroutines decoding json. Set from the tools command line.
+var Workers int = runtime.NumCPU()
+
+const PIPELINE_CHUNK = 256                 // lines handed to a decoder at a time
+const PIPELINE_IDLE = time.Second          // how long a part filled chunk waits for more lines
+const PROGRESS_INTERVAL = 10 * time.Second // how often progress is printed during an import
+
+// A line of logger output and where it came from. File and Offset are only set when the source can be
+// resumed part way through, see follow.go.
+type LogLine_t struct {
+	Text string
+	Position_t
+}
+
+type Position_t struct {
+	File   string
+	Offset int64 // of the end of the line, i.e. where to carry on reading from
+}
+
+type lineChunk_t struct {
+	seq   int // position of the chunk in the input
+	lines []LogLine_t
+}
+
+type decodedChunk_t struct {
+	seq  int
+	docs []map[string]interface{} // nil where the line couldnt be decoded
+	pos  []Position_t
+}
+
+// counts from a pipeline run, updated atomically as it goes
+type PipelineStats_t struct {
+	Lines        int64 // lines read from the input
+	DecodeErrors int64 // lines that werent valid json
+	Documents    int64 // decoded documents handed to the transform stage
+	start        time.Time
+}
+
+func (st *PipelineStats_t) String() string {
+
+	elapsed := time.Since(st.start)
+	lines := atomic.LoadInt64(&st.Lines)
+	rate := float64(lines) / elapsed.Seconds()
+	return fmt.Sprintf("%d lines (%d decode errors, %d documents) in %v, %.0f lines/s",
+		lines, atomic.LoadInt64(&st.DecodeErrors), atomic.LoadInt64(&st.Documents), elapsed.Round(time.Millisecond), rate)
+}
+
+// Reads json lines from r and passes them through the pipeline, see runPipeline. Stops at the end of r.
+func runReaderPipeline(r io.Reader, workers int, handle func(map[string]interface{}, Position_t)) (*PipelineStats_t, error) {
+
+	lines := make(chan LogLine_t, PIPELINE_CHUNK)
+
+	var readErr error
+	go func() {
+		defer close(lines)
+
+		scanner := bufio.NewScanner(r)
+		for scanner.Scan() {
+			lines <- LogLine_t{Text: scanner.Text()}
+		}
+		readErr = scanner.Err()
+	}()
+
+	st := runPipeline(lines, workers, handle, nil)
+	return st, readErr // lines has been closed so readErr is set
+}
+
+// Decodes json lines on workers goroutines and calls handle with each document in the order the lines
+// arrived, until lines is closed. handle and tick are only ever called from the calling goroutine so they
+// dont need to be safe for concurrent use. tick, if there is one, is called every PROGRESS_INTERVAL.
+func runPipeline(lines <-chan LogLine_t, workers int, handle func(map[string]interface{}, Position_t), tick func()) *PipelineStats_t {
+
+	if workers < 1 {
+		workers = 1
+	}
+	st := &PipelineStats_t{start: time.Now()}
+
+	chunks := make(chan lineChunk_t, workers*2)
+	decoded := make(chan decodedChunk_t, workers*2)
+
+	// reader, handing out the lines in chunks. A chunk is sent early if no more lines turn up for a while
+	// so that a live feed isnt held up waiting for the chunk to fill.
+	go func() {
+		defer close(chunks)
+
+		chunk := lineChunk_t{}
+		send := func() {
+			if len(chunk.lines) != 0 {
+				chunks <- chunk
+				chunk = lineChunk_t{seq: chunk.seq + 1}
+			}
+		}
+
+		idle := time.NewTicker(PIPELINE_IDLE)
+		defer idle.Stop()
+		for {
+			select {
+			case line, ok := <-lines:
+				if !ok {
+					send()
+					return
+				}
+				atomic.AddInt64(&st.Lines, 1)
+				chunk.lines = append(chunk.lines, line)
+				if len(chunk.lines) == PIPELINE_CHUNK {
+					send()
+				}
+			case <-idle.C:
+				send()
+			}
+		}
+	}()
+
+	// decoders
+	var wg sync.WaitGroup
+	for n := 0; n < workers; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for chunk := range chunks {
+				out := decodedChunk_t{seq: chunk.seq, docs: make([]map[string]interface{}, len(chunk.lines)), pos: make([]Position_t, len(chunk.lines))}
+				for i, line := range chunk.lines {
+					out.pos[i] = line.Position_t
+
+					//create a map of strings to empty interfaces to unmarshall json B&G logger data into
+					var result map[string]interface{}
+
+					//unmarshall the B&G data. Based on https://www.sohamkamani.com/golang/parsing-json/
+					if err := json.Unmarshal([]byte(line.Text), &result); err != nil {
+						fmt.Fprintln(os.Stderr, "error unmarshalling logger data", err)
+						atomic.AddInt64(&st.DecodeErrors, 1)
+						continue // error in the input data format so skip this line and move on.
+					}
+					out.docs[i] = result
+				}
+				decoded <- out
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(decoded)
+	}()
+
+	progress := time.NewTicker(PROGRESS_INTERVAL)
+	defer progress.Stop()
+
+	// transform, putting the chunks back in order
+	pending := map[int]decodedChunk_t{}
+	next := 0
+	for {
+		select {
+		case <-progress.C:
+			fmt.Printf("progress: %s\r\n", st)
+			if tick != nil {
+				tick()
+			}
+			continue
+
+		case chunk, ok := <-decoded:
+			if !ok {
+				return st
+			}
+			pending[chunk.seq] = chunk
+		}
+
+		for chunk, ok := pending[next]; ok; chunk, ok = pending[next] {
+			delete(pending, next)
+			next++
+			for i, doc := range chunk.docs {
+				if doc != nil {
+					atomic.AddInt64(&st.Documents, 1)
+					handle(doc, chunk.pos[i])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,622 @@
+package transform
+
+import (
+	"fmt"
+	"io/ioutil"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+)
+
+/*
+Polars
+------
+A polar is the boatspeed the boat does at each true wind speed and angle. BuildPolars makes them from sessions
+that have been imported, using the true wind documents (see truewind.go) and the boatspeed.
+
+Only steady sailing goes into a polar. The sessions are cut into POLAR_WINDOW long windows and a window is
+used if:
+
+	- the heading and boatspeed hardly changed in it (POLAR_STEADY_HEADING, POLAR_STEADY_SPEED)
+	- it isnt within POLAR_MANOEUVRE_GAP of a tack or gybe, i.e. of the wind changing sides
+	- the engine wasnt running, if there is engine data (see engine.go)
+
+The windows are binned by TWS (every POLAR_TWS_BIN knots) and TWA (every POLAR_TWA_BIN degrees, port and
+starboard together) and each bin's boatspeed is a percentile of its windows. The 50th percentile is what the
+boat usually does, the 90th or 95th what it does when it is sailed well, which makes a better target. Bins with
+fewer than MIN_POLAR_SAMPLES windows are left empty.
+
+For each TWS the best upwind and downwind VMG and the TWA they are sailed at are worked out from the bins.
+Polars are kept in the catalog under "<boat>-p<percentile>" and can be written out for Expedition, OpenCPN or
+as an ORC certificate style table of target speeds. Polars from elsewhere, e.g. a designer's VPP or a sailmaker,
+can be read in from Expedition or OpenCPN files with AddPolarFile and are kept under the name they are given.
+*/
+
+const POLAR_CATALOG = storage.CATALOG_PREFIX + "polars"
+
+const POLAR_WINDOW = 10 * time.Second
+const POLAR_STEADY_HEADING = 5.0 // degrees
+const POLAR_STEADY_SPEED = 0.2   // m/s
+const POLAR_MANOEUVRE_GAP = 30 * time.Second
+const MIN_POLAR_SAMPLES = 5
+
+const POLAR_TWS_BIN = 2.0 // knots
+const POLAR_TWA_BIN = 5.0 // degrees
+
+// the formats polars can be written in
+const POLAR_EXPEDITION = "expedition"
+const POLAR_OPENCPN = "opencpn"
+const POLAR_ORC = "orc"
+
+var PolarFormats = []string{POLAR_EXPEDITION, POLAR_OPENCPN, POLAR_ORC}
+
+// the true wind angles in an ORC certificate's table of target speeds
+var orcAngles = []float64{52, 60, 75, 90, 110, 120, 135, 150}
+
+// the best VMG at a wind speed
+type Optimum_t struct {
+	Tws   float64 `bson:"tws" json:"tws"`     // knots
+	Twa   float64 `bson:"twa" json:"twa"`     // degrees
+	Speed float64 `bson:"speed" json:"speed"` // knots
+	Vmg   float64 `bson:"vmg" json:"vmg"`     // knots
+}
+
+type Polar_t struct {
+	Name       string      `bson:"_id" json:"name"` // <boat>-p<percentile>
+	Boat       string      `bson:"boat" json:"boat"`
+	Percentile float64     `bson:"percentile" json:"percentile"`
+	Sessions   []string    `bson:"sessions" json:"sessions"`
+	SourceFile string      `bson:"sourcefile,omitempty" json:"sourceFile,omitempty"` // if it was read in rather than built
+	Created    time.Time   `bson:"created" json:"created"`
+	Tws        []float64   `bson:"tws" json:"tws"`           // knots, a column for each
+	Twa        []float64   `bson:"twa" json:"twa"`           // degrees, a row for each
+	Speed      [][]float64 `bson:"speed" json:"speed"`       // knots, [twa][tws]. 0 where there isnt enough data.
+	Samples    [][]int     `bson:"samples" json:"samples"`   // windows in each bin
+	Upwind     []Optimum_t `bson:"upwind" json:"upwind"`     // for each TWS
+	Downwind   []Optimum_t `bson:"downwind" json:"downwind"` // for each TWS
+}
+
+func polarName(boat string, percentile float64) string {
+	return fmt.Sprintf("%s-p%g", boat, percentile)
+}
+
+// a steady window of sailing
+type polarSample_t struct {
+	tws   float64 // knots
+	twa   float64 // degrees off the bow, 0 to 180
+	speed float64 // knots
+}
+
+// Builds a polar for each of the percentiles from the sessions and saves them in the catalog.
+func BuildPolars(sessions []string, boat string, percentiles []float64) ([]Polar_t, error) {
+
+	store := storage.Open()
+	defer store.Close()
+
+	var samples []polarSample_t
+	for _, session := range sessions {
+		s, err := polarSamples(store, session)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Printf("%s: %d steady windows\r\n", session, len(s))
+		samples = append(samples, s...)
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("no steady sailing with true wind found in %v", sessions)
+	}
+
+	// the speeds in each bin
+	bins := map[[2]float64][]float64{}
+	twsSet, twaSet := map[float64]bool{}, map[float64]bool{}
+	for _, s := range samples {
+		key := [2]float64{roundTo(s.twa, POLAR_TWA_BIN), roundTo(s.tws, POLAR_TWS_BIN)}
+		bins[key] = append(bins[key], s.speed)
+		twaSet[key[0]], twsSet[key[1]] = true, true
+	}
+
+	var polars []Polar_t
+	for _, p := range percentiles {
+
+		polar := Polar_t{
+			Name:       polarName(boat, p),
+			Boat:       boat,
+			Percentile: p,
+			Sessions:   sessions,
+			Created:    time.Now().UTC(),
+			Tws:        sortedKeys(twsSet),
+			Twa:        sortedKeys(twaSet),
+		}
+		for _, twa := range polar.Twa {
+			row, n := make([]float64, len(polar.Tws)), make([]int, len(polar.Tws))
+			for j, tws := range polar.Tws {
+				speeds := bins[[2]float64{twa, tws}]
+				n[j] = len(speeds)
+				if len(speeds) >= MIN_POLAR_SAMPLES {
+					row[j] = percentile(speeds, p)
+				}
+			}
+			polar.Speed = append(polar.Speed, row)
+			polar.Samples = append(polar.Samples, n)
+		}
+		polar.findOptima()
+
+		if err := store.Put(POLAR_CATALOG, polar.Name, polar); err != nil {
+			return nil, err
+		}
+		polars = append(polars, polar)
+	}
+	return polars, nil
+}
+
+// Reads a polar from the catalog
+func LoadPolar(store storage.Store, name string) (Polar_t, error) {
+
+	var polar Polar_t
+	err := store.Get(POLAR_CATALOG, name, &polar)
+	return polar, err
+}
+
+// works out the best upwind and downwind VMG for each TWS from the bins
+func (polar *Polar_t) findOptima() {
+
+	polar.Upwind, polar.Downwind = nil, nil
+	for j, tws := range polar.Tws {
+		up, down := Optimum_t{Tws: tws}, Optimum_t{Tws: tws}
+		for i, twa := range polar.Twa {
+			speed := polar.Speed[i][j]
+			if speed == 0 {
+				continue
+			}
+			vmg := speed * math.Cos(twa*math.Pi/180)
+			if twa < 90 && vmg > up.Vmg {
+				up = Optimum_t{tws, twa, speed, vmg}
+			}
+			if twa > 90 && -vmg > down.Vmg {
+				down = Optimum_t{tws, twa, speed, -vmg}
+			}
+		}
+		polar.Upwind = append(polar.Upwind, up)
+		polar.Downwind = append(polar.Downwind, down)
+	}
+}
+
+// Cuts a session into windows and returns the steady ones
+func polarSamples(store storage.Store, session string) ([]polarSample_t, error) {
+
+	type window_t struct {
+		start      time.Time
+		steady     bool
+		sample     polarSample_t
+		starboard  bool // wind from starboard
+		manoeuvre  bool // the wind changed sides in the window
+		motoring   bool
+		hasTrueTwa bool
+	}
+
+	// the engine, if there is engine data, is in its own collection
+	running := map[time.Time]bool{}
+	entry, err := LoadSession(store, session)
+	if err != nil {
+		return nil, err
+	}
+	if col, ok := entry.Collections[strings.TrimPrefix(ENGINE_RAPID_SUFFIX, "-")]; ok {
+		cursor, err := store.Range(col, FIELD_RPM, time.Time{}, time.Time{})
+		if err != nil {
+			return nil, err
+		}
+		for cursor.Next() {
+			if rpm, ok := cursor.Current().Lookup(FIELD_RPM).DoubleOK(); ok && rpm > 0 {
+				running[cursor.Current().Lookup(FIELD_TS).Time().Truncate(POLAR_WINDOW)] = true
+			}
+		}
+		cursor.Close()
+	}
+
+	cursor, err := store.Range(session, "", time.Time{}, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var windows []window_t
+	var b *bucket_t
+	finish := func() {
+		if b == nil {
+			return
+		}
+		w := window_t{start: b.start, motoring: running[b.start]}
+		stw := Aggregate(FIELD_BOATSPEED, b.values[FIELD_BOATSPEED])
+		heading := Aggregate(FIELD_MAG_HEADING, b.values[FIELD_MAG_HEADING])
+		tws := Aggregate(FIELD_TWS, b.values[FIELD_TWS])
+		twa := Aggregate(FIELD_TWA, b.values[FIELD_TWA])
+
+		if twa.N != 0 {
+			w.hasTrueTwa = true
+			w.starboard = twa.Mean < 180
+			for _, v := range b.values[FIELD_TWA] {
+				if (v < 180) != w.starboard {
+					w.manoeuvre = true
+				}
+			}
+		}
+		w.steady = stw.N >= MIN_READINGS && heading.N >= MIN_READINGS && tws.N >= MIN_READINGS &&
+			stw.Mean >= MIN_SPEED && stw.StdDev <= POLAR_STEADY_SPEED && heading.StdDev <= POLAR_STEADY_HEADING
+		w.sample = polarSample_t{tws: tws.Mean * MS2KNOTS, twa: math.Abs(angleDifference(twa.Mean, 0)), speed: stw.Mean * MS2KNOTS}
+		windows = append(windows, w)
+	}
+
+	for cursor.Next() {
+		doc := cursor.Current()
+		ts, ok := doc.Lookup(FIELD_TS).TimeOK()
+		if !ok {
+			continue
+		}
+		if start := ts.Truncate(POLAR_WINDOW); b == nil || !b.start.Equal(start) {
+			finish()
+			b = newBucket(start, "")
+		}
+		for _, field := range []string{FIELD_BOATSPEED, FIELD_MAG_HEADING, FIELD_TWS, FIELD_TWA} {
+			if v, ok := doc.Lookup(field).DoubleOK(); ok {
+				b.add(field, v)
+			}
+		}
+	}
+	finish()
+	if err := cursor.Err(); err != nil {
+		return nil, err
+	}
+
+	// the times of the tacks and gybes: windows where the wind changed sides, or changed from the last one
+	var manoeuvres []time.Time
+	for i, w := range windows {
+		if w.manoeuvre || (i > 0 && w.hasTrueTwa && windows[i-1].hasTrueTwa && w.starboard != windows[i-1].starboard) {
+			manoeuvres = append(manoeuvres, w.start)
+		}
+	}
+
+	var samples []polarSample_t
+	for _, w := range windows {
+		if !w.steady || w.motoring || !w.hasTrueTwa || nearManoeuvre(w.start, manoeuvres) {
+			continue
+		}
+		samples = append(samples, w.sample)
+	}
+	return samples, nil
+}
+
+// true if a window starting at t is within POLAR_MANOEUVRE_GAP of a manoeuvre. manoeuvres are in time order.
+func nearManoeuvre(t time.Time, manoeuvres []time.Time) bool {
+
+	i := sort.Search(len(manoeuvres), func(i int) bool { return !manoeuvres[i].Before(t.Add(-POLAR_MANOEUVRE_GAP)) })
+	return i < len(manoeuvres) && manoeuvres[i].Before(t.Add(POLAR_WINDOW+POLAR_MANOEUVRE_GAP))
+}
+
+// Writing polars out
+
+// Writes a polar in one of PolarFormats
+func (polar *Polar_t) Format(format string) (string, error) {
+
+	switch format {
+	case POLAR_EXPEDITION:
+		return polar.expedition(), nil
+	case POLAR_OPENCPN:
+		return polar.openCPN(), nil
+	case POLAR_ORC:
+		return polar.orc(), nil
+	}
+	return "", fmt.Errorf("unknown polar format %s, expected one of %s", format, strings.Join(PolarFormats, ", "))
+}
+
+// a line per TWS: the TWS followed by TWA and boatspeed pairs, tab separated, leaving out empty bins
+func (polar *Polar_t) expedition() string {
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "!Expedition polar - %s, %gth percentile from %s\n", polar.Boat, polar.Percentile, strings.Join(polar.Sessions, ", "))
+	for j, tws := range polar.Tws {
+		fmt.Fprintf(&sb, "%g", tws)
+		for i, twa := range polar.Twa {
+			if polar.Speed[i][j] != 0 {
+				fmt.Fprintf(&sb, "\t%g\t%.2f", twa, polar.Speed[i][j])
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// a header of the TWS then a line per TWA, semicolon separated, empty bins left blank
+func (polar *Polar_t) openCPN() string {
+
+	var sb strings.Builder
+	sb.WriteString("TWA\\TWS")
+	for _, tws := range polar.Tws {
+		fmt.Fprintf(&sb, ";%g", tws)
+	}
+	sb.WriteString("\n")
+	for i, twa := range polar.Twa {
+		fmt.Fprintf(&sb, "%g", twa)
+		for j := range polar.Tws {
+			sb.WriteString(";")
+			if polar.Speed[i][j] != 0 {
+				fmt.Fprintf(&sb, "%.2f", polar.Speed[i][j])
+			}
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// like the table of target speeds on an ORC certificate: beat angle and VMG, the speed at set angles and run
+// VMG and gybe angle, for each TWS. Speeds at the set angles are interpolated between the bins either side.
+func (polar *Polar_t) orc() string {
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s %gth percentile\n", polar.Boat, polar.Percentile)
+	sb.WriteString("Wind Velocity")
+	for _, tws := range polar.Tws {
+		fmt.Fprintf(&sb, "\t%gkt", tws)
+	}
+	sb.WriteString("\n")
+
+	row := func(name string, value func(j int) float64) {
+		sb.WriteString(name)
+		for j := range polar.Tws {
+			if v := value(j); v != 0 {
+				fmt.Fprintf(&sb, "\t%.1f", v)
+			} else {
+				sb.WriteString("\t-")
+			}
+		}
+		sb.WriteString("\n")
+	}
+
+	row("Beat Angles", func(j int) float64 { return polar.Upwind[j].Twa })
+	row("Beat VMG", func(j int) float64 { return polar.Upwind[j].Vmg })
+	for _, angle := range orcAngles {
+		row(fmt.Sprintf("%g°", angle), func(j int) float64 { return polar.SpeedAt(polar.Tws[j], angle) })
+	}
+	row("Run VMG", func(j int) float64 { return polar.Downwind[j].Vmg })
+	row("Gybe Angles", func(j int) float64 { return polar.Downwind[j].Twa })
+	return sb.String()
+}
+
+// The polar boatspeed at tws knots and twa degrees off the bow, interpolated between the bins around it.
+// Returns 0 if the bins around it are empty or it is off the edge of the polar.
+func (polar *Polar_t) SpeedAt(tws float64, twa float64) float64 {
+
+	twa = math.Abs(angleDifference(twa, 0))
+	i0, i1, fi := bracket(polar.Twa, twa, POLAR_TWA_BIN/2)
+	j0, j1, fj := bracket(polar.Tws, tws, POLAR_TWS_BIN/2)
+	if i0 < 0 || j0 < 0 {
+		return 0
+	}
+
+	corners := []float64{polar.Speed[i0][j0], polar.Speed[i0][j1], polar.Speed[i1][j0], polar.Speed[i1][j1]}
+	for _, c := range corners {
+		if c == 0 {
+			return 0
+		}
+	}
+	return (corners[0]*(1-fj)+corners[1]*fj)*(1-fi) + (corners[2]*(1-fj)+corners[3]*fj)*fi
+}
+
+// the indexes either side of x in a sorted list and how far x is between them. Up to margin past the ends x is
+// clamped to them, further than that or if the list is empty -1 is returned.
+func bracket(list []float64, x float64, margin float64) (int, int, float64) {
+
+	switch {
+	case len(list) == 0, x < list[0]-margin, x > list[len(list)-1]+margin:
+		return -1, -1, 0
+	case x <= list[0]:
+		return 0, 0, 0
+	case x >= list[len(list)-1]:
+		return len(list) - 1, len(list) - 1, 0
+	}
+	i := sort.SearchFloat64s(list, x)
+	if list[i] == x {
+		return i, i, 0
+	}
+	return i - 1, i, (x - list[i-1]) / (list[i] - list[i-1])
+}
+
+// Reading polars in
+
+// Reads a polar from an Expedition or OpenCPN file, as written by Format, and saves it in the catalog as name.
+// The format is worked out from the file: OpenCPN files start with a TWA\TWS header.
+func AddPolarFile(file string, boat string, name string) (Polar_t, error) {
+
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return Polar_t{}, err
+	}
+	polar, err := ParsePolar(string(data))
+	if err != nil {
+		return polar, fmt.Errorf("reading %s: %s", file, err)
+	}
+	polar.Name, polar.Boat, polar.SourceFile, polar.Created = name, boat, file, time.Now().UTC()
+
+	store := storage.Open()
+	defer store.Close()
+	return polar, store.Put(POLAR_CATALOG, polar.Name, polar)
+}
+
+// Reads a polar in Expedition or OpenCPN format. Only the table is filled in, with the optima worked out from it.
+func ParsePolar(text string) (Polar_t, error) {
+
+	var lines [][]string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "!") {
+			continue
+		}
+		fields := strings.FieldsFunc(line, func(r rune) bool {
+			return r == ';' || r == ',' || r == '\t' || r == ' '
+		})
+		if len(fields) == 0 {
+			continue // only separators, e.g. the ;;; a spreadsheet leaves at the end
+		}
+		lines = append(lines, fields)
+	}
+	if len(lines) == 0 {
+		return Polar_t{}, fmt.Errorf("no polar in the file")
+	}
+
+	var polar Polar_t
+	var err error
+	if strings.HasPrefix(strings.ToUpper(lines[0][0]), "TWA") {
+		polar, err = parseOpenCPN(lines)
+	} else {
+		polar, err = parseExpedition(lines)
+	}
+	if err != nil {
+		return polar, err
+	}
+	for j := 1; j < len(polar.Tws); j++ {
+		if polar.Tws[j] <= polar.Tws[j-1] {
+			return polar, fmt.Errorf("the wind speeds must be in increasing order")
+		}
+	}
+	polar.findOptima()
+	return polar, nil
+}
+
+// a header of the TWS then a row per TWA. Blank or 0 speeds are empty bins.
+func parseOpenCPN(lines [][]string) (Polar_t, error) {
+
+	var polar Polar_t
+	for _, f := range lines[0][1:] {
+		tws, err := strconv.ParseFloat(f, 64)
+		if err != nil {
+			return polar, fmt.Errorf("bad TWS %q", f)
+		}
+		polar.Tws = append(polar.Tws, tws)
+	}
+
+	for _, line := range lines[1:] {
+		twa, err := strconv.ParseFloat(line[0], 64)
+		if err != nil {
+			return polar, fmt.Errorf("bad TWA %q", line[0])
+		}
+		if twa == 0 {
+			continue
+		}
+		// blank bins are lost when the fields are split, so rows must be full
+		if len(line)-1 != len(polar.Tws) {
+			return polar, fmt.Errorf("TWA %g has %d speeds for %d wind speeds", twa, len(line)-1, len(polar.Tws))
+		}
+		row := make([]float64, len(polar.Tws))
+		for j, f := range line[1:] {
+			if row[j], err = strconv.ParseFloat(f, 64); err != nil {
+				return polar, fmt.Errorf("bad speed %q at TWA %g", f, twa)
+			}
+		}
+		polar.Twa = append(polar.Twa, twa)
+		polar.Speed = append(polar.Speed, row)
+		polar.Samples = append(polar.Samples, make([]int, len(polar.Tws)))
+	}
+	return polar, nil
+}
+
+// a line per TWS: the TWS then TWA and speed pairs. The angles neednt be the same for each TWS so the table
+// has every angle in the file, with the speeds at the ones a TWS doesnt have interpolated between its angles
+// either side.
+func parseExpedition(lines [][]string) (Polar_t, error) {
+
+	var polar Polar_t
+	type point_t struct{ twa, speed float64 }
+	var rows [][]point_t
+	twaSet := map[float64]bool{}
+	for _, line := range lines {
+		var values []float64
+		for _, f := range line {
+			v, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				return polar, fmt.Errorf("bad number %q", f)
+			}
+			values = append(values, v)
+		}
+		if len(values)%2 != 1 {
+			return polar, fmt.Errorf("TWS %g doesnt have a speed for every angle", values[0])
+		}
+		var row []point_t
+		for i := 1; i < len(values); i += 2 {
+			if values[i] > 0 && values[i+1] > 0 {
+				row = append(row, point_t{values[i], values[i+1]})
+				twaSet[values[i]] = true
+			}
+		}
+		sort.Slice(row, func(a, b int) bool { return row[a].twa < row[b].twa })
+		polar.Tws = append(polar.Tws, values[0])
+		rows = append(rows, row)
+	}
+
+	polar.Twa = sortedKeys(twaSet)
+	for _, twa := range polar.Twa {
+		speeds := make([]float64, len(polar.Tws))
+		for j, row := range rows {
+			for k := 0; k < len(row); k++ {
+				if row[k].twa == twa {
+					speeds[j] = row[k].speed
+				} else if k > 0 && row[k-1].twa < twa && twa < row[k].twa {
+					f := (twa - row[k-1].twa) / (row[k].twa - row[k-1].twa)
+					speeds[j] = row[k-1].speed + (row[k].speed-row[k-1].speed)*f
+				}
+			}
+		}
+		polar.Speed = append(polar.Speed, speeds)
+		polar.Samples = append(polar.Samples, make([]int, len(polar.Tws)))
+	}
+	return polar, nil
+}
+
+// Parses a comma separated list of percentiles, e.g. "50,90"
+func ParsePercentiles(list string) ([]float64, error) {
+
+	var percentiles []float64
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+		var v float64
+		if _, err := fmt.Sscanf(p, "%g", &v); err != nil || v <= 0 || v > 100 {
+			return nil, fmt.Errorf("bad percentile %q", p)
+		}
+		percentiles = append(percentiles, v)
+	}
+	if len(percentiles) == 0 {
+		return nil, fmt.Errorf("no percentiles in %q", list)
+	}
+	return percentiles, nil
+}
+
+// the p'th percentile of values, interpolated between the values either side
+func percentile(values []float64, p float64) float64 {
+
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	pos := p / 100 * float64(len(sorted)-1)
+	i := int(pos)
+	if i >= len(sorted)-1 {
+		return sorted[len(sorted)-1]
+	}
+	return sorted[i] + (sorted[i+1]-sorted[i])*(pos-float64(i))
+}
+
+func roundTo(v float64, size float64) float64 {
+	return math.Round(v/size) * size
+}
+
+func sortedKeys(set map[float64]bool) []float64 {
+
+	keys := make([]float64, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Float64s(keys)
+	return keys
+}
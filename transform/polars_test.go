@@ -0,0 +1,142 @@
+package transform
+
+import (
+	"fmt"
+	"testing"
+)
+
+// 6 and 10 knots, 45 and 90 degrees
+func testPolar() Polar_t {
+	return Polar_t{Tws: []float64{6, 10}, Twa: []float64{45, 90}, Speed: [][]float64{{5, 6}, {6, 7.5}}}
+}
+
+func TestPercentile(t *testing.T) {
+
+	values := []float64{5, 3, 1, 4, 2}
+	for _, tt := range []struct{ p, want float64 }{{0, 1}, {50, 3}, {90, 4.6}, {100, 5}} {
+		if got := percentile(values, tt.p); !approx(got, tt.want, TEST_TOLERANCE) {
+			t.Errorf("%gth percentile: got %f, want %f", tt.p, got, tt.want)
+		}
+	}
+	if values[0] != 5 {
+		t.Errorf("percentile sorted the values it was given")
+	}
+	if got := percentile([]float64{7}, 50); got != 7 {
+		t.Errorf("one value: got %f", got)
+	}
+}
+
+func TestBracket(t *testing.T) {
+
+	list := []float64{6, 10, 14}
+	tests := []struct {
+		x      float64
+		i0, i1 int
+		f      float64
+	}{
+		{8, 0, 1, 0.5},
+		{13, 1, 2, 0.75},
+		{10, 1, 1, 0},
+		{5.5, 0, 0, 0},  // within the margin below the first
+		{14.9, 2, 2, 0}, // and above the last
+		{4, -1, -1, 0},  // too far off the ends
+		{15.5, -1, -1, 0},
+	}
+	for _, tt := range tests {
+		i0, i1, f := bracket(list, tt.x, 1)
+		if i0 != tt.i0 || i1 != tt.i1 || !approx(f, tt.f, TEST_TOLERANCE) {
+			t.Errorf("%g: got %d %d %f, want %d %d %f", tt.x, i0, i1, f, tt.i0, tt.i1, tt.f)
+		}
+	}
+	if i0, _, _ := bracket(nil, 8, 1); i0 != -1 {
+		t.Errorf("empty list: got %d", i0)
+	}
+}
+
+func TestSpeedAt(t *testing.T) {
+
+	polar := testPolar()
+	tests := []struct {
+		name     string
+		tws, twa float64
+		want     float64
+	}{
+		{"on a bin", 6, 45, 5},
+		{"between the bins", 8, 67.5, (5.5 + 6.75) / 2},
+		{"port tack", 10, 270, 7.5},
+		{"port tack as a negative angle", 6, -45, 5},
+		{"just past the wind speeds", 10.5, 90, 7.5},
+		{"too windy", 20, 90, 0},
+		{"too close to the wind", 6, 30, 0},
+	}
+	for _, tt := range tests {
+		if got := polar.SpeedAt(tt.tws, tt.twa); !approx(got, tt.want, TEST_TOLERANCE) {
+			t.Errorf("%s: got %f, want %f", tt.name, got, tt.want)
+		}
+	}
+
+	// not enough data in a corner
+	polar.Speed[1][1] = 0
+	if got := polar.SpeedAt(8, 67.5); got != 0 {
+		t.Errorf("empty bin: got %f, want 0", got)
+	}
+	if got := polar.SpeedAt(6, 45); got != 5 {
+		t.Errorf("full bin next to an empty one: got %f, want 5", got)
+	}
+}
+
+func TestParsePolar(t *testing.T) {
+
+	want := testPolar()
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"expedition", "!Expedition polar\n6\t45\t5\t90\t6\n10\t45\t6\t90\t7.5\n"},
+		{"expedition with spaces and the angles out of order", "6 90 6 45 5\r\n10 45 6 90 7.5\r\n"},
+		{"opencpn", "TWA\\TWS;6;10\n45;5;6\n90;6;7.5\n"},
+		{"opencpn with a 0 row", "TWA\\TWS;6;10\n0;0;0\n45;5;6\n90;6;7.5\n"},
+		{"opencpn with lines of only separators", ";;;\nTWA\\TWS;6;10\n45;5;6\n;;;\n90;6;7.5\n;;\n"},
+	}
+	for _, tt := range tests {
+		polar, err := ParsePolar(tt.text)
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if fmt.Sprint(polar.Tws, polar.Twa, polar.Speed) != fmt.Sprint(want.Tws, want.Twa, want.Speed) {
+			t.Errorf("%s: got %v %v %v", tt.name, polar.Tws, polar.Twa, polar.Speed)
+		}
+		if len(polar.Upwind) != len(polar.Tws) || len(polar.Downwind) != len(polar.Tws) {
+			t.Errorf("%s: got %d upwind and %d downwind optima for %d wind speeds", tt.name, len(polar.Upwind), len(polar.Downwind), len(polar.Tws))
+		}
+	}
+
+	// the angles neednt be the same for every wind speed
+	polar, err := ParsePolar("6 45 5 90 6\n10 50 6 90 7.5\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(polar.Twa) != "[45 50 90]" || polar.Speed[0][1] != 0 || !approx(polar.Speed[1][0], 5+5.0/45, TEST_TOLERANCE) {
+		t.Errorf("mixed angles: got %v %v", polar.Twa, polar.Speed)
+	}
+
+	// and what Format writes can be read back
+	original := testPolar()
+	for _, format := range []string{POLAR_EXPEDITION, POLAR_OPENCPN} {
+		text, err := original.Format(format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		polar, err := ParsePolar(text)
+		if err != nil || fmt.Sprint(polar.Tws, polar.Twa, polar.Speed) != fmt.Sprint(want.Tws, want.Twa, want.Speed) {
+			t.Errorf("%s round trip: got %v %v %v, %v", format, polar.Tws, polar.Twa, polar.Speed, err)
+		}
+	}
+
+	for _, bad := range []string{"", "!just a comment\n", "10 45 6\n6 45 5\n", "6 45 5 90\n", "TWA\\TWS;6;10\n45;5\n", "TWA\\TWS;6;x\n45;5;6\n", ";;;\n,,\n"} {
+		if _, err := ParsePolar(bad); err == nil {
+			t.Errorf("%q: got no error", bad)
+		}
+	}
+}
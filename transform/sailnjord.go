@@ -6,95 +6,46 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
-	"math"
 	"os"
 	"time"
-)
 
-const ms2knots = 1.944 //convert m/s to knots
+	"github.com/m-h-w/nmea-logger/wind"
+)
 
-func calculateTWS(dataStore map[string]interface{}) float64 {
+const MS2KNOTS = 1.944 //convert m/s to knots
 
-	/*
-	   Using the cosine rule (a^2=b^2+c^2-2bcCosA)
-	   TWS = SQRT (BoatSpeed^2 + AWS^2 - 2xBoatSpeedxAWS x Cos AWA)
-	*/
+// Works out the true wind with the wind package, see wind/wind.go, so it is the same as the true wind written
+// by the transformer. There is no true wind until there is a boatspeed to work it out from, and no TWD until
+// there is a heading and the variation to make it a true heading, so those columns are left empty until then.
+func calculateTrueWindData(dataStore map[string]interface{}) {
 
-	b, ok := dataStore["BoatSpeed"].(float64) // boatspeed may not have been written in the early start up phase
+	delete(dataStore, "TWS")
+	delete(dataStore, "TWA")
+	delete(dataStore, "TWD")
 
+	stw, ok := dataStore["BoatSpeed"].(float64) // boatspeed may not have been written in the early start up phase
 	if !ok {
-
-		return 0
+		return
 	}
 
-	b2 := b * b
-
-	c2 := dataStore["AWS"].(float64) * dataStore["AWS"].(float64)
-
-	bc := dataStore["BoatSpeed"].(float64) * dataStore["AWS"].(float64)
-
-	awaRads := (dataStore["AWA"].(float64) / 360) * 2 * math.Pi
-
-	tws := math.Sqrt(b2 + c2 - 2*bc*math.Cos(awaRads))
-
-	return tws
-}
-
-func calculateTWA(dataStore map[string]interface{}, tws float64) float64 {
-
-	/*
-		Use the cosine rule again ...
-
-		Sine rule is harder to use because the angles we need is often >90
-		and the sin of that angle has an equivalent angle less than 90 degrees.
-
-		By using the cosine rule on the angle between the apparent and true wind (A)
-		which is always less than 90 degrees its more predicatable.
-	*/
-
-	// a^2=b^2+c^2 -2bcCosA
-	// where a=boatspeed b= apparent wind speed, c= true wind speed and A is the angle between TWS and AWS
-	// rearranging gives:
-	// cosA = (b^2+c^2-a^2)/2bc
-	// We can then find the angle we need by subtracting angle A plus AWA from 180 (sum of internal angles of a triangle)
-	// Since the  angle we have just found is the supplementary angle to TWA we need to subtract that from 180
-	// TWA = 180 - (180-A-AWA) = A+AWA
-
-	a, ok := dataStore["BoatSpeed"].(float64) // boatspeed may not have been written in the early start up phase
-
-	if !ok {
-		return 0
+	// boatspeed and windspeed are both in knots so the true wind speed is too
+	in := wind.Apparent_t{Awa: dataStore["AWA"].(float64), Aws: dataStore["AWS"].(float64), Stw: stw}
+	if heel, ok := dataStore["Heel"].(float64); ok {
+		if WindCorrection.Heel {
+			in.Heel = heel
+		}
+		in.Leeway = wind.EstimateLeeway(in.Awa, heel, stw, WindCorrection.Leeway)
+	}
+	heading, hasHeading := dataStore["Heading"].(float64) // magnetic
+	variation, hasVariation := dataStore["Variation"].(float64)
+	in.Heading = normaliseDegrees(heading + variation)
+
+	trueWind := wind.TrueWind(in)
+	dataStore["TWS"] = trueWind.Tws
+	dataStore["TWA"] = trueWind.Twa
+	if hasHeading && hasVariation {
+		dataStore["TWD"] = trueWind.Twd
 	}
-
-	a2 := a * a
-	b2 := dataStore["AWS"].(float64) * dataStore["AWS"].(float64)
-	c2 := tws * tws
-	bc := tws * dataStore["AWS"].(float64)
-	/*
-		fmt.Printf("a2:%f\nb2:%f\nc2:%f\nbc:%f\n", a2, b2, c2, bc)
-		fmt.Printf("CosA %f  \n", (b2+c2-a2)/2*bc)
-	*/
-	Arads := math.Acos((b2 + c2 - a2) / (2 * bc))
-	Adeg := (Arads / (2 * math.Pi)) * 360
-
-	twa := Adeg + dataStore["AWA"].(float64)
-
-	return twa
-}
-
-func storeTrueWindData(dataStore map[string]interface{}, tws float64, twa float64) {
-
-	dataStore["TWS"] = tws // boatspeed and windspeed (inputs to TWS) are in knots so no need to convert from m/s
-	dataStore["TWA"] = twa
-}
-
-func calculateTrueWindData(dataStore map[string]interface{}) {
-
-	tws := calculateTWS(dataStore) // needs to be done first because tws is needed for twa.
-
-	twa := calculateTWA(dataStore, tws)
-
-	storeTrueWindData(dataStore, tws, twa)
 }
 
 func storeTimestamp(loggerData map[string]interface{}, dataStore map[string]interface{}) {
@@ -149,7 +100,7 @@ func storeSpeed(loggerData map[string]interface{}, dataStore map[string]interfac
 
 	// if there is more than 1 boatspeed between two position readings then the last one will win
 	// ToDo: look at averaging
-	dataStore["BoatSpeed"] = fields["Speed Water Referenced"].(float64) * ms2knots
+	dataStore["BoatSpeed"] = fields["Speed Water Referenced"].(float64) * MS2KNOTS
 
 	if debug {
 		fmt.Printf("%f\n", dataStore["BoatSpeed"])
@@ -164,6 +115,9 @@ func storeHeading(loggerData map[string]interface{}, dataStore map[string]interf
 
 	fields := loggerData["fields"].(map[string]interface{})
 	dataStore["Heading"] = fields["Heading"].(float64)
+	if variation, ok := fields["Variation"].(float64); ok { // not always sent, the last one is kept until it is
+		dataStore["Variation"] = variation
+	}
 
 	if debug {
 		fmt.Printf("%f\n", dataStore["Heading"])
@@ -179,13 +133,13 @@ func storeWindData(loggerData map[string]interface{}, dataStore map[string]inter
 
 	fields := loggerData["fields"].(map[string]interface{})
 	dataStore["AWA"] = fields["Wind Angle"].(float64)
-	dataStore["AWS"] = fields["Wind Speed"].(float64) * ms2knots
+	dataStore["AWS"] = fields["Wind Speed"].(float64) * MS2KNOTS
 
 	if debug {
 		fmt.Printf("AWA: %f AWS: %f\n", dataStore["AWA"], dataStore["AWS"])
 	}
 
-	// calculate true wind angle and true windspeed from apparent wind speed and andgle and COG & SOG
+	// calculate true wind speed, angle and direction from the apparent wind, boatspeed, heading and heel
 	calculateTrueWindData(dataStore)
 }
 
@@ -199,7 +153,7 @@ func storeCOGandSOG(loggerData map[string]interface{}, dataStore map[string]inte
 
 	if _, ok := fields["COG"].(float64); ok { // some times there is no data in the incoming json for some reason.
 		dataStore["COG"] = fields["COG"].(float64)
-		dataStore["SOG"] = fields["SOG"].(float64) * ms2knots
+		dataStore["SOG"] = fields["SOG"].(float64) * MS2KNOTS
 
 		if debug {
 			fmt.Printf("COG:%f SOG:%f\n", dataStore["COG"], dataStore["SOG"])
@@ -248,7 +202,7 @@ const (
 )
 
 // look for the first "Position, Rapid Update" json document in the B&G logger output stream
-func sync(loggerData map[string]interface{}, dataStore map[string]interface{}) State {
+func syncToPosition(loggerData map[string]interface{}, dataStore map[string]interface{}) State {
 
 	if loggerData["description"] == "Position, Rapid Update" {
 
@@ -337,7 +291,7 @@ func storingDataPoints(loggerData map[string]interface{}, dataStore map[string]i
 // The current columns are:
 // 		ISODateTimeUTC,Lat,Lon, BoatSpeed, Heading
 
-var columns = [...]string{"ISODateTimeUTC", "Lat", "Lon", "BoatSpeed", "Heading", "AWA", "AWS", "TWS", "TWA", "COG", "SOG", "Heel", "Pitch"}
+var columns = [...]string{"ISODateTimeUTC", "Lat", "Lon", "BoatSpeed", "Heading", "AWA", "AWS", "TWS", "TWA", "TWD", "COG", "SOG", "Heel", "Pitch"}
 
 // Put output in CSV format as per https://www.sailnjord.com/data-sources/csv/
 func formattingSnOutput(dataStore map[string]interface{}, datawriter *bufio.Writer) State {
@@ -420,6 +374,13 @@ func formattingSnOutput(dataStore map[string]interface{}, datawriter *bufio.Writ
 			} else {
 				row += ","
 			}
+		case "TWD":
+			if dataStore["TWD"] != nil {
+				row += ","
+				row += fmt.Sprintf("%f", dataStore["TWD"].(float64))
+			} else {
+				row += ","
+			}
 		case "COG":
 			if dataStore["COG"] != nil {
 				row += ","
@@ -527,7 +488,7 @@ func SailNjordConverter(file string) {
 		case syncing:
 			// Wait for the GPS to start sending position updates as every row needs a
 			// a time stamp and a position associated with it
-			s = sync(bgJsonInput, dataStore)
+			s = syncToPosition(bgJsonInput, dataStore)
 
 		case storingBGdataPoints:
 			s = storingDataPoints(bgJsonInput, dataStore, datawriter)
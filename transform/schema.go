@@ -0,0 +1,88 @@
+package transform
+
+/*
+Measurement schema
+------------------
+Every document written to the data store follows the same field naming scheme:
+
+	- field names are all lower case with no separators or camel case, e.g. "magheading" not "magHeading"
+	- every document has "ts" (UTC timestamp) and a "metadata" sub document with at least "source" in it.
+	  These are the time and meta fields of the time-series collections, see mongodb/timeseries.go
+	- the field(s) holding the reading are named after the measurement, not the Go struct field, and are unique
+	  across measurement types. Several measurement types share one collection and are told apart by which
+	  reading field a document has, e.g. ReadAll(FIELD_LAT, ...) returns only position documents.
+	- readings are stored in the units the canboat analyzer outputs them in: angles in degrees, speeds in m/s.
+	  Conversions (e.g. to knots) happen on the way out, not on the way in.
+
+The struct tags on the measurement types must use these names. Documents written before the scheme was
+introduced used the lower cased Go field names, legacyFieldNames maps those to the current names and is
+used by MigrateCollection to rewrite old collections.
+*/
+
+const FIELD_TS = "ts"
+const FIELD_METADATA = "metadata"
+const FIELD_SOURCE = "source" // inside metadata
+
+// reading fields for each measurement type
+const FIELD_LAT = "lat"                // position, degrees
+const FIELD_LONG = "long"              // position, degrees
+const FIELD_PITCH = "pitch"            // attitude, degrees
+const FIELD_ROLL = "roll"              // attitude, degrees. Heel.
+const FIELD_WIND_ANGLE = "windangle"   // apparent wind angle, degrees
+const FIELD_WIND_SPEED = "windspeed"   // apparent wind speed, m/s
+const FIELD_COG = "cog"                // course over ground, degrees true
+const FIELD_SOG = "sog"                // speed over ground, m/s
+const FIELD_MAG_HEADING = "magheading" // compass heading, degrees magnetic
+const FIELD_BOATSPEED = "boatspeed"    // speed through the water, m/s
+const FIELD_RPM = "rpm"                // engine speed, see engine.go
+const FIELD_FUEL_RATE = "fuelrate"     // litres per hour, see engine.go
+const FIELD_VOLTAGE = "voltage"        // battery status, see engine.go
+const FIELD_SOC = "soc"                // dc detailed status, see engine.go
+const FIELD_TWS = "tws"                // true wind speed, m/s, see truewind.go
+const FIELD_TWA = "twa"                // true wind angle, degrees
+const FIELD_TWD = "twd"                // true wind direction, degrees
+const FIELD_GWS = "gws"                // ground wind speed, m/s
+const FIELD_GWD = "gwd"                // ground wind direction, degrees
+
+// fields added to the snapshots, see performance.go
+const FIELD_POLAR_SPEED = "polarspeed"   // m/s
+const FIELD_POLAR_PERF = "polarperf"     // percent of polarspeed
+const FIELD_TARGET_SPEED = "targetspeed" // m/s
+const FIELD_TARGET_TWA = "targettwa"     // degrees off the bow
+const FIELD_VMG = "vmg"                  // m/s
+const FIELD_VMC = "vmc"                  // m/s
+
+// the tidal current, see current.go
+const FIELD_SET = "set"     // direction the current flows to, degrees true
+const FIELD_DRIFT = "drift" // m/s
+
+// reading fields that are angles which wrap round at 360, so need circular statistics, see aggregate.go.
+// Pitch and roll never get near 180 so are treated as ordinary numbers.
+var CircularFields = map[string]bool{
+	FIELD_WIND_ANGLE:  true,
+	FIELD_MAG_HEADING: true,
+	FIELD_COG:         true,
+	FIELD_TWA:         true,
+	FIELD_TWD:         true,
+	FIELD_GWD:         true,
+	FIELD_SET:         true,
+}
+
+// direction -> speed, for reading fields that are read together as a vector, so are averaged as one, see
+// aggregate.go. Averaged on their own a current swinging round comes out as strong as it was all along.
+var VectorFields = map[string]string{
+	FIELD_SET: FIELD_DRIFT,
+}
+
+// old field name -> current field name. Top level and metadata fields are listed separately because
+// "speed" etc only mean something in context.
+var legacyFieldNames = map[string]string{
+	"angle":              FIELD_WIND_ANGLE,
+	"speed":              FIELD_WIND_SPEED,
+	"indicatedboatspeed": FIELD_BOATSPEED,
+}
+
+var legacyMetadataNames = map[string]string{
+	"datasource":      FIELD_SOURCE,
+	"speedcorrectiom": "speedcorrection", // typo in the original struct field name
+}
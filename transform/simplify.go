@@ -0,0 +1,152 @@
+package transform
+
+import (
+	"math"
+	"sort"
+)
+
+/*
+Track simplification
+--------------------
+A long race has thousands of positions even in the low res views, most of them on straight legs where they add
+nothing to the track drawn on the map. The Douglas-Peucker algorithm keeps the positions that matter to the
+shape of the track (tacks, gybes and mark roundings) and drops the ones that are within a tolerance of the
+straight line between the positions either side.
+
+Rather than simplifying for one tolerance, trackImportance works out for every position the largest tolerance
+at which Douglas-Peucker would keep it. Simplifying for a tolerance is then keeping the positions more
+important than it, and simplifying to a number of points is keeping that many of the most important ones,
+which gives the same track as Douglas-Peucker would for some tolerance.
+*/
+
+const EARTH_RADIUS = 6371000.0 // metres
+
+// the default tolerance used when building the low res views, in metres
+const TRACK_TOLERANCE = 2.0
+
+// Simplifies a track to within tolerance metres. The first and last positions are always kept.
+func SimplifyTrack(track []PositionData_t, tolerance float64) []PositionData_t {
+
+	importance := trackImportance(trackPoints(track))
+	var simplified []PositionData_t
+	for i, p := range track {
+		if importance[i] > tolerance {
+			simplified = append(simplified, p)
+		}
+	}
+	return simplified
+}
+
+// Simplifies a track to no more than maxPoints positions, keeping the most important ones.
+func SimplifyTrackTo(track []PositionData_t, maxPoints int) []PositionData_t {
+
+	keep := keepMostImportant(trackImportance(trackPoints(track)), maxPoints)
+	var simplified []PositionData_t
+	for i, p := range track {
+		if keep[i] {
+			simplified = append(simplified, p)
+		}
+	}
+	return simplified
+}
+
+func trackPoints(track []PositionData_t) [][2]float64 {
+
+	points := make([][2]float64, len(track))
+	for i, p := range track {
+		points[i] = [2]float64{p.Lat, p.Long}
+	}
+	return points
+}
+
+// returns which of the points to keep: the maxPoints with the highest importance
+func keepMostImportant(importance []float64, maxPoints int) []bool {
+
+	keep := make([]bool, len(importance))
+	order := make([]int, len(importance))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return importance[order[a]] > importance[order[b]] })
+
+	for n, i := range order {
+		if n >= maxPoints {
+			break
+		}
+		keep[i] = true
+	}
+	return keep
+}
+
+// For each lat, long point, the largest tolerance in metres at which Douglas-Peucker keeps it. The first and
+// last points are infinitely important.
+func trackImportance(points [][2]float64) []float64 {
+
+	importance := make([]float64, len(points))
+	if len(points) == 0 {
+		return importance
+	}
+	importance[0] = math.Inf(1)
+	importance[len(points)-1] = math.Inf(1)
+
+	xy := toMetres(points)
+
+	type span_t struct {
+		first, last int
+		parent      float64 // importance of the point that split off this span
+	}
+	stack := []span_t{{0, len(points) - 1, math.Inf(1)}}
+
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if s.last-s.first < 2 {
+			continue
+		}
+
+		// the point furthest from the line between the ends of the span
+		split, furthest := -1, -1.0
+		for i := s.first + 1; i < s.last; i++ {
+			if d := segmentDistance(xy[i], xy[s.first], xy[s.last]); d > furthest {
+				split, furthest = i, d
+			}
+		}
+
+		// a point cant be more important than the one that split off its span, or it would be kept at a
+		// tolerance where its span never gets looked at
+		importance[split] = math.Min(furthest, s.parent)
+		stack = append(stack, span_t{s.first, split, importance[split]}, span_t{split, s.last, importance[split]})
+	}
+	return importance
+}
+
+// converts lat, long points to x, y in metres on a flat projection centred on the first point, which is plenty
+// accurate enough over the size of a race course
+func toMetres(points [][2]float64) [][2]float64 {
+
+	lat0 := points[0][0] * math.Pi / 180
+	long0 := points[0][1] * math.Pi / 180
+
+	xy := make([][2]float64, len(points))
+	for i, p := range points {
+		lat := p[0] * math.Pi / 180
+		long := p[1] * math.Pi / 180
+		xy[i] = [2]float64{EARTH_RADIUS * (long - long0) * math.Cos(lat0), EARTH_RADIUS * (lat - lat0)}
+	}
+	return xy
+}
+
+// distance from p to the line segment a-b
+func segmentDistance(p [2]float64, a [2]float64, b [2]float64) float64 {
+
+	dx, dy := b[0]-a[0], b[1]-a[1]
+	lengthSq := dx*dx + dy*dy
+	if lengthSq == 0 {
+		return math.Hypot(p[0]-a[0], p[1]-a[1])
+	}
+
+	// how far along the segment the nearest point is, clamped to the ends
+	t := ((p[0]-a[0])*dx + (p[1]-a[1])*dy) / lengthSq
+	t = math.Max(0, math.Min(1, t))
+	return math.Hypot(p[0]-(a[0]+t*dx), p[1]-(a[1]+t*dy))
+}
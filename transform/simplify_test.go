@@ -0,0 +1,81 @@
+package transform
+
+import (
+	"math"
+	"testing"
+)
+
+// a position north and east metres from 50N 1.3W
+func offset(north float64, east float64) [2]float64 {
+
+	lat0 := 50.0
+	return [2]float64{lat0 + north/EARTH_RADIUS*180/math.Pi, -1.3 + east/(EARTH_RADIUS*math.Cos(lat0*math.Pi/180))*180/math.Pi}
+}
+
+func testTrack(points ...[2]float64) []PositionData_t {
+
+	var positions []PositionData_t
+	for _, p := range points {
+		positions = append(positions, PositionData_t{Lat: p[0], Long: p[1]})
+	}
+	return positions
+}
+
+func TestTrackImportance(t *testing.T) {
+
+	// 200m north then 100m east, with the corner 100m off the line between the ends and the points either side
+	// of it on the legs
+	points := [][2]float64{offset(0, 0), offset(100, 0), offset(200, 0), offset(200, 50), offset(200, 100)}
+	importance := trackImportance(points)
+
+	if !math.IsInf(importance[0], 1) || !math.IsInf(importance[4], 1) {
+		t.Errorf("the ends should always be kept, got %v", importance)
+	}
+	corner := 200 * 100 / math.Hypot(200, 100) // from the corner to the line between the ends
+	if !approx(importance[2], corner, 0.1) {
+		t.Errorf("got corner importance %f, want %f", importance[2], corner)
+	}
+	if !approx(importance[1], 0, 0.1) || !approx(importance[3], 0, 0.1) {
+		t.Errorf("points on a straight leg should count for nothing, got %v", importance)
+	}
+
+	// a point cant be more important than the one that split off its span, however far off it is
+	points = [][2]float64{offset(0, 0), offset(50, 20), offset(100, 0), offset(150, 500), offset(300, 0)}
+	importance = trackImportance(points)
+	if importance[1] > importance[3] {
+		t.Errorf("got %v, the point before the big corner is more important than it", importance)
+	}
+
+	if got := trackImportance(nil); len(got) != 0 {
+		t.Errorf("no points: got %v", got)
+	}
+}
+
+func TestSimplifyTrack(t *testing.T) {
+
+	// a zig-zag up the beat with a wobble of 1m on each leg
+	positions := testTrack(offset(0, 0), offset(50, 51), offset(100, 100), offset(150, 49), offset(200, 0), offset(250, 51), offset(300, 100))
+
+	if got := SimplifyTrack(positions, 2); len(got) != 4 {
+		t.Errorf("tolerance 2m: got %d positions, want the ends and the 2 tacks", len(got))
+	}
+	if got := SimplifyTrack(positions, 0); len(got) != len(positions) {
+		t.Errorf("tolerance 0: got %d positions, want all %d", len(got), len(positions))
+	}
+
+	got := SimplifyTrackTo(positions, 4)
+	if len(got) != 4 || got[0] != positions[0] || got[3] != positions[6] {
+		t.Errorf("4 points: got %v", got)
+	}
+	for _, p := range got {
+		if p == positions[1] || p == positions[3] || p == positions[5] {
+			t.Errorf("4 points: kept the wobble at %v rather than a tack", p)
+		}
+	}
+	if got := SimplifyTrackTo(positions, 2); len(got) != 2 || got[0] != positions[0] || got[1] != positions[6] {
+		t.Errorf("2 points: got %v, want the ends", got)
+	}
+	if got := SimplifyTrackTo(positions, 100); len(got) != len(positions) {
+		t.Errorf("100 points: got %d positions, want all %d", len(got), len(positions))
+	}
+}
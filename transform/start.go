@@ -0,0 +1,279 @@
+package transform
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+)
+
+/*
+Start line analysis
+-------------------
+How the boat started, worked out from the position, COG and SOG readings (see transformCogAndSog) over the
+last PRESTART before the gun and AFTER_GUN after it. The line is the pin and committee boat ends pinged on the
+water, or the start line of the session's course (see course.go) if they arent given, and the gun is given
+with -gun or on the API call.
+
+For each second there is a point with the boat's position, COG and SOG and:
+
+	distance    metres from the line (extended past its ends), negative when the boat is over it
+	timetoline  seconds to get to the line at the current COG and SOG, left out if the boat isnt closing on it
+	timetoburn  seconds to the gun less timetoline, before the gun only. Positive is time to spare, negative
+	            is going to be late.
+
+which is what the pre-start replay on the map is drawn from. The start itself has the SOG and distance at the
+gun, whether the boat was over, how late it crossed the line and the line bias: how many degrees the line is off
+square to the mean TWD over the PRESTART, positive when the pin end is further upwind, with the end favoured and
+by how many metres. The line comes from GPS positions so only a TWD referenced to true north is used, see
+truewind.go. The bias is left at 0 and the favoured end empty if there was no true wind, or only a magnetic TWD
+because the compass gave no variation.
+
+The course side of the line is the side the first mark of the course is on, or the upwind side if there is no
+course, or the other side from where the boat was at the start of the PRESTART if there is no wind either.
+
+-gun <time> -col <session> keeps the analysis in the catalog by session for the API. Sessions can have only the
+one start.
+*/
+
+const START_CATALOG = storage.CATALOG_PREFIX + "starts"
+
+const PRESTART = 5 * time.Minute        // analysed before the gun
+const AFTER_GUN = time.Minute           // and after
+const START_STEP = time.Second          // between the points
+const MAX_READING_AGE = 5 * time.Second // readings older than this dont count for a point
+
+type StartPoint_t struct {
+	Ts         time.Time `bson:"ts" json:"ts"`
+	Lat        float64   `bson:"lat" json:"lat"`
+	Long       float64   `bson:"long" json:"long"`
+	Cog        float64   `bson:"cog" json:"cog"`           // degrees true
+	Sog        float64   `bson:"sog" json:"sog"`           // m/s
+	Distance   float64   `bson:"distance" json:"distance"` // metres, negative over the line
+	TimeToLine *float64  `bson:"timetoline,omitempty" json:"timeToLine,omitempty"`
+	TimeToBurn *float64  `bson:"timetoburn,omitempty" json:"timeToBurn,omitempty"`
+}
+
+type Start_t struct {
+	Session       string         `bson:"_id" json:"session"`
+	Gun           time.Time      `bson:"gun" json:"gun"`
+	Line          Line_t         `bson:"line" json:"line"`
+	Length        float64        `bson:"length" json:"length"`                         // metres
+	LineBearing   float64        `bson:"linebearing" json:"lineBearing"`               // from the committee boat to the pin
+	Twd           float64        `bson:"twd" json:"twd"`                               // mean over the PRESTART
+	Bias          float64        `bson:"bias" json:"bias"`                             // degrees, positive if the pin end is favoured
+	BiasDistance  float64        `bson:"biasdistance" json:"biasDistance"`             // metres the favoured end is upwind of the other
+	Favoured      string         `bson:"favoured,omitempty" json:"favoured,omitempty"` // pin or boat
+	SpeedAtGun    float64        `bson:"speedatgun" json:"speedAtGun"`                 // SOG, m/s
+	DistanceAtGun float64        `bson:"distanceatgun" json:"distanceAtGun"`           // metres, negative if over
+	Over          bool           `bson:"over" json:"over"`
+	Late          *float64       `bson:"late,omitempty" json:"late,omitempty"` // seconds after the gun the boat crossed, nil if it didnt
+	Points        []StartPoint_t `bson:"points" json:"points"`
+	Updated       time.Time      `bson:"updated" json:"updated"`
+}
+
+// Analyses the start of a session at gun and saves it in the catalog. line is the course's start line if nil.
+func AddStart(session string, line *Line_t, gun time.Time) (Start_t, error) {
+
+	store := storage.Open()
+	defer store.Close()
+
+	start, err := AnalyseStart(store, session, line, gun)
+	if err != nil {
+		return start, err
+	}
+	start.Updated = time.Now().UTC()
+	return start, store.Put(START_CATALOG, session, start)
+}
+
+// Reads a session's start from the catalog, storage.ErrNotFound if it hasnt been analysed
+func LoadStart(store storage.Store, session string) (Start_t, error) {
+
+	var start Start_t
+	err := store.Get(START_CATALOG, session, &start)
+	return start, err
+}
+
+// Works out how the boat started at gun on line, or on the course's start line if line is nil
+func AnalyseStart(store storage.Store, session string, line *Line_t, gun time.Time) (Start_t, error) {
+
+	course, err := LoadCourse(store, session)
+	if err != nil && err != storage.ErrNotFound {
+		return Start_t{}, err
+	}
+	if line == nil {
+		line = course.Start
+	}
+	if line == nil {
+		return Start_t{}, fmt.Errorf("session %s has no start line, give the pin and committee boat", session)
+	}
+	st := Start_t{Session: session, Gun: gun, Line: *line}
+
+	// the readings, from a little before the first point so there is one to go on
+	from, to := gun.Add(-PRESTART-MAX_READING_AGE), gun.Add(AFTER_GUN+MAX_READING_AGE)
+	positions, err := positionsBetween(store, session, from, to)
+	if err != nil {
+		return st, err
+	}
+	if len(positions) == 0 {
+		return st, fmt.Errorf("session %s has no positions around %v", session, gun)
+	}
+	cog, err := readingsBetween(store, session, FIELD_COG, from, to, nil)
+	if err != nil {
+		return st, err
+	}
+	sog, err := readingsBetween(store, session, FIELD_SOG, from, to, nil)
+	if err != nil {
+		return st, err
+	}
+	twd, err := readingsBetween(store, session, FIELD_TWD, gun.Add(-PRESTART), gun, trueDirection)
+	if err != nil {
+		return st, err
+	}
+
+	// the line in metres from the pin, x east and y north
+	origin := [][2]float64{{line.Pin.Lat, line.Pin.Long}, {line.Boat.Lat, line.Boat.Long}}
+	xy := toMetres(origin)
+	pin, boat := xy[0], xy[1]
+	st.Length = math.Hypot(boat[0]-pin[0], boat[1]-pin[1])
+	if st.Length == 0 {
+		return st, fmt.Errorf("the pin and committee boat are in the same place")
+	}
+	st.LineBearing = bearing(line.Boat.Lat, line.Boat.Long, line.Pin.Lat, line.Pin.Long)
+
+	var values []float64
+	for _, r := range twd {
+		values = append(values, r.value)
+	}
+	if len(values) != 0 {
+		// the favoured end is the one further upwind
+		st.Twd = circularStats(values).Mean
+		upwind := [2]float64{math.Sin(st.Twd * math.Pi / 180), math.Cos(st.Twd * math.Pi / 180)}
+		ahead := (pin[0]-boat[0])*upwind[0] + (pin[1]-boat[1])*upwind[1]
+		st.Bias = math.Asin(ahead/st.Length) * 180 / math.Pi
+		st.BiasDistance = math.Abs(ahead)
+		st.Favoured = "pin"
+		if ahead < 0 {
+			st.Favoured = "boat"
+		}
+	}
+
+	// the unit normal to the line pointing to the course side
+	normal := [2]float64{-(boat[1] - pin[1]) / st.Length, (boat[0] - pin[0]) / st.Length}
+	toMetresFromPin := func(lat float64, long float64) [2]float64 {
+		return toMetres(append(origin[:1:1], [2]float64{lat, long}))[1]
+	}
+	across := func(p [2]float64) float64 { return (p[0]-pin[0])*normal[0] + (p[1]-pin[1])*normal[1] }
+	switch {
+	case len(course.Marks) != 0:
+		if across(toMetresFromPin(course.Marks[0].Lat, course.Marks[0].Long)) < 0 {
+			normal[0], normal[1] = -normal[0], -normal[1]
+		}
+	case len(values) != 0:
+		if math.Sin(st.Twd*math.Pi/180)*normal[0]+math.Cos(st.Twd*math.Pi/180)*normal[1] < 0 {
+			normal[0], normal[1] = -normal[0], -normal[1]
+		}
+	default:
+		p := positions[0]
+		if across(toMetresFromPin(p.Lat, p.Long)) > 0 {
+			normal[0], normal[1] = -normal[0], -normal[1]
+		}
+	}
+
+	for t := gun.Add(-PRESTART); !t.After(gun.Add(AFTER_GUN)); t = t.Add(START_STEP) {
+
+		position, ok := positionAt(positions, t)
+		if !ok {
+			continue
+		}
+		p := StartPoint_t{Ts: t, Lat: position.Lat, Long: position.Long}
+		p.Distance = -across(toMetresFromPin(p.Lat, p.Long))
+
+		c, ok := readingAt(cog, t)
+		s, ok2 := readingAt(sog, t)
+		if ok && ok2 {
+			p.Cog, p.Sog = c, s
+			closing := s * (math.Sin(c*math.Pi/180)*normal[0] + math.Cos(c*math.Pi/180)*normal[1])
+			if p.Distance > 0 && closing > 0 {
+				toLine := p.Distance / closing
+				p.TimeToLine = &toLine
+				if t.Before(gun) {
+					toBurn := gun.Sub(t).Seconds() - toLine
+					p.TimeToBurn = &toBurn
+				}
+			}
+		}
+
+		// the gun, and the first time the boat crossed the line after it
+		if t.Equal(gun) {
+			st.SpeedAtGun, st.DistanceAtGun, st.Over = p.Sog, p.Distance, p.Distance < 0
+		}
+		if n := len(st.Points); n != 0 && !t.Before(gun) && st.Late == nil {
+			prev := st.Points[n-1]
+			if prev.Distance > 0 && p.Distance <= 0 {
+				crossed := prev.Ts.Add(time.Duration(prev.Distance / (prev.Distance - p.Distance) * float64(t.Sub(prev.Ts))))
+				late := math.Max(crossed.Sub(gun).Seconds(), 0)
+				st.Late = &late
+			}
+		}
+		st.Points = append(st.Points, p)
+	}
+
+	if debug {
+		fmt.Printf("start of %s: %d points, %.1fm from the line at %.1f m/s at the gun\n", session, len(st.Points), st.DistanceAtGun, st.SpeedAtGun)
+	}
+	return st, nil
+}
+
+// the positions in a collection between two times
+func positionsBetween(store storage.Store, collection string, start time.Time, end time.Time) ([]PositionData_t, error) {
+
+	cursor, err := store.Range(collection, FIELD_LAT, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+
+	var positions []PositionData_t
+	for cursor.Next() {
+		var p PositionData_t
+		if err := cursor.Decode(&p); err == nil {
+			positions = append(positions, p)
+		}
+	}
+	return positions, cursor.Err()
+}
+
+// the position at t, in between the positions either side of it if they are close enough together
+func positionAt(positions []PositionData_t, t time.Time) (Mark_t, bool) {
+
+	for i := 1; i < len(positions); i++ {
+		a, b := positions[i-1], positions[i]
+		if b.Ts.Before(t) {
+			continue
+		}
+		if a.Ts.After(t) || b.Ts.Sub(a.Ts) > 2*MAX_READING_AGE {
+			break
+		}
+		f := 0.0
+		if span := b.Ts.Sub(a.Ts); span > 0 {
+			f = float64(t.Sub(a.Ts)) / float64(span)
+		}
+		return Mark_t{Lat: a.Lat + (b.Lat-a.Lat)*f, Long: a.Long + (b.Long-a.Long)*f}, true
+	}
+	return Mark_t{}, false
+}
+
+// the latest reading at or before t, if it is no older than MAX_READING_AGE
+func readingAt(readings []reading_t, t time.Time) (float64, bool) {
+
+	v, ok := 0.0, false
+	for _, r := range readings {
+		if r.ts.After(t) {
+			break
+		}
+		v, ok = r.value, t.Sub(r.ts) <= MAX_READING_AGE
+	}
+	return v, ok
+}
@@ -0,0 +1,112 @@
+package transform
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var testGun = time.Date(2021, 7, 11, 10, 0, 0, 0, time.UTC)
+
+// a local store in a temporary directory
+func testStore(t *testing.T) storage.Store {
+
+	os.Setenv("STORAGE_BACKEND", storage.BACKEND_LOCAL)
+	os.Setenv("LOCAL_STORE_DIR", t.TempDir())
+	os.Setenv("ACTIVEDB", "test")
+	return storage.Open()
+}
+
+// writes a session of a boat sailing north at 2 m/s along 50N 1.3W, north metres from the line at the gun,
+// with the wind from twd. There is a magnetic TWD as well, 90 degrees out so it shows if it is used.
+func writeStart(store storage.Store, session string, north float64, twd float64) {
+
+	w := store.Writer(session)
+	write := func(doc bson.D) {
+		data, err := bson.Marshal(doc)
+		check(err)
+		w.Write(data)
+	}
+	for t := testGun.Add(-PRESTART - 10*time.Second); t.Before(testGun.Add(AFTER_GUN + 10*time.Second)); t = t.Add(time.Second) {
+		p := offset(north+2*t.Sub(testGun).Seconds(), 0)
+		source := bson.E{Key: FIELD_METADATA, Value: bson.D{{Key: FIELD_SOURCE, Value: "test"}}}
+		write(bson.D{{Key: FIELD_TS, Value: t}, source, {Key: FIELD_LAT, Value: p[0]}, {Key: FIELD_LONG, Value: p[1]}})
+		write(bson.D{{Key: FIELD_TS, Value: t}, source, {Key: FIELD_COG, Value: 0.0}, {Key: FIELD_SOG, Value: 2.0}})
+		if t.Second()%10 == 0 {
+			write(bson.D{{Key: FIELD_TS, Value: t}, {Key: FIELD_METADATA, Value: bson.D{{Key: FIELD_SOURCE, Value: TRUE_WIND_SOURCE}, {Key: "reference", Value: "true"}}},
+				{Key: FIELD_TWD, Value: twd}})
+			write(bson.D{{Key: FIELD_TS, Value: t}, {Key: FIELD_METADATA, Value: bson.D{{Key: FIELD_SOURCE, Value: TRUE_WIND_SOURCE}, {Key: "reference", Value: "magnetic"}}},
+				{Key: FIELD_TWD, Value: twd + 90}})
+		}
+	}
+	w.Flush()
+}
+
+func TestAnalyseStart(t *testing.T) {
+
+	store := testStore(t)
+	defer store.Close()
+
+	// 100m of line running east, pin at the west end
+	pin, boat := offset(0, -50), offset(0, 50)
+	line := &Line_t{Pin: Mark_t{Lat: pin[0], Long: pin[1]}, Boat: Mark_t{Lat: boat[0], Long: boat[1]}}
+
+	tests := []struct {
+		name     string
+		north    float64 // metres from the line at the gun
+		twd      float64
+		bias     float64
+		favoured string
+		over     bool
+		late     float64
+	}{
+		{"pin favoured", -10, 350, 10, "pin", false, 5},
+		{"boat favoured", -10, 10, -10, "boat", false, 5},
+		{"square", -4, 0, 0, "pin", false, 2},
+		{"over", 10, 350, 10, "pin", true, 0},
+	}
+	for _, tt := range tests {
+		writeStart(store, tt.name, tt.north, tt.twd)
+		st, err := AnalyseStart(store, tt.name, line, testGun)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+
+		if !approx(st.Bias, tt.bias, 0.01) || (tt.bias != 0 && st.Favoured != tt.favoured) {
+			t.Errorf("%s: got bias %f favouring %s, want %f favouring %s", tt.name, st.Bias, st.Favoured, tt.bias, tt.favoured)
+		}
+		if !approx(st.Length, 100, 0.1) || !approx(st.Twd, tt.twd, 0.01) {
+			t.Errorf("%s: got a %fm line and twd %f", tt.name, st.Length, st.Twd)
+		}
+
+		// distances are positive on the pre-start side, negative over the line
+		if !approx(st.DistanceAtGun, -tt.north, 0.1) || st.Over != tt.over || !approx(st.SpeedAtGun, 2, TEST_TOLERANCE) {
+			t.Errorf("%s: got %fm from the line at %f m/s, over %t, want %fm over %t", tt.name, st.DistanceAtGun, st.SpeedAtGun, st.Over, -tt.north, tt.over)
+		}
+		if tt.over && st.Late != nil {
+			t.Errorf("%s: over the line but crossed %fs late", tt.name, *st.Late)
+		}
+		if !tt.over && (st.Late == nil || !approx(*st.Late, tt.late, 0.1)) {
+			t.Errorf("%s: got late %v, want %f", tt.name, st.Late, tt.late)
+		}
+
+		// a minute before the gun the boat is 120m further back, so 60s plus the time to cover the distance
+		// at the gun to the line, and that much late
+		first := st.Points[0]
+		if !first.Ts.Equal(testGun.Add(-PRESTART)) || len(st.Points) != int((PRESTART+AFTER_GUN)/START_STEP)+1 {
+			t.Errorf("%s: got %d points from %v", tt.name, len(st.Points), first.Ts)
+		}
+		for _, p := range st.Points {
+			if !p.Ts.Equal(testGun.Add(-time.Minute)) {
+				continue
+			}
+			toLine := 60 - tt.north/2
+			if p.TimeToLine == nil || p.TimeToBurn == nil || !approx(*p.TimeToLine, toLine, 0.1) || !approx(*p.TimeToBurn, 60-toLine, 0.1) {
+				t.Errorf("%s: a minute before the gun got %+v, want %fs to the line", tt.name, p, toLine)
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package transform
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/m-h-w/nmea-logger/storage"
+	"github.com/m-h-w/nmea-logger/wind"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+/*
+True wind
+---------
+The instruments only give the apparent wind. Each time an apparent wind reading comes in a true wind document
+is written next to it, worked out with the wind package from the latest boatspeed, heading, heel and, for the
+ground wind, SOG and COG:
+
+	{ts, metadata: {source: "calculated", reference: "true", heel: 12.1, leeway: -3.2}, tws, twa, twd, gws, gwd}
+
+Readings older than TRUE_WIND_MAX_AGE are not used. Without a boatspeed there is no true wind document, and
+without SOG and COG the ground wind is left out. TWD and GWD are true if the compass gives the variation,
+otherwise magnetic, which metadata.reference says. Speeds are in m/s like the rest of the schema.
+*/
+
+const TRUE_WIND_SOURCE = "calculated"
+
+// how old the boatspeed, heading etc can be and still be used with an apparent wind reading
+const TRUE_WIND_MAX_AGE = 2 * time.Second
+
+// the corrections applied to the true wind. Set from the command line, see tools/mongo-tools.go
+type WindCorrection_t struct {
+	Heel   bool    // correct the apparent wind for the masthead unit heeling over with the boat
+	Leeway float64 // leeway coefficient, see wind.EstimateLeeway. 0 for no leeway correction.
+}
+
+var WindCorrection = WindCorrection_t{Heel: true, Leeway: wind.LEEWAY_COEFFICIENT}
+
+type trueWindMetadata_t struct {
+	DataSource string  `bson:"source"`
+	Reference  string  `bson:"reference"` // of twd and gwd: true or magnetic
+	Heel       float64 `bson:"heel"`      // used to correct the apparent wind
+	Leeway     float64 `bson:"leeway"`    // degrees, estimated from heel and boatspeed
+}
+
+type trueWind_t struct {
+	Ts       time.Time          `bson:"ts"`
+	Metadata trueWindMetadata_t `bson:"metadata"`
+	Tws      float64            `bson:"tws"`
+	Twa      float64            `bson:"twa"`
+	Twd      float64            `bson:"twd"`
+	Gws      *float64           `bson:"gws,omitempty"` // only if there is SOG and COG
+	Gwd      *float64           `bson:"gwd,omitempty"`
+}
+
+// true for a true wind document whose directions are referenced to true north rather than magnetic
+func trueDirection(doc bson.Raw) bool {
+
+	reference, _ := doc.Lookup(FIELD_METADATA, "reference").StringValueOK()
+	return reference == "true"
+}
+
+// a reading and when it was taken
+type reading_t struct {
+	value float64
+	ts    time.Time
+}
+
+func (r reading_t) fresh(now time.Time) bool {
+
+	if r.ts.IsZero() {
+		return false
+	}
+	age := now.Sub(r.ts)
+	return age <= TRUE_WIND_MAX_AGE && age >= -TRUE_WIND_MAX_AGE
+}
+
+// the latest readings needed for the true wind and current, kept up to date as the logger documents go past
+type instruments_t struct {
+	boatspeed reading_t // m/s
+	heading   reading_t // magnetic
+	variation reading_t
+	heel      reading_t
+	sog       reading_t // m/s
+	cog       reading_t // true
+	awa       reading_t // apparent, for the leeway in the current
+}
+
+// records the readings in a logger document that the true wind and current need
+func (ins *instruments_t) update(input map[string]interface{}) {
+
+	fields, ok := input["fields"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	ts, ok := input["timestamp"].(string)
+	if !ok {
+		return
+	}
+	t, err := time.Parse(time.RFC3339, convertToDateFormat(ts))
+	if err != nil {
+		return
+	}
+
+	set := func(r *reading_t, field string) {
+		if v, ok := fields[field].(float64); ok {
+			*r = reading_t{v, t}
+		}
+	}
+
+	switch input["description"] {
+	case "Speed":
+		set(&ins.boatspeed, "Speed Water Referenced")
+	case "Vessel Heading":
+		set(&ins.heading, "Heading")
+		set(&ins.variation, "Variation")
+	case "Attitude":
+		set(&ins.heel, "Roll")
+	case "Wind Data":
+		if reference, ok := fields["Reference"].(map[string]interface{}); ok && reference["name"] == "Apparent" {
+			set(&ins.awa, "Wind Angle")
+		}
+	case "COG & SOG, Rapid Update":
+		if reference, ok := fields["COG Reference"].(map[string]interface{}); ok && reference["name"] == "True" {
+			set(&ins.cog, "COG")
+			set(&ins.sog, "SOG")
+		}
+	}
+}
+
+// writes the true wind for an apparent wind reading, if there are readings to work it out from
+func transformTrueWind(input map[string]interface{}, ins *instruments_t, w storage.Writer) {
+
+	t, err := time.Parse(time.RFC3339, convertToDateFormat(input["timestamp"].(string)))
+	check(err)
+
+	fields := input["fields"].(map[string]interface{})
+	if reference, ok := fields["Reference"].(map[string]interface{}); !ok || reference["name"] != "Apparent" {
+		return
+	}
+	awa, ok := fields["Wind Angle"].(float64)
+	aws, ok2 := fields["Wind Speed"].(float64)
+	if !ok || !ok2 {
+		return
+	}
+
+	tw := trueWindAt(t, awa, aws, ins)
+	if tw == nil {
+		return
+	}
+
+	if debug {
+		fmt.Printf("true wind: tws %f twa %f twd %f\n", tw.Tws, tw.Twa, tw.Twd)
+	}
+
+	bsonTrueWind, err := bson.Marshal(tw)
+	check(err)
+	w.Write(bsonTrueWind)
+}
+
+// the true wind for an apparent wind reading at t, or nil if there isnt a boatspeed and heading to work it out
+func trueWindAt(t time.Time, awa float64, aws float64, ins *instruments_t) *trueWind_t {
+
+	if !ins.boatspeed.fresh(t) || !ins.heading.fresh(t) {
+		return nil
+	}
+
+	tw := trueWind_t{Ts: t}
+	tw.Metadata.DataSource = TRUE_WIND_SOURCE
+	tw.Metadata.Reference = "magnetic"
+
+	heading := ins.heading.value
+	if ins.variation.fresh(t) {
+		heading += ins.variation.value
+		tw.Metadata.Reference = "true"
+	}
+
+	in := wind.Apparent_t{Awa: awa, Aws: aws, Stw: ins.boatspeed.value, Heading: heading}
+	if ins.heel.fresh(t) {
+		if WindCorrection.Heel {
+			in.Heel = ins.heel.value
+		}
+		in.Leeway = wind.EstimateLeeway(awa, ins.heel.value, ins.boatspeed.value*MS2KNOTS, WindCorrection.Leeway)
+	}
+	tw.Metadata.Heel, tw.Metadata.Leeway = in.Heel, in.Leeway
+
+	trueWind := wind.TrueWind(in)
+	tw.Tws, tw.Twa, tw.Twd = trueWind.Tws, trueWind.Twa, trueWind.Twd
+
+	// COG is always true so the ground wind is only worked out against a true heading
+	if ins.sog.fresh(t) && ins.cog.fresh(t) && tw.Metadata.Reference == "true" {
+		gws, gwd := wind.GroundWind(in, ins.sog.value, ins.cog.value)
+		tw.Gws, tw.Gwd = &gws, &gwd
+	}
+	return &tw
+}
@@ -0,0 +1,152 @@
+package wind
+
+import "math"
+
+/*
+Wind math
+---------
+Works out the true wind from what the instruments measure on the boat. Used by the transformer when it writes
+the true wind documents (transform/truewind.go) and by the SailNjord exporter, so both agree.
+
+The apparent wind measured at the masthead is the true wind plus the wind made by the boat moving. Taking the
+boat's motion away from the apparent wind, as vectors, leaves the wind:
+
+	- true wind (TWS, TWA, TWD): the boat's motion through the water, i.e. speed through the water (STW) along
+	  the heading, turned by leeway. This is the wind the sails see and what the polars are in.
+	- ground wind (GWS, GWD): the boat's motion over the ground, SOG along COG. This is the wind a weather
+	  forecast or a buoy on the shore would give. It differs from the true wind by the tidal current, which
+	  is the difference between the two motions, see Current.
+
+Working with vectors rather than the cosine rule means there is no acos to go out of range on noisy readings,
+and no special case for the wind being aft of the beam.
+
+Angles are in degrees. Wind angles are measured clockwise from the bow, 0 to 360, which is how the analyzer
+outputs them, so 90 is wind on the starboard beam and 270 on the port beam. Directions are where the wind
+comes from, 0 to 360, in the same reference (true or magnetic) as the heading and COG given. Speeds can be in
+any unit as long as they are all the same, except EstimateLeeway which needs knots.
+*/
+
+// The leeway coefficient used if none is given, for EstimateLeeway. Typical values for a keel boat are 8 to 14.
+const LEEWAY_COEFFICIENT = 10.0
+
+// the most leeway EstimateLeeway gives, for when the boat is nearly stopped and heeled
+const MAX_LEEWAY = 15.0
+
+// readings as measured on the boat
+type Apparent_t struct {
+	Awa     float64 // apparent wind angle, degrees clockwise from the bow
+	Aws     float64 // apparent wind speed
+	Stw     float64 // speed through the water, i.e. boatspeed
+	Heading float64 // degrees
+	Heel    float64 // degrees, either side. 0 if the masthead unit needs no correction or there is no attitude sensor
+	Leeway  float64 // degrees, positive when the boat slips to starboard. See EstimateLeeway.
+}
+
+type True_t struct {
+	Tws float64 // true wind speed
+	Twa float64 // true wind angle, degrees clockwise from the bow, 0 to 360
+	Twd float64 // true wind direction, degrees, 0 to 360
+}
+
+// Works out the true wind from the apparent wind and the boat's motion through the water.
+func TrueWind(in Apparent_t) True_t {
+
+	awa, aws := CorrectForHeel(in.Awa, in.Aws, in.Heel)
+
+	// in the boat's frame, x forward and y to starboard, as vectors of where the wind comes from
+	ax, ay := polar(awa, aws)
+	mx, my := polar(in.Leeway, in.Stw) // the boat's motion makes a wind from the way it is going
+	tx, ty := ax-mx, ay-my
+
+	tws := math.Hypot(tx, ty)
+	twa := in.Awa // no true wind to speak of, keep the apparent angle rather than a meaningless one
+	if tws > 1e-9 {
+		twa = Normalise(math.Atan2(ty, tx) * 180 / math.Pi)
+	}
+	return True_t{Tws: tws, Twa: twa, Twd: Normalise(in.Heading + twa)}
+}
+
+// Works out the wind over the ground, speed and direction, from the apparent wind and the boat's motion over
+// the ground. heading, cog and the direction returned are all in the same reference.
+func GroundWind(in Apparent_t, sog float64, cog float64) (float64, float64) {
+
+	awa, aws := CorrectForHeel(in.Awa, in.Aws, in.Heel)
+
+	// north and east, as vectors of where the wind comes from
+	an, ae := polar(in.Heading+awa, aws)
+	mn, me := polar(cog, sog)
+	gn, ge := an-mn, ae-me
+
+	gws := math.Hypot(gn, ge)
+	if gws <= 1e-9 {
+		return 0, Normalise(in.Heading + in.Awa)
+	}
+	return gws, Normalise(math.Atan2(ge, gn) * 180 / math.Pi)
+}
+
+// Works out the tidal current from the boat's motion over the ground less its motion through the water: STW
+// along course, the heading turned by leeway. Returns the set, the direction the current flows to (not from,
+// unlike the wind), and the drift, its speed. course and cog must be in the same reference.
+func Current(stw float64, course float64, sog float64, cog float64) (float64, float64) {
+
+	gn, ge := polar(cog, sog)
+	wn, we := polar(course, stw)
+	cn, ce := gn-wn, ge-we
+
+	drift := math.Hypot(cn, ce)
+	if drift <= 1e-9 {
+		return 0, 0
+	}
+	return Normalise(math.Atan2(ce, cn) * 180 / math.Pi), drift
+}
+
+// Corrects the apparent wind for the masthead unit being heeled over with the boat. The unit only sees the
+// part of the wind across the boat that is square to the mast, so that part is scaled back up. The part along
+// the boat is unchanged.
+func CorrectForHeel(awa float64, aws float64, heel float64) (float64, float64) {
+
+	cosHeel := math.Cos(heel * math.Pi / 180)
+	if heel == 0 || cosHeel < 0.2 { // knocked down more than ~80 degrees, the correction would be silly
+		return awa, aws
+	}
+
+	x, y := polar(awa, aws)
+	y /= cosHeel
+	return Normalise(math.Atan2(y, x) * 180 / math.Pi), math.Hypot(x, y)
+}
+
+// Estimates leeway from heel and boatspeed with the usual formula, leeway = k x heel / stw^2, stw in knots.
+// The boat slips away from the wind, so the result is negative (to port) with the wind on the starboard side.
+// Returns 0 when there is no heel or boatspeed to go on.
+func EstimateLeeway(awa float64, heel float64, stwKnots float64, k float64) float64 {
+
+	if stwKnots <= 0 || heel == 0 || k <= 0 {
+		return 0
+	}
+	leeway := math.Min(k*math.Abs(heel)/(stwKnots*stwKnots), MAX_LEEWAY)
+
+	if Normalise(awa) < 180 { // wind from starboard, slipping to port
+		return -leeway
+	}
+	return leeway
+}
+
+// returns a in the range [0, 360)
+func Normalise(a float64) float64 {
+
+	a = math.Mod(a, 360)
+	if a < 0 {
+		a += 360
+	}
+	if a >= 360 { // a tiny negative angle rounds to 360 when added to it
+		a = 0
+	}
+	return a
+}
+
+// x, y components of a speed coming from angle degrees
+func polar(angle float64, speed float64) (float64, float64) {
+
+	rads := angle * math.Pi / 180
+	return speed * math.Cos(rads), speed * math.Sin(rads)
+}
@@ -0,0 +1,202 @@
+package wind
+
+import (
+	"math"
+	"testing"
+)
+
+const TOLERANCE = 1e-6
+
+// the apparent wind angle and speed for a true wind, worked forwards from it: the apparent wind is the true
+// wind plus the wind made by the boat going through the water at leeway degrees off the bow
+func apparent(twa float64, tws float64, stw float64, leeway float64) (float64, float64) {
+
+	x := tws*math.Cos(twa*math.Pi/180) + stw*math.Cos(leeway*math.Pi/180)
+	y := tws*math.Sin(twa*math.Pi/180) + stw*math.Sin(leeway*math.Pi/180)
+	return Normalise(math.Atan2(y, x) * 180 / math.Pi), math.Hypot(x, y)
+}
+
+// true if a and b are the same angle, allowing for 0 and 360
+func sameAngle(a float64, b float64) bool {
+	d := math.Mod(math.Abs(a-b), 360)
+	return math.Min(d, 360-d) < TOLERANCE
+}
+
+func TestTrueWind(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		twa     float64
+		tws     float64
+		stw     float64
+		heading float64
+		leeway  float64
+		twd     float64
+	}{
+		{"beam reach starboard", 90, 10, 5, 0, 0, 90},
+		{"beam reach port", 270, 10, 5, 100, 0, 10},
+		{"run", 180, 10, 6, 45, 0, 225},
+		{"close hauled starboard", 45, 10, 6, 200, 0, 245},
+		{"close hauled port", 315, 10, 6, 30, 0, 345},
+		{"close hauled starboard with leeway", 42, 12, 6.5, 0, -4, 42},
+		{"close hauled port with leeway", 318, 12, 6.5, 0, 4, 318},
+		{"faster than the wind", 120, 8, 12, 0, 0, 120},
+	}
+
+	for _, tt := range tests {
+		awa, aws := apparent(tt.twa, tt.tws, tt.stw, tt.leeway)
+		got := TrueWind(Apparent_t{Awa: awa, Aws: aws, Stw: tt.stw, Heading: tt.heading, Leeway: tt.leeway})
+		if math.Abs(got.Tws-tt.tws) > TOLERANCE || !sameAngle(got.Twa, tt.twa) || !sameAngle(got.Twd, tt.twd) {
+			t.Errorf("%s: got tws %f twa %f twd %f, want %f %f %f", tt.name, got.Tws, got.Twa, got.Twd, tt.tws, tt.twa, tt.twd)
+		}
+	}
+}
+
+func TestTrueWindZeroBoatspeed(t *testing.T) {
+
+	// stopped, the true wind is the apparent wind
+	got := TrueWind(Apparent_t{Awa: 70, Aws: 8, Heading: 300})
+	if math.Abs(got.Tws-8) > TOLERANCE || !sameAngle(got.Twa, 70) || !sameAngle(got.Twd, 10) {
+		t.Errorf("stopped: got %+v", got)
+	}
+
+	// motoring at the wind speed in a calm, the apparent angle is kept rather than a meaningless one
+	got = TrueWind(Apparent_t{Awa: 0, Aws: 5, Stw: 5, Heading: 90})
+	if got.Tws > TOLERANCE || !sameAngle(got.Twa, 0) || !sameAngle(got.Twd, 90) {
+		t.Errorf("calm: got %+v", got)
+	}
+}
+
+func TestTrueWindHeel(t *testing.T) {
+
+	// a beam wind heeled over reads light by cos(heel) at the masthead
+	heel := 20.0
+	got := TrueWind(Apparent_t{Awa: 90, Aws: 10 * math.Cos(heel*math.Pi/180), Heel: heel})
+	if math.Abs(got.Tws-10) > TOLERANCE || !sameAngle(got.Twa, 90) {
+		t.Errorf("heeled beam wind: got %+v", got)
+	}
+}
+
+func TestGroundWind(t *testing.T) {
+
+	// no current, so the ground wind is the true wind
+	awa, aws := apparent(45, 10, 6, 0)
+	in := Apparent_t{Awa: awa, Aws: aws, Stw: 6, Heading: 200}
+	gws, gwd := GroundWind(in, 6, 200)
+	if math.Abs(gws-10) > TOLERANCE || !sameAngle(gwd, 245) {
+		t.Errorf("no current: got gws %f gwd %f", gws, gwd)
+	}
+
+	// stopped in the water in a northerly, drifting east on the current. The true wind has the drift in it,
+	// the ground wind doesnt.
+	in = Apparent_t{Awa: Normalise(math.Atan2(1, 10) * 180 / math.Pi), Aws: math.Hypot(10, 1), Heading: 0}
+	gws, gwd = GroundWind(in, 1, 90)
+	if math.Abs(gws-10) > TOLERANCE || !sameAngle(gwd, 0) {
+		t.Errorf("current: got gws %f gwd %f, want 10 0", gws, gwd)
+	}
+	if tw := TrueWind(in); math.Abs(tw.Tws-math.Hypot(10, 1)) > TOLERANCE {
+		t.Errorf("current: got tws %f, want %f", tw.Tws, math.Hypot(10, 1))
+	}
+
+	// no wind over the ground
+	if gws, _ := GroundWind(Apparent_t{Awa: 0, Aws: 5, Stw: 5}, 5, 0); gws > TOLERANCE {
+		t.Errorf("calm: got gws %f", gws)
+	}
+}
+
+func TestCurrent(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		stw    float64
+		course float64
+		sog    float64
+		cog    float64
+		set    float64
+		drift  float64
+	}{
+		{"none", 5, 30, 5, 30, 0, 0},
+		{"flowing to the east", 5, 0, math.Hypot(5, 1), math.Atan2(1, 5) * 180 / math.Pi, 90, 1},
+		{"foul tide", 5, 0, 3, 0, 180, 2},
+		{"fair tide", 5, 270, 6.5, 270, 270, 1.5},
+		{"stopped in the water", 0, 0, 1, 315, 315, 1},
+	}
+
+	for _, tt := range tests {
+		set, drift := Current(tt.stw, tt.course, tt.sog, tt.cog)
+		if math.Abs(drift-tt.drift) > TOLERANCE || (tt.drift != 0 && !sameAngle(set, tt.set)) {
+			t.Errorf("%s: got set %f drift %f, want %f %f", tt.name, set, drift, tt.set, tt.drift)
+		}
+	}
+
+	// the set is where the current flows to, the wind is where it comes from: drifting east on the current
+	// in a calm makes an easterly
+	set, _ := Current(0, 0, 1, 90)
+	tw := TrueWind(Apparent_t{Awa: 90, Aws: 1})
+	if !sameAngle(set, 90) || !sameAngle(tw.Twd, 90) {
+		t.Errorf("drifting east: got set %f and twd %f, want both 90", set, tw.Twd)
+	}
+	gws, _ := GroundWind(Apparent_t{Awa: 90, Aws: 1}, 1, 90)
+	if gws > TOLERANCE {
+		t.Errorf("drifting east: got gws %f, want 0", gws)
+	}
+}
+
+func TestCorrectForHeel(t *testing.T) {
+
+	tests := []struct {
+		name string
+		awa  float64
+		aws  float64
+		heel float64
+		want func(awa float64, aws float64) bool
+	}{
+		{"upright", 40, 15, 0, func(awa float64, aws float64) bool { return sameAngle(awa, 40) && aws == 15 }},
+		{"beam", 90, 10, 20, func(awa float64, aws float64) bool {
+			return sameAngle(awa, 90) && math.Abs(aws-10/math.Cos(20*math.Pi/180)) < TOLERANCE
+		}},
+		{"heeled to port", 90, 10, -20, func(awa float64, aws float64) bool {
+			return sameAngle(awa, 90) && math.Abs(aws-10/math.Cos(20*math.Pi/180)) < TOLERANCE
+		}},
+		{"head to wind", 0, 10, 25, func(awa float64, aws float64) bool { return sameAngle(awa, 0) && math.Abs(aws-10) < TOLERANCE }},
+		{"dead downwind", 180, 10, 25, func(awa float64, aws float64) bool { return sameAngle(awa, 180) && math.Abs(aws-10) < TOLERANCE }},
+		{"close hauled starboard", 30, 15, 25, func(awa float64, aws float64) bool { return awa > 30 && awa < 90 && aws > 15 }},
+		{"close hauled port", 330, 15, 25, func(awa float64, aws float64) bool { return awa > 270 && awa < 330 && aws > 15 }},
+		{"knocked down", 60, 15, 85, func(awa float64, aws float64) bool { return awa == 60 && aws == 15 }},
+	}
+
+	for _, tt := range tests {
+		awa, aws := CorrectForHeel(tt.awa, tt.aws, tt.heel)
+		if !tt.want(awa, aws) {
+			t.Errorf("%s: got awa %f aws %f", tt.name, awa, aws)
+		}
+	}
+}
+
+func TestEstimateLeeway(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		awa    float64
+		heel   float64
+		stw    float64
+		k      float64
+		leeway float64
+	}{
+		{"starboard tack slips to port", 40, 20, 6, 10, -10 * 20 / 36.0},
+		{"port tack slips to starboard", 320, 20, 6, 10, 10 * 20 / 36.0},
+		{"heel sign doesnt matter", 40, -20, 6, 10, -10 * 20 / 36.0},
+		{"wind angle past 360", 400, 20, 6, 10, -10 * 20 / 36.0},
+		{"upright", 40, 0, 6, 10, 0},
+		{"stopped", 40, 20, 0, 10, 0},
+		{"no coefficient", 40, 20, 6, 0, 0},
+		{"nearly stopped starboard", 40, 20, 0.5, 10, -MAX_LEEWAY},
+		{"nearly stopped port", 320, 20, 0.5, 10, MAX_LEEWAY},
+	}
+
+	for _, tt := range tests {
+		if got := EstimateLeeway(tt.awa, tt.heel, tt.stw, tt.k); math.Abs(got-tt.leeway) > TOLERANCE {
+			t.Errorf("%s: got %f, want %f", tt.name, got, tt.leeway)
+		}
+	}
+}